@@ -22,3 +22,22 @@ func authMiddleware(token string, next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// wsAuthMiddleware is authMiddleware for WebSocket endpoints. Browsers cannot
+// set headers on the handshake, so the token may also be passed as ?token=.
+func wsAuthMiddleware(token string, next http.Handler) http.Handler {
+	tokenBytes := []byte(token)
+	headerAuth := authMiddleware(token, next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		provided := r.URL.Query().Get("token")
+		if provided == "" {
+			headerAuth.ServeHTTP(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), tokenBytes) != 1 {
+			http.Error(w, `{"error":"invalid token"}`, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
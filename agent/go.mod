@@ -5,4 +5,5 @@ go 1.22
 require (
 	github.com/creack/pty v1.1.24
 	github.com/gorilla/websocket v1.5.3
+	github.com/klauspost/compress v1.17.11
 )
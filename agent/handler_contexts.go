@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/angelorc/vmsan/agent/internal/execctx"
+	"github.com/angelorc/vmsan/agent/internal/sysuser"
+)
+
+// volatileEnv are shell-maintained variables that are never carried over
+// from one command of a context to the next.
+var volatileEnv = map[string]bool{
+	"PWD":    true,
+	"OLDPWD": true,
+	"SHLVL":  true,
+	"_":      true,
+}
+
+type contextRequest struct {
+	Cwd  string            `json:"cwd,omitempty"`
+	Env  map[string]string `json:"env,omitempty"`
+	User string            `json:"user,omitempty"`
+}
+
+// contextStateFile creates the file a shell-mode command in a context dumps
+// its final working directory and environment to. The file is unlinked
+// right away: the command writes to it through an inherited descriptor, so
+// it cannot be swapped for something else before the agent reads it back.
+func contextStateFile() (*os.File, error) {
+	f, err := os.CreateTemp("", "vmsan-ctx-*")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Remove(f.Name()); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// contextStateFD is the descriptor a context's command inherits its state
+// file on, i.e. the first of exec.Cmd.ExtraFiles.
+const contextStateFD = 3
+
+// contextTrap is prepended to a context's shell script so that, however the
+// script exits, its working directory and environment end up in the state
+// file on contextStateFD.
+func contextTrap() string {
+	return fmt.Sprintf(`trap 'vmsan_rc=$?; { pwd; printf "\0"; env -0; } >&%d; exit $vmsan_rc' EXIT`, contextStateFD) + "\n"
+}
+
+// updateContext reads the state a command left in f, records it on ctx as
+// changes relative to the environment the command started with, and closes
+// f. A command killed before its trap ran leaves the context unchanged.
+func updateContext(ctx *execctx.Context, f *os.File, startEnv []string) error {
+	defer f.Close()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	cwd, envData, ok := bytes.Cut(data, []byte{0})
+	if !ok {
+		return errors.New("no state recorded")
+	}
+	var env []string
+	for _, kv := range bytes.Split(envData, []byte{0}) {
+		if len(kv) > 0 {
+			env = append(env, string(kv))
+		}
+	}
+	ctx.Update(strings.TrimSuffix(string(cwd), "\n"), startEnv, env, volatileEnv)
+	return nil
+}
+
+func makeContextCreateHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req contextRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		if req.User == "" {
+			req.User = defaultUser
+		}
+		if req.User != "" {
+			if _, err := sysuser.Resolve(req.User); err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"resolve user: %s"}`, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx, err := execctx.Create(req.User, req.Cwd, req.Env)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err), http.StatusTooManyRequests)
+			return
+		}
+		logger.Info("context.created", "context_id", ctx.ID, "user", req.User, "cwd", req.Cwd)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(ctx.Info())
+	}
+}
+
+// handleListContexts returns JSON info for all exec contexts.
+func handleListContexts(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(execctx.List())
+}
+
+// handleGetContext returns JSON info for a single exec context.
+func handleGetContext(w http.ResponseWriter, r *http.Request) {
+	ctx := execctx.Get(r.PathValue("id"))
+	if ctx == nil {
+		http.Error(w, `{"error":"context not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ctx.Info())
+}
+
+// handleDeleteContext removes an exec context. Commands already running in
+// it are not affected.
+func handleDeleteContext(w http.ResponseWriter, r *http.Request) {
+	if !execctx.Remove(r.PathValue("id")) {
+		http.Error(w, `{"error":"context not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/angelorc/vmsan/agent/internal/execctx"
+)
+
+func TestContextTrap_CarriesCwdAndEnvOver(t *testing.T) {
+	ctx, err := execctx.Create("", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer execctx.Remove(ctx.ID)
+
+	state, err := contextStateFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := state.Stat(); err != nil || info.Sys().(*syscall.Stat_t).Nlink != 0 {
+		t.Fatalf("expected the state file to be unlinked, got %v", err)
+	}
+	dir := t.TempDir()
+	cmd := buildShellCommand("/bin/bash", contextTrap()+"cd "+dir+"; export VMSAN_X='a b'; unset HOME; exit 3", nil, false, false)
+	start := cmd.Environ()
+	cmd.Env = start
+	cmd.ExtraFiles = []*os.File{state}
+	if err := cmd.Run(); err == nil {
+		t.Fatal("expected the script's exit status to be preserved")
+	}
+	if err := updateContext(ctx, state, start); err != nil {
+		t.Fatal(err)
+	}
+
+	info := ctx.Info()
+	if info.Cwd != dir {
+		t.Fatalf("expected cwd %q, got %q", dir, info.Cwd)
+	}
+	if info.Env["VMSAN_X"] != "a b" {
+		t.Fatalf("expected VMSAN_X to be recorded, got %v", info.Env)
+	}
+	if _, ok := info.Env["PWD"]; ok {
+		t.Fatalf("expected PWD to be ignored, got %v", info.Env)
+	}
+	if len(info.Unset) != 1 || info.Unset[0] != "HOME" {
+		t.Fatalf("expected HOME to be unset, got %v", info.Unset)
+	}
+}
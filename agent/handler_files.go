@@ -10,25 +10,33 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"syscall"
 	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/sysuser"
 )
 
 const maxTarUploadBytes = 1 << 30 // 1GB
 
-func makeFilesWriteHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+func makeFilesWriteHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		handleFilesWrite(w, r, logger)
+		handleFilesWrite(w, r, logger, defaultUser)
 	}
 }
 
-func makeFilesReadHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+func makeFilesReadHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
-		handleFilesRead(w, r, logger)
+		handleFilesRead(w, r, logger, defaultUser)
 	}
 }
 
-func handleFilesWrite(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+// handleFilesWrite extracts a gzipped tar into X-Extract-Dir as the X-User
+// user (the default user if unset), so the upload is subject to that user's
+// permissions and owned by them. Symlinks, hardlinks, modes and times are
+// preserved; links may not point outside the extract dir. Writing as root,
+// files get the archive's ownership, or that of the X-Owner user when the
+// header is set.
+func handleFilesWrite(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defaultUser string) {
 	start := time.Now()
 
 	extractDir := r.Header.Get("X-Extract-Dir")
@@ -43,90 +51,127 @@ func handleFilesWrite(w http.ResponseWriter, r *http.Request, logger *slog.Logge
 		return
 	}
 
+	username := r.Header.Get("X-User")
+	if username == "" {
+		username = defaultUser
+	}
+	creds, err := sysuser.Resolve(username)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"X-User: %s"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	var owner *fileOwner
+	if name := r.Header.Get("X-Owner"); name != "" {
+		ownerCreds, err := sysuser.Resolve(name)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"X-Owner: %s"}`, err), http.StatusBadRequest)
+			return
+		}
+		if creds.Uid != 0 && ownerCreds.Uid != creds.Uid {
+			http.Error(w, `{"error":"X-Owner requires writing as root"}`, http.StatusBadRequest)
+			return
+		}
+		owner = &fileOwner{uid: int(ownerCreds.Uid), gid: int(ownerCreds.Gid)}
+	}
+
 	logger.Info("files.write",
 		"extract_dir", extractDir,
+		"user", creds.Username,
+		"owner", r.Header.Get("X-Owner"),
 		"content_length", r.ContentLength,
 	)
 
-	lr := &io.LimitedReader{R: r.Body, N: maxTarUploadBytes + 1}
-	gz, err := gzip.NewReader(lr)
+	var x *tarExtractor
+	err = creds.RunAs(func() error {
+		var err error
+		x, err = newTarExtractor(extractDir, owner, creds.Uid == 0)
+		if err != nil {
+			return err
+		}
+		return extractTarGz(x, r.Body)
+	})
 	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"gzip: %s"}`, err), http.StatusBadRequest)
+		filesError(w, err)
 		return
 	}
+	if len(x.skipped) > 0 {
+		logger.Warn("files.write.skipped", "extract_dir", extractDir, "entries", x.skipped)
+	}
+
+	logger.Info("files.write.done",
+		"extract_dir", extractDir,
+		"user", creds.Username,
+		"files_written", x.filesWritten,
+		"links_written", x.linksWritten,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"filesWritten": x.filesWritten,
+		"linksWritten": x.linksWritten,
+		"skipped":      len(x.skipped),
+	})
+}
+
+// extractTarGz extracts the gzipped tar read from body, up to
+// maxTarUploadBytes of it, with x.
+func extractTarGz(x *tarExtractor, body io.Reader) error {
+	lr := &io.LimitedReader{R: body, N: maxTarUploadBytes + 1}
+	gz, err := gzip.NewReader(lr)
+	if err != nil {
+		return badEntry("gzip: %s", err)
+	}
 	defer gz.Close()
 
 	tr := tar.NewReader(gz)
-	filesWritten := 0
-
 	for {
 		header, err := tr.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			http.Error(w, fmt.Sprintf(`{"error":"tar: %s"}`, err), http.StatusBadRequest)
-			return
+			return badEntry("tar: %s", err)
 		}
-
-		// Path traversal protection.
-		target := filepath.Join(extractDir, header.Name)
-		if !strings.HasPrefix(filepath.Clean(target), filepath.Clean(extractDir)+string(os.PathSeparator)) &&
-			filepath.Clean(target) != filepath.Clean(extractDir) {
-			http.Error(w, `{"error":"path traversal detected"}`, http.StatusBadRequest)
-			return
-		}
-
-		switch header.Typeflag {
-		case tar.TypeDir:
-			if err := os.MkdirAll(target, os.FileMode(header.Mode)); err != nil {
-				http.Error(w, fmt.Sprintf(`{"error":"mkdir: %s"}`, err), http.StatusInternalServerError)
-				return
-			}
-		case tar.TypeReg:
-			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
-				http.Error(w, fmt.Sprintf(`{"error":"mkdir: %s"}`, err), http.StatusInternalServerError)
-				return
-			}
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode))
-			if err != nil {
-				http.Error(w, fmt.Sprintf(`{"error":"create: %s"}`, err), http.StatusInternalServerError)
-				return
-			}
-			if _, err := io.Copy(f, tr); err != nil {
-				f.Close()
-				http.Error(w, fmt.Sprintf(`{"error":"write: %s"}`, err), http.StatusInternalServerError)
-				return
-			}
-			f.Close()
-			filesWritten++
+		if err := x.extract(header, tr); err != nil {
+			return err
 		}
 
 		if lr.N <= 0 {
-			http.Error(w, `{"error":"upload exceeds 1GB limit"}`, http.StatusRequestEntityTooLarge)
-			return
+			return &extractError{http.StatusRequestEntityTooLarge, "upload exceeds 1GB limit"}
 		}
 	}
+	return x.finish()
+}
 
-	logger.Info("files.write.done",
-		"extract_dir", extractDir,
-		"files_written", filesWritten,
-		"duration_ms", time.Since(start).Milliseconds(),
-	)
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"filesWritten": filesWritten,
-	})
+// filesError writes err as a JSON error, with its status if it is an
+// extractError.
+func filesError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*extractError); ok {
+		status = e.status
+	}
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	http.Error(w, string(body), status)
 }
 
 type readRequest struct {
 	Path string `json:"path"`
+	User string `json:"user,omitempty"` // defaults to the agent's default user
 }
 
-func handleFilesRead(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+// handleFilesRead streams a file, opened as the requested user so that files
+// the user cannot read are denied. The request is a JSON body for POST and
+// query parameters for GET. Range requests are answered with 206, with the
+// file's ETag and Last-Modified, so an interrupted download can be resumed;
+// If-Range and the other conditional headers apply to GET only.
+func handleFilesRead(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defaultUser string) {
 	var req readRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if r.Method == http.MethodGet {
+		req.Path = r.URL.Query().Get("path")
+		req.User = r.URL.Query().Get("user")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
 		return
 	}
@@ -142,33 +187,61 @@ func handleFilesRead(w http.ResponseWriter, r *http.Request, logger *slog.Logger
 		return
 	}
 
-	info, err := os.Stat(cleanPath)
+	if req.User == "" {
+		req.User = defaultUser
+	}
+	creds, err := sysuser.Resolve(req.User)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"user: %s"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	var f *os.File
+	err = creds.RunAs(func() error {
+		var err error
+		f, err = os.Open(cleanPath)
+		return err
+	})
 	if err != nil {
-		if os.IsNotExist(err) {
+		switch {
+		case os.IsNotExist(err):
 			http.Error(w, `{"error":"file not found"}`, http.StatusNotFound)
-			return
+		case os.IsPermission(err):
+			http.Error(w, `{"error":"permission denied"}`, http.StatusForbidden)
+		default:
+			http.Error(w, fmt.Sprintf(`{"error":"open: %s"}`, err), http.StatusInternalServerError)
 		}
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"error":"stat: %s"}`, err), http.StatusInternalServerError)
 		return
 	}
 	if info.IsDir() {
-		http.Error(w, `{"error":"path is a directory"}`, http.StatusBadRequest)
+		http.Error(w, `{"error":"path is a directory, use /files/archive"}`, http.StatusBadRequest)
 		return
 	}
 
 	logger.Info("files.read",
 		"path", cleanPath,
+		"user", creds.Username,
 		"size", info.Size(),
 	)
 
-	f, err := os.Open(cleanPath)
-	if err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"open: %s"}`, err), http.StatusInternalServerError)
-		return
-	}
-	defer f.Close()
-
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", info.Size()))
-	io.Copy(w, f)
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// fileETag identifies a version of a file by its inode, size and
+// modification time.
+func fileETag(info os.FileInfo) string {
+	var ino uint64
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		ino = st.Ino
+	}
+	return fmt.Sprintf(`"%x-%x-%x"`, ino, info.Size(), info.ModTime().UnixNano())
 }
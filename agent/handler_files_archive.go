@@ -0,0 +1,356 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/globs"
+	"github.com/angelorc/vmsan/agent/internal/sysuser"
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveRequest selects the files POST /files/archive streams.
+type archiveRequest struct {
+	Path   string `json:"path"`
+	User   string `json:"user,omitempty"`   // defaults to the agent's default user
+	Format string `json:"format,omitempty"` // tar, tar.gz (default) or tar.zst
+
+	// Include, if set, keeps only the files matching one of its globs;
+	// Exclude drops files and directories matching one of its globs. Globs
+	// match paths relative to Path; "**" matches any number of directories
+	// and a glob without a slash matches names at any depth.
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Gitignore drops what the .gitignore files inside Path ignore, and
+	// .git directories.
+	Gitignore bool `json:"gitignore,omitempty"`
+
+	// Symlinks is preserve (default) to store symlinks as such, follow to
+	// store what they point to, or skip.
+	Symlinks string `json:"symlinks,omitempty"`
+}
+
+var archiveContentTypes = map[string]string{
+	"tar":     "application/x-tar",
+	"tar.gz":  "application/gzip",
+	"tar.zst": "application/zstd",
+}
+
+// archiver writes a directory tree to a tar stream.
+type archiver struct {
+	req    archiveRequest
+	tw     *tar.Writer
+	ignore *globs.GitIgnore
+
+	dirs    map[string]bool // directory entries already written
+	visited map[[2]uint64]bool
+	files   int
+	skipped []string
+}
+
+func makeFilesArchiveHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleFilesArchive(w, r, logger, defaultUser)
+	}
+}
+
+// handleFilesArchive streams a directory (or a single file) as a tar
+// archive, read as the requested user. Entries are relative to the path.
+// Files that cannot be read are left out and logged; an error after the
+// stream started aborts it.
+func handleFilesArchive(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defaultUser string) {
+	start := time.Now()
+
+	var req archiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, `{"error":"path is required"}`, http.StatusBadRequest)
+		return
+	}
+	req.Path = filepath.Clean(req.Path)
+	if !filepath.IsAbs(req.Path) {
+		http.Error(w, `{"error":"path must be absolute"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Format == "" {
+		req.Format = "tar.gz"
+	}
+	if archiveContentTypes[req.Format] == "" {
+		http.Error(w, `{"error":"format must be tar, tar.gz or tar.zst"}`, http.StatusBadRequest)
+		return
+	}
+	switch req.Symlinks {
+	case "":
+		req.Symlinks = "preserve"
+	case "preserve", "follow", "skip":
+	default:
+		http.Error(w, `{"error":"symlinks must be preserve, follow or skip"}`, http.StatusBadRequest)
+		return
+	}
+	for _, p := range append(append([]string{}, req.Include...), req.Exclude...) {
+		if _, err := path.Match(p, ""); err != nil {
+			body, _ := json.Marshal(map[string]string{"error": fmt.Sprintf("invalid glob %q", p)})
+			http.Error(w, string(body), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if req.User == "" {
+		req.User = defaultUser
+	}
+	creds, err := sysuser.Resolve(req.User)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"user: %s"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	logger.Info("files.archive",
+		"path", req.Path,
+		"user", creds.Username,
+		"format", req.Format,
+	)
+
+	a := &archiver{req: req, dirs: map[string]bool{}, visited: map[[2]uint64]bool{}}
+	if req.Gitignore {
+		a.ignore = &globs.GitIgnore{}
+	}
+	started := false
+	err = creds.RunAs(func() error {
+		info, err := os.Stat(req.Path)
+		if err != nil {
+			return err
+		}
+		// Check access up front, while an error can still be reported.
+		f, err := os.Open(req.Path)
+		if err != nil {
+			return err
+		}
+		f.Close()
+
+		name := filepath.Base(req.Path)
+		if name == "/" {
+			name = "root"
+		}
+		w.Header().Set("Content-Type", archiveContentTypes[req.Format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+req.Format))
+		started = true
+
+		var out io.WriteCloser
+		switch req.Format {
+		case "tar.gz":
+			out = gzip.NewWriter(w)
+		case "tar.zst":
+			out, err = zstd.NewWriter(w)
+			if err != nil {
+				return err
+			}
+		default:
+			out = nopWriteCloser{w}
+		}
+		a.tw = tar.NewWriter(out)
+
+		if info.IsDir() {
+			err = a.walkDir(req.Path, "", info)
+		} else {
+			err = a.addFile(req.Path, info.Name(), info, "")
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.tw.Close(); err != nil {
+			return err
+		}
+		return out.Close()
+	})
+	if err != nil {
+		if !started {
+			switch {
+			case os.IsNotExist(err):
+				http.Error(w, `{"error":"path not found"}`, http.StatusNotFound)
+			case os.IsPermission(err):
+				http.Error(w, `{"error":"permission denied"}`, http.StatusForbidden)
+			default:
+				http.Error(w, fmt.Sprintf(`{"error":"stat: %s"}`, err), http.StatusInternalServerError)
+			}
+			return
+		}
+		// Reset the connection so the client sees a failed transfer rather
+		// than a truncated archive.
+		logger.Warn("files.archive.aborted", "path", req.Path, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+	if len(a.skipped) > 0 {
+		logger.Warn("files.archive.skipped", "path", req.Path, "entries", a.skipped)
+	}
+
+	logger.Info("files.archive.done",
+		"path", req.Path,
+		"files", a.files,
+		"skipped", len(a.skipped),
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// walkDir archives the content of the directory dir, whose path in the
+// archive is rel ("" for the root).
+func (a *archiver) walkDir(dir, rel string, info fs.FileInfo) error {
+	// With symlinks followed, a link to an ancestor would recurse forever.
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		key := [2]uint64{uint64(st.Dev), st.Ino}
+		if a.visited[key] {
+			a.skipped = append(a.skipped, rel+" (symlink loop)")
+			return nil
+		}
+		a.visited[key] = true
+		defer delete(a.visited, key)
+	}
+
+	if a.ignore != nil {
+		if err := a.ignore.Load(dir, rel); err != nil {
+			a.skipped = append(a.skipped, path.Join(rel, ".gitignore"))
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if rel == "" {
+			return err
+		}
+		a.skipped = append(a.skipped, rel)
+		return nil
+	}
+
+	for _, e := range entries {
+		abs := filepath.Join(dir, e.Name())
+		name := path.Join(rel, e.Name())
+
+		info, err := os.Lstat(abs)
+		if err != nil {
+			a.skipped = append(a.skipped, name)
+			continue
+		}
+		link := ""
+		if info.Mode()&fs.ModeSymlink != 0 {
+			switch a.req.Symlinks {
+			case "skip":
+				continue
+			case "follow":
+				if info, err = os.Stat(abs); err != nil {
+					a.skipped = append(a.skipped, name)
+					continue
+				}
+			default:
+				if link, err = os.Readlink(abs); err != nil {
+					a.skipped = append(a.skipped, name)
+					continue
+				}
+			}
+		}
+
+		isDir := info.IsDir()
+		if a.ignore != nil && (isDir && e.Name() == ".git" || a.ignore.Ignored(name, isDir)) {
+			continue
+		}
+		if globs.MatchAny(a.req.Exclude, name) {
+			continue
+		}
+		if isDir {
+			if len(a.req.Include) == 0 {
+				if err := a.addDir(name); err != nil {
+					return err
+				}
+			}
+			if err := a.walkDir(abs, name, info); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(a.req.Include) > 0 && !globs.MatchAny(a.req.Include, name) {
+			continue
+		}
+		if err := a.addFile(abs, name, info, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addDir writes the entry of the directory rel, and of its parents if they
+// were not written yet.
+func (a *archiver) addDir(rel string) error {
+	if rel == "." || a.dirs[rel] {
+		return nil
+	}
+	if err := a.addDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	a.dirs[rel] = true
+	info, err := os.Stat(filepath.Join(a.req.Path, rel))
+	if err != nil {
+		a.skipped = append(a.skipped, rel)
+		return nil
+	}
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	header.Name = rel + "/"
+	return a.tw.WriteHeader(header)
+}
+
+// addFile writes the entry of a regular file or, if link is set, a
+// symlink. Other file types are skipped.
+func (a *archiver) addFile(abs, rel string, info fs.FileInfo, link string) error {
+	if link == "" && !info.Mode().IsRegular() {
+		a.skipped = append(a.skipped, rel)
+		return nil
+	}
+	var f *os.File
+	if link == "" {
+		var err error
+		if f, err = os.Open(abs); err != nil {
+			a.skipped = append(a.skipped, rel)
+			return nil
+		}
+		defer f.Close()
+	}
+
+	if err := a.addDir(path.Dir(rel)); err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = rel
+	if err := a.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if f != nil {
+		// A file that shrank while being read fails the stream rather
+		// than producing a corrupt archive.
+		if _, err := io.CopyN(a.tw, f, header.Size); err != nil {
+			return fmt.Errorf("%s: %w", rel, err)
+		}
+	}
+	a.files++
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// archiveNames requests an archive of dir with the given extra JSON fields
+// and returns its entries as "name" or "name -> link".
+func archiveNames(t *testing.T, dir, fields string) []string {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	body := fmt.Sprintf(`{"path":%q%s}`, dir, fields)
+	rec := httptest.NewRecorder()
+	handleFilesArchive(rec, httptest.NewRequest("POST", "/files/archive", strings.NewReader(body)), logger, "root")
+	if rec.Code != 200 {
+		t.Fatalf("unexpected response %d %s", rec.Code, rec.Body)
+	}
+
+	var r io.Reader = rec.Body
+	if strings.Contains(fields, "tar.zst") {
+		zr, err := zstd.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	var names []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := header.Name
+		if header.Typeflag == tar.TypeSymlink {
+			name += " -> " + header.Linkname
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestHandleFilesArchive_Filters(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		".gitignore":              "node_modules/\n*.log\n",
+		".git/HEAD":               "ref: refs/heads/main\n",
+		"node_modules/x/index.js": "",
+		"dist/app.js":             "console.log(1)\n",
+		"dist/app.js.map":         "{}",
+		"dist/debug.log":          "",
+		"src/main.ts":             "",
+	} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644)
+	}
+	os.Symlink("dist/app.js", filepath.Join(dir, "latest.js"))
+
+	for _, tc := range []struct {
+		fields string
+		want   []string
+	}{
+		{`,"format":"tar","gitignore":true`, []string{".gitignore", "dist/", "dist/app.js", "dist/app.js.map", "latest.js -> dist/app.js", "src/", "src/main.ts"}},
+		{`,"format":"tar.zst","gitignore":true,"exclude":["*.map"],"symlinks":"skip"`, []string{".gitignore", "dist/", "dist/app.js", "src/", "src/main.ts"}},
+		{`,"format":"tar","include":["*.js"],"exclude":["node_modules"],"symlinks":"follow"`, []string{"dist/", "dist/app.js", "latest.js"}},
+	} {
+		got := archiveNames(t, dir, tc.fields)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.fields, got, tc.want)
+		}
+	}
+}
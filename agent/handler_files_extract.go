@@ -0,0 +1,462 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// fileOwner is a uid/gid pair files are chowned to.
+type fileOwner struct {
+	uid, gid int
+}
+
+// extractError is an extraction failure and the HTTP status it maps to.
+type extractError struct {
+	status int
+	msg    string
+}
+
+func (e *extractError) Error() string { return e.msg }
+
+func badEntry(format string, args ...any) error {
+	return &extractError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// fsError reports a failed filesystem operation: 403 if the user lacks the
+// permission, else 500.
+func fsError(op string, err error) error {
+	status := http.StatusInternalServerError
+	if errors.Is(err, fs.ErrPermission) {
+		status = http.StatusForbidden
+	}
+	return &extractError{status, fmt.Sprintf("%s: %s", op, err)}
+}
+
+// tarExtractor writes tar entries below root, recreating directories,
+// regular files, symlinks, hardlinks and FIFOs with their mode, times and
+// ownership. Ownership is forced to owner when set, and otherwise taken from
+// the archive (by name when the name exists here, else by id) if keepOwner
+// is set.
+type tarExtractor struct {
+	root      string
+	realRoot  string // root with symlinks resolved
+	owner     *fileOwner
+	keepOwner bool
+
+	uids, gids map[string]int
+	dirTimes   []dirTimes
+	symlinks   []string // written symlinks, checked again once all exist
+
+	filesWritten int
+	linksWritten int
+	skipped      []string
+}
+
+type dirTimes struct {
+	path         string
+	atime, mtime time.Time
+}
+
+func newTarExtractor(root string, owner *fileOwner, keepOwner bool) (*tarExtractor, error) {
+	x := &tarExtractor{root: root, owner: owner, keepOwner: keepOwner, uids: map[string]int{}, gids: map[string]int{}}
+	if err := x.mkdirAll(root); err != nil {
+		return nil, fsError("mkdir", err)
+	}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil, fsError("resolve extract dir", err)
+	}
+	x.realRoot = real
+	return x, nil
+}
+
+// withinDir reports whether path is dir or below it. Both must be clean.
+func withinDir(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// resolve maps an archive path to its location below root, rejecting paths
+// that escape it.
+func (x *tarExtractor) resolve(name string) (string, error) {
+	target := filepath.Join(x.root, name)
+	if !withinDir(x.root, target) {
+		return "", badEntry("path traversal detected")
+	}
+	return target, nil
+}
+
+// checkResolved makes sure that path, after following the symlinks that
+// already exist along it, is still below root, so writing there cannot
+// escape through a symlink.
+func (x *tarExtractor) checkResolved(path string) error {
+	for dir := path; ; {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			if !withinDir(x.realRoot, real) {
+				return badEntry("path traversal detected")
+			}
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			// EvalSymlinks does not wrap ELOOP; ask stat.
+			if _, serr := os.Stat(dir); errors.Is(serr, syscall.ELOOP) {
+				return badEntry("symlink loop at %s", dir)
+			}
+			return fsError("resolve", err)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
+
+// followLink resolves name the way the kernel follows a symlink found in
+// the resolved directory dir: symlinks that exist along the way are
+// followed, missing components are taken as they are.
+func followLink(dir, name string, depth int) (string, error) {
+	if depth > 40 {
+		return "", syscall.ELOOP
+	}
+	cur := dir
+	if filepath.IsAbs(name) {
+		cur = "/"
+	}
+	for _, part := range strings.Split(name, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			cur = filepath.Dir(cur)
+			continue
+		}
+		next := filepath.Join(cur, part)
+		info, err := os.Lstat(next)
+		switch {
+		case err == nil && info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(next)
+			if err != nil {
+				return "", err
+			}
+			if next, err = followLink(cur, link, depth+1); err != nil {
+				return "", err
+			}
+		case err != nil && !os.IsNotExist(err):
+			return "", err
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+// checkLink makes sure that the symlink at path pointing to linkname
+// resolves below root when followed. Links that loop cannot be followed
+// anywhere and pass.
+func (x *tarExtractor) checkLink(path, linkname string) error {
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return fsError("resolve", err)
+	}
+	dest, err := followLink(dir, linkname, 0)
+	if errors.Is(err, syscall.ELOOP) {
+		return nil
+	}
+	if err != nil {
+		return fsError("resolve", err)
+	}
+	if !withinDir(x.realRoot, dest) {
+		return badEntry("symlink %s points outside the extract dir", strings.TrimPrefix(path, x.root+"/"))
+	}
+	return nil
+}
+
+// mkdirAll creates path and any missing parents. New directories are
+// chowned to the forced owner, if any, so that it can write into them.
+func (x *tarExtractor) mkdirAll(path string) error {
+	if info, err := os.Stat(path); err == nil {
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err := x.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(path, 0o755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	if x.owner != nil {
+		return os.Lchown(path, x.owner.uid, x.owner.gid)
+	}
+	return nil
+}
+
+// prepare creates the parent directory of target and removes whatever
+// non-directory is in the way, so that it is replaced rather than written
+// through.
+func (x *tarExtractor) prepare(target string) error {
+	if err := x.checkResolved(filepath.Dir(target)); err != nil {
+		return err
+	}
+	if err := x.mkdirAll(filepath.Dir(target)); err != nil {
+		return fsError("mkdir", err)
+	}
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return fsError("remove", err)
+		}
+	}
+	return nil
+}
+
+// extract writes one entry, reading a regular file's content from r.
+func (x *tarExtractor) extract(header *tar.Header, r io.Reader) error {
+	target, err := x.resolve(header.Name)
+	if err != nil {
+		return err
+	}
+	mode := header.FileInfo().Mode()
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := x.checkResolved(target); err != nil {
+			return err
+		}
+		if target == x.root {
+			// A "./" entry describes the extract dir, which is left as it
+			// is.
+			return nil
+		}
+		if err := x.mkdirAll(target); err != nil {
+			return fsError("mkdir", err)
+		}
+		if err := x.setAttrs(header, target, mode); err != nil {
+			return err
+		}
+		// Directory times are set last, as extracting their content
+		// changes them.
+		if !header.ModTime.IsZero() {
+			x.dirTimes = append(x.dirTimes, dirTimes{target, accessTime(header), header.ModTime})
+		}
+		return nil
+
+	case tar.TypeReg:
+		if err := x.prepare(target); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|syscall.O_NOFOLLOW, 0o600)
+		if err != nil {
+			return fsError("create", err)
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return fsError("write", err)
+		}
+		if err := f.Close(); err != nil {
+			return fsError("write", err)
+		}
+		if err := x.setAttrs(header, target, mode); err != nil {
+			return err
+		}
+		if !header.ModTime.IsZero() {
+			if err := os.Chtimes(target, accessTime(header), header.ModTime); err != nil {
+				return fsError("chtimes", err)
+			}
+		}
+		x.filesWritten++
+		return nil
+
+	case tar.TypeSymlink:
+		// The link may only point inside root. It is resolved from the
+		// directory it is actually created in, through the symlinks
+		// already extracted.
+		if err := x.prepare(target); err != nil {
+			return err
+		}
+		if err := x.checkLink(target, header.Linkname); err != nil {
+			return err
+		}
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			return fsError("symlink", err)
+		}
+		x.symlinks = append(x.symlinks, target)
+		if err := x.chown(header, target); err != nil {
+			return err
+		}
+		if !header.ModTime.IsZero() {
+			if err := lutimes(target, accessTime(header), header.ModTime); err != nil {
+				return fsError("chtimes", err)
+			}
+		}
+		x.linksWritten++
+		return nil
+
+	case tar.TypeLink:
+		source, err := x.resolve(header.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := x.checkResolved(filepath.Dir(source)); err != nil {
+			return err
+		}
+		if err := x.prepare(target); err != nil {
+			return err
+		}
+		if err := os.Link(source, target); err != nil {
+			return fsError("link", err)
+		}
+		x.linksWritten++
+		return nil
+
+	case tar.TypeFifo:
+		if err := x.prepare(target); err != nil {
+			return err
+		}
+		if err := syscall.Mkfifo(target, 0o600); err != nil {
+			return fsError("mkfifo", err)
+		}
+		if err := x.setAttrs(header, target, mode); err != nil {
+			return err
+		}
+		x.filesWritten++
+		return nil
+
+	case tar.TypeXGlobalHeader:
+		// pax global headers (e.g. git archive's commit id) carry no file.
+		return nil
+
+	default:
+		// Devices and other special files are not recreated.
+		x.skipped = append(x.skipped, header.Name)
+		return nil
+	}
+}
+
+// finish checks the written symlinks again, as a later entry may have
+// changed where one leads, and applies the deferred directory times,
+// deepest first. An escaping symlink is removed.
+func (x *tarExtractor) finish() error {
+	for _, path := range x.symlinks {
+		linkname, err := os.Readlink(path)
+		if err != nil {
+			// Replaced by a later entry.
+			continue
+		}
+		if err := x.checkLink(path, linkname); err != nil {
+			os.Remove(path)
+			return err
+		}
+	}
+	for i := len(x.dirTimes) - 1; i >= 0; i-- {
+		d := x.dirTimes[i]
+		if err := os.Chtimes(d.path, d.atime, d.mtime); err != nil {
+			return fsError("chtimes", err)
+		}
+	}
+	return nil
+}
+
+// setAttrs chowns then chmods path; in that order so that chown does not
+// clear setuid and setgid bits.
+func (x *tarExtractor) setAttrs(header *tar.Header, path string, mode os.FileMode) error {
+	if err := x.chown(header, path); err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return fsError("chmod", err)
+	}
+	return nil
+}
+
+func (x *tarExtractor) chown(header *tar.Header, path string) error {
+	uid, gid := -1, -1
+	switch {
+	case x.owner != nil:
+		uid, gid = x.owner.uid, x.owner.gid
+	case x.keepOwner && os.Geteuid() == 0:
+		uid, gid = x.archiveOwner(header)
+	default:
+		return nil
+	}
+	if err := os.Lchown(path, uid, gid); err != nil {
+		return fsError("chown", err)
+	}
+	return nil
+}
+
+// archiveOwner maps the entry's owner to local ids, preferring names.
+func (x *tarExtractor) archiveOwner(header *tar.Header) (int, int) {
+	uid, gid := header.Uid, header.Gid
+	if header.Uname != "" {
+		id, ok := x.uids[header.Uname]
+		if !ok {
+			id = -1
+			if u, err := user.Lookup(header.Uname); err == nil {
+				id, _ = strconv.Atoi(u.Uid)
+			}
+			x.uids[header.Uname] = id
+		}
+		if id >= 0 {
+			uid = id
+		}
+	}
+	if header.Gname != "" {
+		id, ok := x.gids[header.Gname]
+		if !ok {
+			id = -1
+			if g, err := user.LookupGroup(header.Gname); err == nil {
+				id, _ = strconv.Atoi(g.Gid)
+			}
+			x.gids[header.Gname] = id
+		}
+		if id >= 0 {
+			gid = id
+		}
+	}
+	return uid, gid
+}
+
+func accessTime(header *tar.Header) time.Time {
+	if header.AccessTime.IsZero() {
+		return header.ModTime
+	}
+	return header.AccessTime
+}
+
+const (
+	atFDCWD           = -0x64
+	atSymlinkNoFollow = 0x100
+)
+
+// lutimes sets the times of path without following it if it is a symlink.
+func lutimes(path string, atime, mtime time.Time) error {
+	p, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return err
+	}
+	ts := [2]syscall.Timespec{
+		syscall.NsecToTimespec(atime.UnixNano()),
+		syscall.NsecToTimespec(mtime.UnixNano()),
+	}
+	dirfd := atFDCWD
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&ts[0])), atSymlinkNoFollow, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: path, Err: errno}
+	}
+	return nil
+}
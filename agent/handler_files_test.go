@@ -0,0 +1,252 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func tarGz(t *testing.T, headers []*tar.Header, contents map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, h := range headers {
+		body := contents[h.Name]
+		h.Size = int64(len(body))
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func writeFiles(t *testing.T, dir string, headers map[string]string, archive []byte) (int, map[string]interface{}) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	req := httptest.NewRequest("POST", "/files/write", bytes.NewReader(archive))
+	req.Header.Set("X-Extract-Dir", dir)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	rec := httptest.NewRecorder()
+	handleFilesWrite(rec, req, logger, "root")
+	var resp map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+func TestHandleFilesWrite_LinksAndTimes(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	archive := tarGz(t, []*tar.Header{
+		{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader, PAXRecords: map[string]string{"comment": "0123abcd"}},
+		{Name: "app/", Typeflag: tar.TypeDir, Mode: 0o750, ModTime: mtime},
+		{Name: "app/run.sh", Typeflag: tar.TypeReg, Mode: 0o755, ModTime: mtime},
+		{Name: "app/current", Typeflag: tar.TypeSymlink, Linkname: "run.sh", ModTime: mtime},
+		{Name: "app/hard.sh", Typeflag: tar.TypeLink, Linkname: "app/run.sh"},
+	}, map[string]string{"app/run.sh": "#!/bin/sh\n"})
+
+	code, resp := writeFiles(t, dir, nil, archive)
+	if code != 200 || resp["filesWritten"] != 1.0 || resp["linksWritten"] != 2.0 || resp["skipped"] != 0.0 {
+		t.Fatalf("unexpected response %d %v", code, resp)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "app/run.sh"))
+	if err != nil || info.Mode().Perm() != 0o755 || !info.ModTime().Equal(mtime) {
+		t.Fatalf("expected mode 0755 and mtime %v, got %v %v", mtime, info, err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, "app")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Fatalf("expected the directory mtime to be kept, got %v %v", info, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "app/current")); err != nil || link != "run.sh" {
+		t.Fatalf("expected a symlink to run.sh, got %q %v", link, err)
+	}
+	if info, err := os.Lstat(filepath.Join(dir, "app/current")); err != nil || !info.ModTime().Equal(mtime) {
+		t.Fatalf("expected the symlink mtime to be kept, got %v %v", info, err)
+	}
+	hard, err := os.Stat(filepath.Join(dir, "app/hard.sh"))
+	if err != nil || !os.SameFile(info, hard) {
+		t.Fatalf("expected hard.sh to be a hardlink to run.sh, got %v", err)
+	}
+}
+
+func TestHandleFilesWrite_RejectsEscapes(t *testing.T) {
+	dir := t.TempDir()
+	outside := t.TempDir()
+
+	for name, headers := range map[string][]*tar.Header{
+		"relative symlink": {{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}},
+		"absolute symlink": {{Name: "abs", Typeflag: tar.TypeSymlink, Linkname: "/etc/passwd"}},
+		"hardlink":         {{Name: "pw", Typeflag: tar.TypeLink, Linkname: "../etc/passwd"}},
+		"symlink loop": {
+			{Name: "out", Typeflag: tar.TypeSymlink, Linkname: "out"},
+			{Name: "out/evil", Typeflag: tar.TypeReg, Mode: 0o644},
+		},
+		"symlink through a symlink": {
+			{Name: "dot", Typeflag: tar.TypeSymlink, Linkname: "."},
+			{Name: "up2", Typeflag: tar.TypeSymlink, Linkname: "dot/../etc"},
+		},
+		"symlink redirected by a later entry": {
+			{Name: "later", Typeflag: tar.TypeSymlink, Linkname: "here/../etc"},
+			{Name: "here", Typeflag: tar.TypeSymlink, Linkname: "."},
+		},
+	} {
+		if code, resp := writeFiles(t, dir, nil, tarGz(t, headers, nil)); code != 400 {
+			t.Errorf("%s: expected 400, got %d %v", name, code, resp)
+		}
+	}
+
+	if _, err := os.Lstat(filepath.Join(dir, "later")); !os.IsNotExist(err) {
+		t.Errorf("expected the redirected symlink to be removed, got %v", err)
+	}
+
+	// A symlink already in the extract dir that points outside it must not
+	// be written through either.
+	os.Symlink(outside, filepath.Join(dir, "escape"))
+	archive := tarGz(t, []*tar.Header{{Name: "escape/evil", Typeflag: tar.TypeReg, Mode: 0o644}}, nil)
+	if code, resp := writeFiles(t, dir, nil, archive); code != 400 {
+		t.Errorf("expected 400 writing through an existing symlink, got %d %v", code, resp)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "evil")); err == nil {
+		t.Fatal("a file was written outside the extract dir")
+	}
+}
+
+func TestHandleFilesWrite_LeavesExtractDirAlone(t *testing.T) {
+	dir := t.TempDir()
+	os.Chmod(dir, 0o755)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	archive := tarGz(t, []*tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0o700, Uid: 4242, Gid: 4242, ModTime: mtime},
+		{Name: "./file", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, nil)
+
+	if code, resp := writeFiles(t, dir, nil, archive); code != 200 {
+		t.Fatalf("unexpected response %d %v", code, resp)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o755 || info.ModTime().Equal(mtime) {
+		t.Fatalf("expected the extract dir's mode and times to be kept, got %v %v", info.Mode(), info.ModTime())
+	}
+	if uid := info.Sys().(*syscall.Stat_t).Uid; uid == 4242 {
+		t.Fatal("expected the extract dir's owner to be kept")
+	}
+}
+
+func TestHandleFilesWrite_Owner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir := t.TempDir()
+	archive := tarGz(t, []*tar.Header{
+		{Name: "data/file", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 0, Gid: 0},
+	}, map[string]string{"data/file": "x"})
+
+	if code, resp := writeFiles(t, dir, map[string]string{"X-Owner": "nobody"}, archive); code != 200 {
+		t.Fatalf("unexpected response %d %v", code, resp)
+	}
+	for _, name := range []string{"data", "data/file"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid := info.Sys().(*syscall.Stat_t).Uid; uid != 65534 {
+			t.Errorf("expected %s to be owned by nobody, got uid %d", name, uid)
+		}
+	}
+
+	if code, _ := writeFiles(t, dir, map[string]string{"X-Owner": "no-such-user"}, archive); code != 400 {
+		t.Fatalf("expected 400 for an unknown owner, got %d", code)
+	}
+}
+
+func TestHandleFiles_AsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	root := t.TempDir()
+	os.Chmod(filepath.Dir(root), 0o755)
+	home := filepath.Join(root, "home")
+	os.Mkdir(home, 0o755)
+	os.Chown(home, 65534, 65534)
+	archive := tarGz(t, []*tar.Header{
+		{Name: "project/main.go", Typeflag: tar.TypeReg, Mode: 0o644, Uid: 0, Gid: 0},
+	}, map[string]string{"project/main.go": "package main\n"})
+	asNobody := map[string]string{"X-User": "nobody"}
+
+	if code, resp := writeFiles(t, home, asNobody, archive); code != 200 {
+		t.Fatalf("unexpected response %d %v", code, resp)
+	}
+	for _, name := range []string{"project", "project/main.go"} {
+		info, err := os.Stat(filepath.Join(home, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid := info.Sys().(*syscall.Stat_t).Uid; uid != 65534 {
+			t.Errorf("expected %s to be owned by nobody, got uid %d", name, uid)
+		}
+	}
+
+	if code, resp := writeFiles(t, root, asNobody, archive); code != 403 {
+		t.Fatalf("expected 403 writing into a root-owned dir, got %d %v", code, resp)
+	}
+	if code, resp := writeFiles(t, home, map[string]string{"X-User": "nobody", "X-Owner": "root"}, archive); code != 400 {
+		t.Fatalf("expected X-Owner to be refused for a non-root user, got %d %v", code, resp)
+	}
+
+	secret := filepath.Join(root, "secret")
+	os.WriteFile(secret, []byte("x"), 0o600)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for user, want := range map[string]int{"nobody": 403, "root": 200} {
+		rec := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"path":%q,"user":%q}`, secret, user)
+		handleFilesRead(rec, httptest.NewRequest("POST", "/files/read", strings.NewReader(body)), logger, "root")
+		if rec.Code != want {
+			t.Errorf("reading as %s: expected %d, got %d %s", user, want, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestHandleFilesRead_Range(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.bin")
+	os.WriteFile(path, []byte("0123456789"), 0o644)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	req := httptest.NewRequest("GET", "/files/read?path="+path+"&user=root", nil)
+	req.Header.Set("Range", "bytes=4-")
+	rec := httptest.NewRecorder()
+	handleFilesRead(rec, req, logger, "root")
+	etag := rec.Header().Get("ETag")
+	if rec.Code != 206 || rec.Body.String() != "456789" || etag == "" || rec.Header().Get("Last-Modified") == "" {
+		t.Fatalf("expected a partial response with validators, got %d %q %v", rec.Code, rec.Body, rec.Header())
+	}
+
+	// A range conditional on a stale ETag returns the whole file.
+	os.WriteFile(path, []byte("abcdefghijkl"), 0o644)
+	req = httptest.NewRequest("GET", "/files/read?path="+path, nil)
+	req.Header.Set("Range", "bytes=4-")
+	req.Header.Set("If-Range", etag)
+	rec = httptest.NewRecorder()
+	handleFilesRead(rec, req, logger, "root")
+	if rec.Code != 200 || rec.Body.String() != "abcdefghijkl" || rec.Header().Get("ETag") == etag {
+		t.Fatalf("expected the full changed file, got %d %q", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/sysuser"
+	"github.com/angelorc/vmsan/agent/internal/upload"
+)
+
+// uploadRequest opens a resumable upload of a single file.
+type uploadRequest struct {
+	Path string `json:"path"`
+	User string `json:"user,omitempty"` // defaults to the agent's default user
+	Size *int64 `json:"size,omitempty"` // expected size, checked on commit
+	Mode string `json:"mode,omitempty"` // octal, defaults to 0644
+}
+
+type commitRequest struct {
+	SHA256 string `json:"sha256"`
+}
+
+func makeUploadCreateHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleUploadCreate(w, r, logger, defaultUser)
+	}
+}
+
+// handleUploadCreate opens an upload session for a file written as the
+// requested user. Chunks are then sent with PATCH /files/uploads/{id} and
+// the file moved into place by POST /files/uploads/{id}/commit. Sessions
+// idle for a day are discarded.
+func handleUploadCreate(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defaultUser string) {
+	var req uploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, `{"error":"path is required"}`, http.StatusBadRequest)
+		return
+	}
+	path := filepath.Clean(req.Path)
+	if !filepath.IsAbs(path) {
+		http.Error(w, `{"error":"path must be absolute"}`, http.StatusBadRequest)
+		return
+	}
+	size := int64(-1)
+	if req.Size != nil {
+		if *req.Size < 0 {
+			http.Error(w, `{"error":"size must not be negative"}`, http.StatusBadRequest)
+			return
+		}
+		size = *req.Size
+	}
+	mode := os.FileMode(0o644)
+	if req.Mode != "" {
+		m, err := parseMode(req.Mode)
+		if err != nil {
+			http.Error(w, `{"error":"mode must be octal, e.g. 0644"}`, http.StatusBadRequest)
+			return
+		}
+		mode = m.Perm()
+	}
+
+	if req.User == "" {
+		req.User = defaultUser
+	}
+	creds, err := sysuser.Resolve(req.User)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"user: %s"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	s, err := upload.Create(path, creds.Username, size, mode, creds.RunAs)
+	if err != nil {
+		uploadError(w, err)
+		return
+	}
+	logger.Info("files.upload.created",
+		"upload_id", s.ID,
+		"path", path,
+		"user", creds.Username,
+		"size", size,
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.Info())
+}
+
+// handleListUploads returns JSON info for all open upload sessions.
+func handleListUploads(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(upload.List())
+}
+
+// handleGetUpload returns an upload session, including the offset the next
+// chunk must start at.
+func handleGetUpload(w http.ResponseWriter, r *http.Request) {
+	s := upload.Get(r.PathValue("id"))
+	if s == nil {
+		http.Error(w, `{"error":"upload not found"}`, http.StatusNotFound)
+		return
+	}
+	info := s.Info()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+	json.NewEncoder(w).Encode(info)
+}
+
+func makeUploadChunkHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleUploadChunk(w, r, logger)
+	}
+}
+
+// handleUploadChunk appends the request body at ?offset=, which must be the
+// session's current offset. If the body is cut short, the part received is
+// kept; the client asks for the offset and resends from there.
+func handleUploadChunk(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	start := time.Now()
+	s := upload.Get(r.PathValue("id"))
+	if s == nil {
+		http.Error(w, `{"error":"upload not found"}`, http.StatusNotFound)
+		return
+	}
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, `{"error":"offset is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	newOffset, err := s.Write(offset, r.Body)
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	if err != nil {
+		logger.Warn("files.upload.chunk",
+			"upload_id", s.ID,
+			"offset", offset,
+			"received", newOffset-offset,
+			"error", err,
+		)
+		uploadError(w, err)
+		return
+	}
+	logger.Info("files.upload.chunk",
+		"upload_id", s.ID,
+		"offset", offset,
+		"received", newOffset-offset,
+		"duration_ms", time.Since(start).Milliseconds(),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"offset": newOffset})
+}
+
+func makeUploadCommitHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleUploadCommit(w, r, logger)
+	}
+}
+
+// handleUploadCommit verifies the uploaded data against the SHA-256 the
+// client computed and moves the file to its destination. A mismatch
+// discards the upload.
+func handleUploadCommit(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	s := upload.Get(r.PathValue("id"))
+	if s == nil {
+		http.Error(w, `{"error":"upload not found"}`, http.StatusNotFound)
+		return
+	}
+	var req commitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.SHA256 == "" {
+		http.Error(w, `{"error":"sha256 is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	if err := s.Commit(req.SHA256); err != nil {
+		logger.Warn("files.upload.commit", "upload_id", s.ID, "path", s.Path, "error", err)
+		uploadError(w, err)
+		return
+	}
+	info := s.Info()
+	logger.Info("files.upload.committed",
+		"upload_id", s.ID,
+		"path", s.Path,
+		"size", info.Offset,
+		"duration_ms", time.Since(s.CreatedAt).Milliseconds(),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"path":   s.Path,
+		"size":   info.Offset,
+		"sha256": req.SHA256,
+	})
+}
+
+// handleDeleteUpload aborts an upload and deletes its data.
+func handleDeleteUpload(w http.ResponseWriter, r *http.Request) {
+	s := upload.Get(r.PathValue("id"))
+	if s == nil {
+		http.Error(w, `{"error":"upload not found"}`, http.StatusNotFound)
+		return
+	}
+	if err := s.Abort(); err != nil {
+		uploadError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// uploadError maps upload errors to HTTP statuses. Offset errors carry the
+// offset to resume from.
+func uploadError(w http.ResponseWriter, err error) {
+	var oe *upload.OffsetError
+	status := http.StatusInternalServerError
+	body := map[string]interface{}{"error": err.Error()}
+	switch {
+	case errors.As(err, &oe):
+		status = http.StatusConflict
+		body["offset"] = oe.Offset
+	case errors.Is(err, upload.ErrBusy), errors.Is(err, upload.ErrIncomplete):
+		status = http.StatusConflict
+	case errors.Is(err, upload.ErrTooLarge):
+		status = http.StatusRequestEntityTooLarge
+	case errors.Is(err, upload.ErrChecksum):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, upload.ErrTooMany):
+		status = http.StatusTooManyRequests
+	case os.IsPermission(err):
+		status = http.StatusForbidden
+	case os.IsNotExist(err):
+		status = http.StatusNotFound
+	}
+	data, _ := json.Marshal(body)
+	http.Error(w, string(data), status)
+}
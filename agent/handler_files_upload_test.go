@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHandleUploads_ChunkedResume(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /files/uploads", makeUploadCreateHandler(logger, "root"))
+	mux.HandleFunc("GET /files/uploads/{id}", handleGetUpload)
+	mux.HandleFunc("PATCH /files/uploads/{id}", makeUploadChunkHandler(logger))
+	mux.HandleFunc("POST /files/uploads/{id}/commit", makeUploadCommitHandler(logger))
+	do := func(method, url, body string) (int, map[string]interface{}) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(method, url, strings.NewReader(body)))
+		var resp map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	dest := filepath.Join(t.TempDir(), "dataset.csv")
+	data := "a,b\n1,2\n3,4\n"
+	sum := sha256.Sum256([]byte(data))
+
+	code, resp := do("POST", "/files/uploads", fmt.Sprintf(`{"path":%q,"size":%d,"mode":"600"}`, dest, len(data)))
+	if code != 201 {
+		t.Fatalf("unexpected response %d %v", code, resp)
+	}
+	id := resp["id"].(string)
+
+	if code, resp := do("PATCH", "/files/uploads/"+id+"?offset=0", data[:5]); code != 200 || resp["offset"] != 5.0 {
+		t.Fatalf("unexpected chunk response %d %v", code, resp)
+	}
+	if code, resp := do("PATCH", "/files/uploads/"+id+"?offset=0", data); code != 409 || resp["offset"] != 5.0 {
+		t.Fatalf("expected a conflict with the offset to resume from, got %d %v", code, resp)
+	}
+	if code, resp := do("GET", "/files/uploads/"+id, ""); code != 200 || resp["offset"] != 5.0 {
+		t.Fatalf("unexpected session %d %v", code, resp)
+	}
+	if code, resp := do("POST", "/files/uploads/"+id+"/commit", fmt.Sprintf(`{"sha256":%q}`, hex.EncodeToString(sum[:]))); code != 409 {
+		t.Fatalf("expected committing an incomplete upload to fail, got %d %v", code, resp)
+	}
+	if code, resp := do("PATCH", "/files/uploads/"+id+"?offset=5", data[5:]); code != 200 || resp["offset"] != float64(len(data)) {
+		t.Fatalf("unexpected chunk response %d %v", code, resp)
+	}
+	if code, resp := do("POST", "/files/uploads/"+id+"/commit", fmt.Sprintf(`{"sha256":%q}`, hex.EncodeToString(sum[:]))); code != 200 {
+		t.Fatalf("unexpected commit response %d %v", code, resp)
+	}
+
+	info, err := os.Stat(dest)
+	if got, _ := os.ReadFile(dest); err != nil || string(got) != data || info.Mode().Perm() != 0o600 {
+		t.Fatalf("expected the committed file with mode 0600, got %q %v", got, err)
+	}
+	if code, _ := do("GET", "/files/uploads/"+id, ""); code != 404 {
+		t.Fatalf("expected the session to be gone, got %d", code)
+	}
+}
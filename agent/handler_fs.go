@@ -0,0 +1,493 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/sysuser"
+)
+
+const (
+	maxReaddirDepth     = 16
+	defaultReaddirLimit = 1000
+	maxReaddirLimit     = 10000
+)
+
+// fsRequest is the body of the /files filesystem operations. Paths must be
+// absolute; the operation runs as User, the default user if unset.
+type fsRequest struct {
+	Path string `json:"path"`
+	User string `json:"user,omitempty"`
+
+	// readdir: Depth levels (default 1), at most Limit entries (default
+	// 1000) starting after Cursor, a nextCursor of a previous page.
+	Depth  int    `json:"depth,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+
+	// mkdir: Parents creates missing parents and accepts an existing dir.
+	// mkdir, chmod: Mode is octal, e.g. "755".
+	Parents bool   `json:"parents,omitempty"`
+	Mode    string `json:"mode,omitempty"`
+
+	// rename: From is moved to Path, replacing it only with Overwrite.
+	From      string `json:"from,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+
+	// remove, chmod, chown: Recursive applies to directory contents.
+	Recursive bool `json:"recursive,omitempty"`
+
+	// chown: Owner is a user name; Group defaults to the owner's group.
+	Owner string `json:"owner,omitempty"`
+	Group string `json:"group,omitempty"`
+
+	// symlink: Path is created pointing to Target, which may be relative.
+	Target string `json:"target,omitempty"`
+}
+
+// fsEntry describes a file. Symlinks are described, not followed.
+type fsEntry struct {
+	Name       string    `json:"name"`
+	Path       string    `json:"path"`
+	Type       string    `json:"type"` // file, dir, symlink, fifo, socket, device or other
+	Size       int64     `json:"size"`
+	Mode       string    `json:"mode"` // octal permission and special bits
+	ModTime    time.Time `json:"mtime"`
+	UID        int       `json:"uid"`
+	GID        int       `json:"gid"`
+	Owner      string    `json:"owner"`
+	Group      string    `json:"group"`
+	LinkTarget string    `json:"linkTarget,omitempty"`
+}
+
+type readdirResponse struct {
+	Path       string    `json:"path"`
+	Entries    []fsEntry `json:"entries"`
+	NextCursor string    `json:"nextCursor,omitempty"`
+}
+
+// fsOp performs one filesystem operation on a validated request, with the
+// credentials of its user, and returns the JSON response.
+type fsOp func(req fsRequest, creds *sysuser.Credentials) (interface{}, error)
+
+// fsBadRequest is an error in the request itself.
+type fsBadRequest struct{ msg string }
+
+func (e *fsBadRequest) Error() string { return e.msg }
+
+func badFSRequest(format string, args ...any) error {
+	return &fsBadRequest{fmt.Sprintf(format, args...)}
+}
+
+func makeFSHandler(logger *slog.Logger, defaultUser, name string, op fsOp) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleFS(w, r, logger, defaultUser, name, op)
+	}
+}
+
+// handleFS decodes and validates a filesystem request and runs op as the
+// requested user, so that the user's permissions apply.
+func handleFS(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defaultUser, name string, op fsOp) {
+	start := time.Now()
+
+	var req fsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Path == "" {
+		http.Error(w, `{"error":"path is required"}`, http.StatusBadRequest)
+		return
+	}
+	for _, p := range []*string{&req.Path, &req.From} {
+		if *p == "" {
+			continue
+		}
+		*p = filepath.Clean(*p)
+		if !filepath.IsAbs(*p) {
+			http.Error(w, `{"error":"paths must be absolute"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if req.User == "" {
+		req.User = defaultUser
+	}
+	creds, err := sysuser.Resolve(req.User)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"user: %s"}`, err), http.StatusBadRequest)
+		return
+	}
+
+	var resp interface{}
+	err = creds.RunAs(func() error {
+		var err error
+		resp, err = op(req, creds)
+		return err
+	})
+	if err != nil {
+		status := fsErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			logger.Warn("files."+name, "path", req.Path, "user", creds.Username, "error", err)
+		}
+		body, _ := json.Marshal(map[string]string{"error": err.Error()})
+		http.Error(w, string(body), status)
+		return
+	}
+	if name != "stat" && name != "readdir" {
+		logger.Info("files."+name,
+			"path", req.Path,
+			"user", creds.Username,
+			"duration_ms", time.Since(start).Milliseconds(),
+		)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// fsErrorStatus maps a filesystem error to an HTTP status.
+func fsErrorStatus(err error) int {
+	var bad *fsBadRequest
+	switch {
+	case errors.As(err, &bad):
+		return http.StatusBadRequest
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrExist), errors.Is(err, syscall.ENOTEMPTY):
+		return http.StatusConflict
+	case errors.Is(err, syscall.ENOTDIR), errors.Is(err, syscall.EISDIR),
+		errors.Is(err, syscall.EXDEV), errors.Is(err, syscall.EINVAL):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// parseMode parses an octal mode such as "755" or "2775", including the
+// setuid, setgid and sticky bits.
+func parseMode(s string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0o7777 {
+		return 0, badFSRequest("mode must be octal, e.g. 0644")
+	}
+	mode := os.FileMode(m) & os.ModePerm
+	if m&0o4000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&0o2000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&0o1000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode, nil
+}
+
+func formatMode(mode os.FileMode) string {
+	m := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&os.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&os.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return fmt.Sprintf("%04o", m)
+}
+
+var groupNames sync.Map // map[int]string
+
+// groupName returns the name of gid, or the gid itself if it has none.
+func groupName(gid int) string {
+	if v, ok := groupNames.Load(gid); ok {
+		return v.(string)
+	}
+	name := strconv.Itoa(gid)
+	if g, err := user.LookupGroupId(name); err == nil {
+		name = g.Name
+	}
+	groupNames.Store(gid, name)
+	return name
+}
+
+func newFSEntry(path string, info fs.FileInfo) fsEntry {
+	e := fsEntry{
+		Name:    info.Name(),
+		Path:    path,
+		Size:    info.Size(),
+		Mode:    formatMode(info.Mode()),
+		ModTime: info.ModTime().UTC(),
+	}
+	switch mode := info.Mode(); {
+	case mode.IsRegular():
+		e.Type = "file"
+	case mode.IsDir():
+		e.Type = "dir"
+	case mode&fs.ModeSymlink != 0:
+		e.Type = "symlink"
+		e.LinkTarget, _ = os.Readlink(path)
+	case mode&fs.ModeNamedPipe != 0:
+		e.Type = "fifo"
+	case mode&fs.ModeSocket != 0:
+		e.Type = "socket"
+	case mode&fs.ModeDevice != 0:
+		e.Type = "device"
+	default:
+		e.Type = "other"
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		e.UID, e.GID = int(st.Uid), int(st.Gid)
+		e.Owner, e.Group = userName(e.UID), groupName(e.GID)
+	}
+	return e
+}
+
+func lstatEntry(path string) (fsEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fsEntry{}, err
+	}
+	return newFSEntry(path, info), nil
+}
+
+// protectedPath reports whether path is too broad to remove or to change
+// recursively: the root, a top-level directory or the user's home.
+func protectedPath(path string, creds *sysuser.Credentials) bool {
+	return path == "/" || filepath.Dir(path) == "/" || path == filepath.Clean(creds.HomeDir)
+}
+
+func fsStat(req fsRequest, _ *sysuser.Credentials) (interface{}, error) {
+	return lstatEntry(req.Path)
+}
+
+// fsReaddir lists a directory depth levels deep, in name order with each
+// directory followed by its content. Symlinks to directories are not
+// descended into. The cursor is the path, relative to the listed directory,
+// of the last entry already returned, so paging resumes in the right place
+// even if entries are added or removed in between.
+func fsReaddir(req fsRequest, _ *sysuser.Credentials) (interface{}, error) {
+	depth := req.Depth
+	if depth <= 0 {
+		depth = 1
+	}
+	depth = min(depth, maxReaddirDepth)
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultReaddirLimit
+	}
+	limit = min(limit, maxReaddirLimit)
+	var cursor []string
+	if req.Cursor != "" {
+		if !filepath.IsLocal(req.Cursor) || filepath.Clean(req.Cursor) != req.Cursor {
+			return nil, badFSRequest("invalid cursor")
+		}
+		cursor = strings.Split(req.Cursor, "/")
+	}
+
+	resp := readdirResponse{Path: req.Path, Entries: []fsEntry{}}
+	last := ""
+	var walk func(dir string, rel []string, level int) error
+	walk = func(dir string, rel []string, level int) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, de := range entries {
+			path := filepath.Join(dir, de.Name())
+			relPath := append(rel[:len(rel):len(rel)], de.Name())
+			// Entries up to the cursor were returned already, as were the
+			// subtrees of directories before it that do not contain it.
+			order := slices.Compare(relPath, cursor)
+			after := cursor == nil || order > 0
+			if !after && !slices.Equal(relPath, cursor[:min(len(relPath), len(cursor))]) {
+				continue
+			}
+			if after {
+				info, err := de.Info()
+				if err != nil {
+					continue // removed since it was listed
+				}
+				if len(resp.Entries) == limit {
+					resp.NextCursor = last
+					return errStopWalk
+				}
+				resp.Entries = append(resp.Entries, newFSEntry(path, info))
+				last = strings.Join(relPath, "/")
+			}
+			if de.IsDir() && level < depth {
+				// Subdirectories the user cannot read are listed but
+				// not expanded.
+				if err := walk(path, relPath, level+1); err == errStopWalk {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := walk(req.Path, nil, 1); err != nil && err != errStopWalk {
+		return nil, err
+	}
+	return resp, nil
+}
+
+var errStopWalk = errors.New("stop walk")
+
+func fsMkdir(req fsRequest, _ *sysuser.Credentials) (interface{}, error) {
+	mode := os.FileMode(0o755)
+	if req.Mode != "" {
+		m, err := parseMode(req.Mode)
+		if err != nil {
+			return nil, err
+		}
+		mode = m
+	}
+	if req.Parents {
+		if err := os.MkdirAll(req.Path, mode.Perm()); err != nil {
+			return nil, err
+		}
+	} else if err := os.Mkdir(req.Path, mode.Perm()); err != nil {
+		return nil, err
+	}
+	// Mkdir applies the umask and ignores special bits.
+	if req.Mode != "" {
+		if err := os.Chmod(req.Path, mode); err != nil {
+			return nil, err
+		}
+	}
+	return lstatEntry(req.Path)
+}
+
+func fsRename(req fsRequest, creds *sysuser.Credentials) (interface{}, error) {
+	if req.From == "" {
+		return nil, badFSRequest("from is required")
+	}
+	if protectedPath(req.From, creds) {
+		return nil, badFSRequest("refusing to move %s", req.From)
+	}
+	if !req.Overwrite {
+		if _, err := os.Lstat(req.Path); err == nil {
+			return nil, &fs.PathError{Op: "rename", Path: req.Path, Err: fs.ErrExist}
+		}
+	}
+	if err := os.Rename(req.From, req.Path); err != nil {
+		return nil, err
+	}
+	return lstatEntry(req.Path)
+}
+
+// fsRemove removes a file, symlink or empty directory, or with Recursive a
+// directory and its content. The root, top-level directories and the
+// user's home are refused.
+func fsRemove(req fsRequest, creds *sysuser.Credentials) (interface{}, error) {
+	if protectedPath(req.Path, creds) {
+		return nil, badFSRequest("refusing to remove %s", req.Path)
+	}
+	if _, err := os.Lstat(req.Path); err != nil {
+		return nil, err
+	}
+	var err error
+	if req.Recursive {
+		err = os.RemoveAll(req.Path)
+	} else {
+		err = os.Remove(req.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"path": req.Path, "removed": true}, nil
+}
+
+// walkTree calls fn for path and, if recursive, everything below it without
+// following symlinks.
+func walkTree(path string, recursive bool, fn func(path string, d fs.DirEntry) error) error {
+	if !recursive {
+		return fn(path, nil)
+	}
+	return filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(p, d)
+	})
+}
+
+func fsChmod(req fsRequest, creds *sysuser.Credentials) (interface{}, error) {
+	if req.Mode == "" {
+		return nil, badFSRequest("mode is required")
+	}
+	mode, err := parseMode(req.Mode)
+	if err != nil {
+		return nil, err
+	}
+	if req.Recursive && protectedPath(req.Path, creds) {
+		return nil, badFSRequest("refusing to chmod %s recursively", req.Path)
+	}
+	err = walkTree(req.Path, req.Recursive, func(path string, d fs.DirEntry) error {
+		// chmod follows symlinks; leave those met while recursing alone.
+		if d != nil && d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		return os.Chmod(path, mode)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lstatEntry(req.Path)
+}
+
+func fsChown(req fsRequest, creds *sysuser.Credentials) (interface{}, error) {
+	if req.Owner == "" && req.Group == "" {
+		return nil, badFSRequest("owner or group is required")
+	}
+	uid, gid := -1, -1
+	if req.Owner != "" {
+		owner, err := sysuser.Resolve(req.Owner)
+		if err != nil {
+			return nil, badFSRequest("owner: %s", err)
+		}
+		uid, gid = int(owner.Uid), int(owner.Gid)
+	}
+	if req.Group != "" {
+		g, err := user.LookupGroup(req.Group)
+		if err != nil {
+			return nil, badFSRequest("unknown group %q", req.Group)
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	if req.Recursive && protectedPath(req.Path, creds) {
+		return nil, badFSRequest("refusing to chown %s recursively", req.Path)
+	}
+	err := walkTree(req.Path, req.Recursive, func(path string, _ fs.DirEntry) error {
+		return os.Lchown(path, uid, gid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lstatEntry(req.Path)
+}
+
+func fsSymlink(req fsRequest, _ *sysuser.Credentials) (interface{}, error) {
+	if req.Target == "" {
+		return nil, badFSRequest("target is required")
+	}
+	if err := os.Symlink(req.Target, req.Path); err != nil {
+		return nil, err
+	}
+	return lstatEntry(req.Path)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func runFS(t *testing.T, op fsOp, body string) (int, map[string]interface{}) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec := httptest.NewRecorder()
+	handleFS(rec, httptest.NewRequest("POST", "/files/op", strings.NewReader(body)), logger, "root", "op", op)
+	var resp map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+func TestHandleFS_Operations(t *testing.T) {
+	dir := t.TempDir()
+	p := func(name string) string { return filepath.Join(dir, name) }
+
+	if code, resp := runFS(t, fsMkdir, fmt.Sprintf(`{"path":%q,"parents":true,"mode":"2750"}`, p("a/b"))); code != 200 || resp["type"] != "dir" || resp["mode"] != "2750" {
+		t.Fatalf("unexpected mkdir response %d %v", code, resp)
+	}
+	if code, _ := runFS(t, fsMkdir, fmt.Sprintf(`{"path":%q}`, p("a/b"))); code != 409 {
+		t.Fatalf("expected mkdir of an existing dir to conflict, got %d", code)
+	}
+	os.WriteFile(p("a/b/file.txt"), []byte("hello"), 0o644)
+
+	if code, resp := runFS(t, fsSymlink, fmt.Sprintf(`{"path":%q,"target":"b/file.txt"}`, p("a/link"))); code != 200 || resp["type"] != "symlink" || resp["linkTarget"] != "b/file.txt" {
+		t.Fatalf("unexpected symlink response %d %v", code, resp)
+	}
+	if code, resp := runFS(t, fsStat, fmt.Sprintf(`{"path":%q}`, p("a/b/file.txt"))); code != 200 || resp["size"] != 5.0 || resp["owner"] != "root" {
+		t.Fatalf("unexpected stat response %d %v", code, resp)
+	}
+
+	if code, resp := runFS(t, fsRename, fmt.Sprintf(`{"from":%q,"path":%q}`, p("a/b/file.txt"), p("a/link"))); code != 409 {
+		t.Fatalf("expected rename onto an existing path to conflict, got %d %v", code, resp)
+	}
+	if code, resp := runFS(t, fsRename, fmt.Sprintf(`{"from":%q,"path":%q}`, p("a/b/file.txt"), p("a/b/renamed.txt"))); code != 200 || resp["name"] != "renamed.txt" {
+		t.Fatalf("unexpected rename response %d %v", code, resp)
+	}
+	if code, resp := runFS(t, fsChmod, fmt.Sprintf(`{"path":%q,"mode":"600"}`, p("a/b/renamed.txt"))); code != 200 || resp["mode"] != "0600" {
+		t.Fatalf("unexpected chmod response %d %v", code, resp)
+	}
+
+	if code, _ := runFS(t, fsRemove, fmt.Sprintf(`{"path":%q}`, p("a"))); code != 409 {
+		t.Fatalf("expected removing a non-empty dir without recursive to conflict, got %d", code)
+	}
+	for _, path := range []string{"/", "/etc", "/root"} {
+		if code, _ := runFS(t, fsRemove, fmt.Sprintf(`{"path":%q,"recursive":true}`, path)); code != 400 {
+			t.Fatalf("expected removing %s to be refused, got %d", path, code)
+		}
+	}
+	if code, resp := runFS(t, fsRemove, fmt.Sprintf(`{"path":%q,"recursive":true}`, p("a"))); code != 200 || resp["removed"] != true {
+		t.Fatalf("unexpected remove response %d %v", code, resp)
+	}
+	if code, _ := runFS(t, fsStat, fmt.Sprintf(`{"path":%q}`, p("a"))); code != 404 {
+		t.Fatalf("expected the removed dir to be gone, got %d", code)
+	}
+}
+
+func TestHandleFS_ReaddirPages(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a/x", "a/y", "b", "c/d/e"} {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755)
+		os.WriteFile(filepath.Join(dir, name), nil, 0o644)
+	}
+
+	var names []string
+	cursor := ""
+	for pages := 0; ; pages++ {
+		code, resp := runFS(t, fsReaddir, fmt.Sprintf(`{"path":%q,"depth":2,"limit":3,"cursor":%q}`, dir, cursor))
+		if code != 200 || pages > 3 {
+			t.Fatalf("unexpected readdir response %d %v", code, resp)
+		}
+		for _, e := range resp["entries"].([]interface{}) {
+			rel, _ := filepath.Rel(dir, e.(map[string]interface{})["path"].(string))
+			names = append(names, rel)
+		}
+		next, _ := resp["nextCursor"].(string)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	want := "a a/x a/y b c c/d"
+	if got := strings.Join(names, " "); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestHandleFS_ReaddirCursorSurvivesChanges(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		os.WriteFile(filepath.Join(dir, name), nil, 0o644)
+	}
+
+	code, resp := runFS(t, fsReaddir, fmt.Sprintf(`{"path":%q,"limit":2}`, dir))
+	if code != 200 || resp["nextCursor"] != "b" {
+		t.Fatalf("unexpected first page %d %v", code, resp)
+	}
+	// Removing a returned entry must not make the next page skip one.
+	os.Remove(filepath.Join(dir, "a"))
+	code, resp = runFS(t, fsReaddir, fmt.Sprintf(`{"path":%q,"limit":2,"cursor":"b"}`, dir))
+	if code != 200 {
+		t.Fatalf("unexpected second page %d %v", code, resp)
+	}
+	var names []string
+	for _, e := range resp["entries"].([]interface{}) {
+		names = append(names, filepath.Base(e.(map[string]interface{})["path"].(string)))
+	}
+	if got := strings.Join(names, " "); got != "c d" {
+		t.Fatalf("got %q, want %q", got, "c d")
+	}
+
+	if code, _ := runFS(t, fsReaddir, fmt.Sprintf(`{"path":%q,"cursor":"../b"}`, dir)); code != 400 {
+		t.Fatalf("expected a cursor outside the dir to be rejected, got %d", code)
+	}
+}
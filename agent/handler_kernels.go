@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/admission"
+	"github.com/angelorc/vmsan/agent/internal/cgroup"
+	"github.com/angelorc/vmsan/agent/internal/eventlog"
+	"github.com/angelorc/vmsan/agent/internal/kernel"
+	"github.com/angelorc/vmsan/agent/internal/sysuser"
+)
+
+type kernelRequest struct {
+	Language string            `json:"language"` // python or node
+	User     string            `json:"user,omitempty"`
+	Cwd      string            `json:"cwd,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	Limits   *cgroup.Limits    `json:"limits,omitempty"`
+}
+
+type kernelExecuteRequest struct {
+	Code      string `json:"code"`
+	TimeoutMs int    `json:"timeoutMs,omitempty"`
+}
+
+// kernelEvent is one line of a kernel execution stream: an output (stdout,
+// stderr, display, result or error) or the closing "done" event.
+type kernelEvent struct {
+	kernel.Output
+	Status         string `json:"status,omitempty"`
+	ExecutionCount int    `json:"executionCount,omitempty"`
+	DurationMs     *int64 `json:"durationMs,omitempty"`
+	Timestamp      string `json:"ts"`
+}
+
+// kernelSpawner starts interpreters the way POST /exec starts commands: as
+// the resolved user, from cwd, with env added to the agent's environment.
+func kernelSpawner(creds *sysuser.Credentials, cwd string, env map[string]string) kernel.Spawner {
+	return func(name string, args ...string) *exec.Cmd {
+		cmd := buildCommand(name, args)
+		cmd.Dir = cwd
+		if len(env) > 0 {
+			cmd.Env = cmd.Environ()
+			for k, v := range env {
+				cmd.Env = append(cmd.Env, k+"="+v)
+			}
+		}
+		if creds != nil {
+			creds.Apply(cmd)
+		}
+		return cmd
+	}
+}
+
+func kernelError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, kernel.ErrUnsupportedLanguage), errors.Is(err, kernel.ErrLimits):
+		status = http.StatusBadRequest
+	case errors.Is(err, kernel.ErrTooMany), errors.Is(err, admission.ErrBusy):
+		status = http.StatusTooManyRequests
+	case errors.Is(err, kernel.ErrDead), errors.Is(err, kernel.ErrRestarting):
+		status = http.StatusConflict
+	}
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	http.Error(w, string(body), status)
+}
+
+func makeKernelCreateHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req kernelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		var limits cgroup.Limits
+		if req.Limits != nil {
+			limits = *req.Limits
+			if err := limits.Validate(); err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"limits: %s"}`, err), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.User == "" {
+			req.User = defaultUser
+		}
+		var creds *sysuser.Credentials
+		if req.User != "" {
+			var err error
+			creds, err = sysuser.Resolve(req.User)
+			if err != nil {
+				http.Error(w, fmt.Sprintf(`{"error":"resolve user: %s"}`, err), http.StatusBadRequest)
+				return
+			}
+		}
+
+		k, err := kernel.Create(req.Language, req.User, limits, kernelSpawner(creds, req.Cwd, req.Env))
+		if err != nil {
+			logger.Warn("kernel.start", "language", req.Language, "user", req.User, "error", err)
+			kernelError(w, err)
+			return
+		}
+		info := k.Info()
+		logger.Info("kernel.started", "kernel_id", k.ID, "language", k.Language, "version", info.Version, "user", req.User, "pid", info.PID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(info)
+	}
+}
+
+// handleListKernels returns JSON info for all kernels.
+func handleListKernels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(kernel.List())
+}
+
+// handleGetKernel returns JSON info for a single kernel.
+func handleGetKernel(w http.ResponseWriter, r *http.Request) {
+	k := kernel.Get(r.PathValue("id"))
+	if k == nil {
+		http.Error(w, `{"error":"kernel not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(k.Info())
+}
+
+// handleDeleteKernel shuts a kernel down.
+func handleDeleteKernel(w http.ResponseWriter, r *http.Request) {
+	if !kernel.Remove(r.PathValue("id")) {
+		http.Error(w, `{"error":"kernel not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func makeKernelExecuteHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleKernelExecute(w, r, logger)
+	}
+}
+
+// handleKernelExecute runs code in a kernel and streams its output as NDJSON
+// (or SSE) events, ending with a "done" event carrying the status. Plain
+// stdout/stderr and structured outputs (display, result, error) are each in
+// order, but not necessarily relative to one another. Requests for a busy
+// kernel wait for it. Like a command, an execution takes an admission slot
+// and fails with 429 if none is free. If the client disconnects, the code
+// is interrupted.
+func handleKernelExecute(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	k := kernel.Get(r.PathValue("id"))
+	if k == nil {
+		http.Error(w, `{"error":"kernel not found"}`, http.StatusNotFound)
+		return
+	}
+	var req kernelExecuteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.TimeoutMs < 0 {
+		http.Error(w, `{"error":"timeoutMs must not be negative"}`, http.StatusBadRequest)
+		return
+	}
+
+	if err := execAdmission.Acquire(r.Context(), "", 0, nil); err != nil {
+		kernelError(w, err)
+		return
+	}
+	defer execAdmission.Release()
+
+	out := newHTTPOutput(w, r)
+	begun := false
+	write := func(evt kernelEvent) {
+		if !begun {
+			begun = true
+			out.begin()
+		}
+		evt.Timestamp = now()
+		data, _ := json.Marshal(evt)
+		out.write(eventlog.Event{Data: data})
+	}
+
+	start := time.Now()
+	reply, err := k.Execute(r.Context(), req.Code, time.Duration(req.TimeoutMs)*time.Millisecond, func(o kernel.Output) {
+		write(kernelEvent{Output: o})
+	})
+	if err != nil {
+		if r.Context().Err() == nil {
+			kernelError(w, err)
+		}
+		return
+	}
+	durationMs := time.Since(start).Milliseconds()
+	write(kernelEvent{
+		Output:         kernel.Output{Type: "done"},
+		Status:         reply.Status,
+		ExecutionCount: reply.ExecutionCount,
+		DurationMs:     &durationMs,
+	})
+	logger.Info("kernel.executed",
+		"kernel_id", k.ID,
+		"status", reply.Status,
+		"execution_count", reply.ExecutionCount,
+		"duration_ms", durationMs,
+	)
+}
+
+// handleKernelInterrupt interrupts the code running in a kernel, if any.
+func handleKernelInterrupt(w http.ResponseWriter, r *http.Request) {
+	k := kernel.Get(r.PathValue("id"))
+	if k == nil {
+		http.Error(w, `{"error":"kernel not found"}`, http.StatusNotFound)
+		return
+	}
+	if err := k.Interrupt(); err != nil {
+		kernelError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+func makeKernelRestartHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		k := kernel.Get(r.PathValue("id"))
+		if k == nil {
+			http.Error(w, `{"error":"kernel not found"}`, http.StatusNotFound)
+			return
+		}
+		if err := k.Restart(); err != nil {
+			logger.Warn("kernel.restart", "kernel_id", k.ID, "error", err)
+			kernelError(w, err)
+			return
+		}
+		info := k.Info()
+		logger.Info("kernel.restarted", "kernel_id", k.ID, "pid", info.PID)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(info)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/user"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/eventlog"
+	"github.com/angelorc/vmsan/agent/internal/procfs"
+)
+
+const (
+	defaultPortsInterval = 500 * time.Millisecond
+	minPortsInterval     = 100 * time.Millisecond
+)
+
+// portInfo describes a listening socket: a TCP socket in the LISTEN state
+// or a bound, unconnected UDP socket.
+type portInfo struct {
+	Protocol string `json:"protocol"` // tcp or udp
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+	PID      int    `json:"pid,omitempty"`
+	Process  string `json:"process,omitempty"`
+	User     string `json:"user,omitempty"`
+}
+
+func (p portInfo) key() string {
+	return p.Protocol + "/" + p.Address + "/" + strconv.Itoa(p.Port)
+}
+
+type portEvent struct {
+	Type      string    `json:"type"` // opened, closed or error
+	Port      *portInfo `json:"port,omitempty"`
+	Timestamp string    `json:"ts"`
+	Error     string    `json:"error,omitempty"`
+}
+
+var userNames sync.Map // map[int]string
+
+// userName returns the name of uid, or the uid itself if it has none.
+func userName(uid int) string {
+	if v, ok := userNames.Load(uid); ok {
+		return v.(string)
+	}
+	name := strconv.Itoa(uid)
+	if u, err := user.LookupId(name); err == nil {
+		name = u.Username
+	}
+	userNames.Store(uid, name)
+	return name
+}
+
+// listeningPorts returns the listening sockets of protocol (tcp, udp or ""
+// for both), sorted by protocol, port and address.
+func listeningPorts(protocol string) ([]portInfo, error) {
+	owners, err := procfs.SocketOwners()
+	if err != nil {
+		return nil, err
+	}
+	tables := map[string][]string{"tcp": {"tcp", "tcp6"}, "udp": {"udp", "udp6"}}
+	seen := make(map[string]bool)
+	ports := []portInfo{}
+	for _, proto := range []string{"tcp", "udp"} {
+		if protocol != "" && protocol != proto {
+			continue
+		}
+		for _, table := range tables[proto] {
+			sockets, err := procfs.ReadNet(table)
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range sockets {
+				listening := s.State == procfs.TCPListen
+				if proto == "udp" {
+					listening = s.State == procfs.TCPClose && s.RemotePort == 0 && s.LocalPort != 0
+				}
+				if !listening {
+					continue
+				}
+				p := portInfo{Protocol: proto, Address: s.LocalIP.String(), Port: s.LocalPort, User: userName(s.UID)}
+				if pid, ok := owners[s.Inode]; ok {
+					p.PID = pid
+					if st, err := procfs.ReadStat(pid); err == nil {
+						p.Process = st.Comm
+					}
+				}
+				// SO_REUSEPORT lets several sockets share an address.
+				if !seen[p.key()] {
+					seen[p.key()] = true
+					ports = append(ports, p)
+				}
+			}
+		}
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		a, b := ports[i], ports[j]
+		if a.Protocol != b.Protocol {
+			return a.Protocol < b.Protocol
+		}
+		if a.Port != b.Port {
+			return a.Port < b.Port
+		}
+		return a.Address < b.Address
+	})
+	return ports, nil
+}
+
+func portsProtocol(w http.ResponseWriter, r *http.Request) (string, bool) {
+	protocol := r.URL.Query().Get("protocol")
+	switch protocol {
+	case "", "tcp", "udp":
+		return protocol, true
+	}
+	http.Error(w, `{"error":"protocol must be tcp or udp"}`, http.StatusBadRequest)
+	return "", false
+}
+
+// handleListPorts returns the listening TCP and UDP sockets in the guest,
+// optionally filtered by ?protocol=.
+func handleListPorts(w http.ResponseWriter, r *http.Request) {
+	protocol, ok := portsProtocol(w, r)
+	if !ok {
+		return
+	}
+	ports, err := listeningPorts(protocol)
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"error":"read sockets: %s"}`, err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ports)
+}
+
+// handlePortEvents streams "opened" and "closed" events as listening
+// sockets come and go, as NDJSON or SSE. It starts with an "opened" event
+// for every socket already listening, then polls every ?intervalMs=.
+func handlePortEvents(w http.ResponseWriter, r *http.Request) {
+	protocol, ok := portsProtocol(w, r)
+	if !ok {
+		return
+	}
+	interval := defaultPortsInterval
+	if v := r.URL.Query().Get("intervalMs"); v != "" {
+		ms, err := strconv.Atoi(v)
+		if err != nil || ms <= 0 {
+			http.Error(w, `{"error":"invalid intervalMs"}`, http.StatusBadRequest)
+			return
+		}
+		interval = max(time.Duration(ms)*time.Millisecond, minPortsInterval)
+	}
+
+	out := newHTTPOutput(w, r)
+	out.begin()
+	send := func(evt portEvent) {
+		evt.Timestamp = now()
+		data, _ := json.Marshal(evt)
+		out.write(eventlog.Event{Data: data})
+	}
+
+	known := make(map[string]portInfo)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		ports, err := listeningPorts(protocol)
+		if err != nil {
+			send(portEvent{Type: "error", Error: err.Error()})
+		} else {
+			current := make(map[string]bool, len(ports))
+			for _, p := range ports {
+				current[p.key()] = true
+				if _, ok := known[p.key()]; !ok {
+					known[p.key()] = p
+					send(portEvent{Type: "opened", Port: &p})
+				}
+			}
+			for key, p := range known {
+				if !current[key] {
+					delete(known, key)
+					send(portEvent{Type: "closed", Port: &p})
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+)
+
+func TestListeningPorts_FindsOwnSockets(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	want := map[string]int{
+		"tcp": ln.Addr().(*net.TCPAddr).Port,
+		"udp": pc.LocalAddr().(*net.UDPAddr).Port,
+	}
+	for protocol, port := range want {
+		ports, err := listeningPorts(protocol)
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := false
+		for _, p := range ports {
+			if p.Protocol != protocol {
+				t.Fatalf("expected only %s sockets, got %+v", protocol, p)
+			}
+			if p.Port == port {
+				found = true
+				if p.Address != "127.0.0.1" || p.PID != os.Getpid() || p.Process == "" {
+					t.Fatalf("unexpected %s listener %+v", protocol, p)
+				}
+			}
+		}
+		if !found {
+			t.Fatalf("expected %s port %d in %+v", protocol, port, ports)
+		}
+	}
+}
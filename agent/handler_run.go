@@ -2,25 +2,41 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
+	"github.com/angelorc/vmsan/agent/internal/admission"
+	"github.com/angelorc/vmsan/agent/internal/cgroup"
 	"github.com/angelorc/vmsan/agent/internal/cmdstore"
+	"github.com/angelorc/vmsan/agent/internal/execctx"
+	"github.com/angelorc/vmsan/agent/internal/signals"
 	"github.com/angelorc/vmsan/agent/internal/sysuser"
+	"github.com/creack/pty"
 )
 
-const maxConcurrentCommands = 16
+// Default admission limits, overridable with -max-commands and -max-queue.
+const (
+	defaultMaxCommands = 16
+	defaultMaxQueue    = 64
+)
 
-var activeCommands atomic.Int32
+// execAdmission bounds the number of concurrently running commands.
+var execAdmission = admission.New(defaultMaxCommands, defaultMaxQueue)
 
 type runRequest struct {
 	Cmd       string            `json:"cmd"`
@@ -30,16 +46,121 @@ type runRequest struct {
 	TimeoutMs int               `json:"timeoutMs,omitempty"`
 	Detached  bool              `json:"detached,omitempty"`
 	User      string            `json:"user,omitempty"`
+	Stdin     bool              `json:"stdin,omitempty"`
+	TTY       bool              `json:"tty,omitempty"`
+	Cols      uint16            `json:"cols,omitempty"`
+	Rows      uint16            `json:"rows,omitempty"`
+	Limits    *cgroup.Limits    `json:"limits,omitempty"`
+	Encoding  string            `json:"encoding,omitempty"` // utf8 (default, line events) or base64 (raw chunks)
+
+	// KillSignal is sent to the command's process group when TimeoutMs
+	// fires (default SIGTERM); KillGraceMs later it is escalated to SIGKILL.
+	KillSignal  string `json:"killSignal,omitempty"`
+	KillGraceMs int    `json:"killGraceMs,omitempty"`
+
+	// StatsIntervalMs enables periodic "stats" events for non-detached commands.
+	StatsIntervalMs int `json:"statsIntervalMs,omitempty"`
+
+	// Shell runs Cmd as a shell string through the user's login shell with
+	// pipefail set; Script does the same for a multi-line script and
+	// replaces Cmd. Args become "$@". Login adds -l for the login
+	// environment and Errexit adds set -e.
+	Shell   bool   `json:"shell,omitempty"`
+	Script  string `json:"script,omitempty"`
+	Login   bool   `json:"login,omitempty"`
+	Errexit bool   `json:"errexit,omitempty"`
+
+	// Expect plays an expect script against the command's terminal output
+	// (see POST /exec/expect). It requires TTY.
+	Expect []expectStep `json:"expect,omitempty"`
+
+	// ContextID runs the command in an exec context (see POST /contexts),
+	// starting from its cwd, env and user.
+	ContextID string `json:"contextId,omitempty"`
+
+	// QueueTimeoutMs lets the command wait this long for a free slot instead
+	// of being rejected with 429; Priority (high, normal or low) orders it in
+	// the queue.
+	QueueTimeoutMs int    `json:"queueTimeoutMs,omitempty"`
+	Priority       string `json:"priority,omitempty"`
+
+	// OnDisconnect decides what happens to a streaming command when the
+	// client goes away: kill (default) terminates its process tree, detach
+	// keeps it running as a detached job, continue just keeps it running.
+	OnDisconnect string `json:"onDisconnect,omitempty"`
+}
+
+type killRequest struct {
+	Signal  string `json:"signal,omitempty"`  // default SIGKILL
+	Scope   string `json:"scope,omitempty"`   // process, group (default) or tree
+	GraceMs int    `json:"graceMs,omitempty"` // escalate to SIGKILL after this long
+}
+
+type resizeRequest struct {
+	Cols uint16 `json:"cols"`
+	Rows uint16 `json:"rows"`
+}
+
+const (
+	defaultTTYCols = 80
+	defaultTTYRows = 24
+
+	defaultKillGrace = 5 * time.Second
+
+	cpuTimePollInterval = 100 * time.Millisecond
+
+	encodingUTF8   = "utf8"
+	encodingBase64 = "base64"
+
+	outputChunkSize = 32 * 1024
+
+	disconnectKill     = "kill"
+	disconnectDetach   = "detach"
+	disconnectContinue = "continue"
+)
+
+// Resource limits reported in the exit event when they ended a command.
+const (
+	limitMemory = "memory"
+	limitCPU    = "cpu"
+	limitWall   = "wall"
+)
+
+// ptyInput adapts a pseudo-terminal master to the stdin contract used by
+// cmdstore: writes go to the terminal and Close sends EOT (^D) instead of
+// hanging up the terminal, which would also cut off the command's output.
+type ptyInput struct {
+	f *os.File
+}
+
+func (p ptyInput) Write(b []byte) (int, error) {
+	return p.f.Write(b)
+}
+
+func (p ptyInput) Close() error {
+	_, err := p.f.Write([]byte{0x04})
+	return err
 }
 
 type ndjsonEvent struct {
-	Type      string `json:"type"`
-	Data      string `json:"data,omitempty"`
-	ID        string `json:"id,omitempty"`
-	PID       int    `json:"pid,omitempty"`
-	ExitCode  *int   `json:"exitCode,omitempty"`
-	Timestamp string `json:"ts"`
-	Error     string `json:"error,omitempty"`
+	Type      string           `json:"type"`
+	Seq       int64            `json:"seq,omitempty"`
+	Data      string           `json:"data,omitempty"`
+	ID        string           `json:"id,omitempty"`
+	PID       int              `json:"pid,omitempty"`
+	ExitCode  *int             `json:"exitCode,omitempty"`
+	Encoding  string           `json:"encoding,omitempty"`
+	Offset    *int64           `json:"offset,omitempty"`
+	Limit     string           `json:"limit,omitempty"`
+	Signal    string           `json:"signal,omitempty"`
+	Rusage    *cmdstore.Rusage `json:"rusage,omitempty"`
+	Stats     *execStats       `json:"stats,omitempty"`
+	Position  int              `json:"position,omitempty"`
+	Step      *int             `json:"step,omitempty"`
+	Summary   *batchSummary    `json:"summary,omitempty"`
+	Expect    *expectEvent     `json:"expect,omitempty"`
+	Timestamp string           `json:"ts"`
+	Error     string           `json:"error,omitempty"`
 }
 
 func now() string {
@@ -69,10 +190,111 @@ func buildCommand(name string, args []string) *exec.Cmd {
 	return exec.Command(name, args...)
 }
 
+// posixShells are the login shells a shell-mode command can run under; any
+// other login shell (fish, nologin, ...) falls back to fallbackShell.
+var posixShells = map[string]bool{
+	"sh":   true,
+	"bash": true,
+	"dash": true,
+	"ash":  true,
+	"ksh":  true,
+	"mksh": true,
+	"zsh":  true,
+}
+
+const fallbackShell = "/bin/sh"
+
+// buildShellCommand runs script through loginShell. pipefail is enabled
+// where the shell supports it (probed in a subshell, since a failing set
+// would abort a POSIX shell), and args are passed as positional parameters.
+func buildShellCommand(loginShell, script string, args []string, login, errexit bool) *exec.Cmd {
+	shell := loginShell
+	if !filepath.IsAbs(shell) || !posixShells[filepath.Base(shell)] {
+		shell = fallbackShell
+	}
+
+	prelude := "(set -o pipefail) 2>/dev/null && set -o pipefail\n"
+	if errexit {
+		prelude += "set -e\n"
+	}
+
+	shellArgs := []string{}
+	if login {
+		shellArgs = append(shellArgs, "-l")
+	}
+	shellArgs = append(shellArgs, "-c", prelude+script, shell)
+	shellArgs = append(shellArgs, args...)
+	return exec.Command(shell, shellArgs...)
+}
+
+// commandIO holds the streams wired to a started command.
+type commandIO struct {
+	stdin  io.WriteCloser // nil unless stdin was requested or a TTY is used
+	stdout io.ReadCloser
+	stderr io.ReadCloser // nil under a TTY, where stderr is merged into stdout
+	tty    *os.File
+}
+
+// startCommand wires the command's streams according to req and starts it.
+// With req.TTY the command runs under a pseudo-terminal; otherwise stdout and
+// stderr are separate pipes and stdin is only opened when req.Stdin is set.
+func startCommand(cmd *exec.Cmd, req runRequest) (*commandIO, error) {
+	if req.TTY {
+		cols, rows := req.Cols, req.Rows
+		if cols == 0 {
+			cols = defaultTTYCols
+		}
+		if rows == 0 {
+			rows = defaultTTYRows
+		}
+		if cmd.Env == nil {
+			cmd.Env = cmd.Environ()
+		}
+		cmd.Env = append(cmd.Env, "TERM=xterm-256color")
+
+		ptmx, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: cols, Rows: rows})
+		if err != nil {
+			return nil, fmt.Errorf("pty start: %w", err)
+		}
+		return &commandIO{stdin: ptyInput{f: ptmx}, stdout: ptmx, tty: ptmx}, nil
+	}
+
+	// Run the command as leader of its own process group so signals can
+	// reach everything it forks. (pty.Start uses setsid, which already does
+	// this for TTY commands.)
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	cio := &commandIO{}
+	var err error
+	if req.Stdin {
+		if cio.stdin, err = cmd.StdinPipe(); err != nil {
+			return nil, fmt.Errorf("stdin pipe: %w", err)
+		}
+	}
+	if cio.stdout, err = cmd.StdoutPipe(); err != nil {
+		return nil, fmt.Errorf("stdout pipe: %w", err)
+	}
+	if cio.stderr, err = cmd.StderrPipe(); err != nil {
+		return nil, fmt.Errorf("stderr pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start: %w", err)
+	}
+	return cio, nil
+}
+
 func writeEvent(w io.Writer, mu *sync.Mutex, evt ndjsonEvent) {
 	mu.Lock()
 	defer mu.Unlock()
 	data, _ := json.Marshal(evt)
+	writeLine(w, data)
+}
+
+// writeLine writes one encoded event as an NDJSON line and flushes it.
+func writeLine(w io.Writer, data []byte) {
 	fmt.Fprintf(w, "%s\n", data)
 	if f, ok := w.(http.Flusher); ok {
 		f.Flush()
@@ -91,9 +313,87 @@ func handleRun(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defa
 		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
 		return
 	}
+	runExec(r.Context(), req, newExecSink(newHTTPOutput(w, r)), logger, defaultUser)
+}
+
+// execPlan is a validated runRequest with its defaults applied.
+type execPlan struct {
+	req        runRequest
+	killSignal syscall.Signal
+	killGrace  time.Duration
+	limits     cgroup.Limits
+	context    *execctx.Context
+	expect     []expectAction
+}
+
+// planExec validates req and applies defaults. Its errors are client errors.
+func planExec(req runRequest, defaultUser string) (*execPlan, error) {
+	if req.Script != "" {
+		if req.Cmd != "" {
+			return nil, errors.New("cmd and script are mutually exclusive")
+		}
+		req.Cmd = req.Script
+		req.Shell = true
+	}
 	if req.Cmd == "" {
-		http.Error(w, `{"error":"cmd is required"}`, http.StatusBadRequest)
-		return
+		return nil, errors.New("cmd is required")
+	}
+
+	plan := &execPlan{killSignal: syscall.SIGTERM, killGrace: defaultKillGrace}
+	if req.KillSignal != "" {
+		sig, err := signals.Parse(req.KillSignal)
+		if err != nil {
+			return nil, fmt.Errorf("killSignal: %w", err)
+		}
+		plan.killSignal = sig
+	}
+	if req.KillGraceMs > 0 {
+		plan.killGrace = time.Duration(req.KillGraceMs) * time.Millisecond
+	}
+
+	switch req.Encoding {
+	case "", encodingUTF8, encodingBase64:
+	default:
+		return nil, errors.New("encoding must be utf8 or base64")
+	}
+
+	if req.Limits != nil {
+		plan.limits = *req.Limits
+		if err := plan.limits.Validate(); err != nil {
+			return nil, fmt.Errorf("limits: %w", err)
+		}
+	}
+
+	switch req.OnDisconnect {
+	case "", disconnectKill, disconnectDetach, disconnectContinue:
+	default:
+		return nil, errors.New("onDisconnect must be kill, detach or continue")
+	}
+
+	if len(req.Expect) > 0 {
+		if !req.TTY || req.Detached {
+			return nil, errors.New("expect requires tty and cannot be detached")
+		}
+		actions, err := planExpect(req.Expect)
+		if err != nil {
+			return nil, err
+		}
+		plan.expect = actions
+	}
+
+	if !admission.ValidPriority(req.Priority) {
+		return nil, admission.ErrInvalidPriority
+	}
+
+	if req.ContextID != "" {
+		plan.context = execctx.Get(req.ContextID)
+		if plan.context == nil {
+			return nil, errors.New("context not found")
+		}
+		if req.User != "" && req.User != plan.context.User {
+			return nil, errors.New("user is fixed by the context")
+		}
+		req.User = plan.context.User
 	}
 
 	// Apply default user when none specified in request.
@@ -101,6 +401,21 @@ func handleRun(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defa
 		req.User = defaultUser
 	}
 
+	plan.req = req
+	return plan, nil
+}
+
+// runExec validates req, admits and starts the command and delivers its
+// events to sink until it finishes. When ctx is done first, the client is
+// gone and req.OnDisconnect decides what happens to the command.
+func runExec(ctx context.Context, req runRequest, sink *execSink, logger *slog.Logger, defaultUser string) {
+	plan, err := planExec(req, defaultUser)
+	if err != nil {
+		sink.fail(http.StatusBadRequest, err.Error())
+		return
+	}
+	req = plan.req
+
 	logger.Info("exec",
 		"cmd", req.Cmd,
 		"args", req.Args,
@@ -108,17 +423,137 @@ func handleRun(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defa
 		"detached", req.Detached,
 		"timeout_ms", req.TimeoutMs,
 		"user", req.User,
+		"tty", req.TTY,
+		"encoding", req.Encoding,
+		"shell", req.Shell,
 	)
 
-	if int(activeCommands.Load()) >= maxConcurrentCommands {
-		http.Error(w, `{"error":"too many concurrent commands"}`, http.StatusTooManyRequests)
+	if !admitExec(ctx, sink, logger, req.Priority, req.QueueTimeoutMs, req.Cmd) {
+		return
+	}
+	entry, finished := startExec(plan, sink, logger, execAdmission.Release)
+	if entry == nil {
+		return
+	}
+	go func() {
+		<-finished
+		sink.events.Close()
+	}()
+	if req.Detached {
 		return
 	}
-	activeCommands.Add(1)
 
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		// The client went away. Events keep being journaled; stop writing
+		// to the dead connection so the handler can return.
+		sink.detach()
+		applyDisconnect(logger, plan, entry)
+	}
+}
+
+// admitExec takes an admission slot, reporting a queued event while it
+// waits. It returns false if no slot was granted; the failure has then been
+// delivered to sink.
+func admitExec(ctx context.Context, sink *execSink, logger *slog.Logger, priority string, queueTimeoutMs int, cmd string) bool {
+	queueTimeout := time.Duration(queueTimeoutMs) * time.Millisecond
+	// The stream starts early when the command has to queue, so later
+	// failures may have to be reported as an error event.
+	err := execAdmission.Acquire(ctx, priority, queueTimeout, func(position int) {
+		active, queued := execAdmission.Stats()
+		logger.Info("exec.queued", "cmd", cmd, "position", position, "active", active, "queued", queued)
+		sink.begin()
+		sink.send(ndjsonEvent{Type: "queued", Position: position, Timestamp: now()})
+	})
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, admission.ErrBusy), errors.Is(err, admission.ErrQueueFull):
+		sink.fail(http.StatusTooManyRequests, err.Error())
+	case errors.Is(err, admission.ErrQueueTimeout):
+		sink.fail(http.StatusServiceUnavailable, err.Error())
+	default:
+		// The client went away while queued.
+	}
+	return false
+}
+
+// applyDisconnect applies the plan's onDisconnect policy to a command whose
+// client went away.
+func applyDisconnect(logger *slog.Logger, plan *execPlan, entry *cmdstore.Entry) {
+	policy := plan.req.OnDisconnect
+	if policy == "" {
+		policy = disconnectKill
+	}
+	logger.Info("exec.disconnect", "cmd_id", entry.ID, "policy", policy)
+	switch policy {
+	case disconnectKill:
+		entry.MarkKilled()
+		entry.Terminate(plan.killSignal, cmdstore.ScopeTree, plan.killGrace)
+	case disconnectDetach:
+		entry.MarkDetached()
+	}
+}
+
+// startExec starts an admitted command and delivers its events to sink in
+// the background. release is called once the command no longer needs its
+// admission slot. The returned channel is closed after the exit event has
+// been sent. If the command cannot be started, the failure is delivered to
+// sink and startExec returns a nil entry.
+func startExec(plan *execPlan, sink *execSink, logger *slog.Logger, release func()) (*cmdstore.Entry, <-chan struct{}) {
+	req, limits := plan.req, plan.limits
 	start := time.Now()
 
-	cmd := buildCommand(req.Cmd, req.Args)
+	var creds *sysuser.Credentials
+	if req.User != "" {
+		var err error
+		creds, err = sysuser.Resolve(req.User)
+		if err != nil {
+			release()
+			sink.fail(http.StatusBadRequest, fmt.Sprintf("resolve user: %s", err))
+			return nil, nil
+		}
+	}
+
+	// In a context, commands start from its cwd and environment, and the
+	// final cwd and environment of a shell-mode command carry over to the
+	// next one. Detached commands never update the context.
+	script := req.Cmd
+	var stateFile *os.File
+	if plan.context != nil && req.Shell && !req.Detached {
+		var err error
+		if stateFile, err = contextStateFile(); err != nil {
+			release()
+			sink.fail(http.StatusInternalServerError, fmt.Sprintf("context state: %s", err))
+			return nil, nil
+		}
+		script = contextTrap() + script
+	}
+	fail := func(status int, msg string) {
+		if stateFile != nil {
+			stateFile.Close()
+		}
+		release()
+		sink.fail(status, msg)
+	}
+
+	var cmd *exec.Cmd
+	if req.Shell {
+		loginShell := ""
+		if creds != nil {
+			loginShell = creds.Shell
+		}
+		cmd = buildShellCommand(loginShell, script, req.Args, req.Login, req.Errexit)
+	} else {
+		cmd = buildCommand(req.Cmd, req.Args)
+	}
+	if stateFile != nil {
+		cmd.ExtraFiles = []*os.File{stateFile}
+	}
+	if plan.context != nil {
+		cmd.Dir, cmd.Env = plan.context.Environ(cmd.Environ())
+	}
 	if req.Cwd != "" {
 		cmd.Dir = req.Cwd
 	}
@@ -133,174 +568,599 @@ func handleRun(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defa
 	}
 
 	// Apply credentials after env merge so HOME/USER/LOGNAME are canonical.
-	if req.User != "" {
-		creds, err := sysuser.Resolve(req.User)
-		if err != nil {
-			activeCommands.Add(-1)
-			http.Error(w, fmt.Sprintf(`{"error":"resolve user: %s"}`, err), http.StatusBadRequest)
-			return
-		}
+	if creds != nil {
 		creds.Apply(cmd)
 	}
 
-	stdout, err := cmd.StdoutPipe()
+	// Place the command in its own cgroup leaf. Without cgroup v2 commands
+	// still run, but only the wall-time limit can be enforced.
+	cg, err := cgroup.New("exec", limits)
 	if err != nil {
-		activeCommands.Add(-1)
-		http.Error(w, fmt.Sprintf(`{"error":"stdout pipe: %s"}`, err), http.StatusInternalServerError)
-		return
+		if limits.NeedsCgroup() {
+			fail(http.StatusBadRequest, fmt.Sprintf("limits: %s", err))
+			return nil, nil
+		}
+		if !errors.Is(err, cgroup.ErrUnavailable) {
+			logger.Warn("exec.cgroup", "error", err)
+		}
+		cg = nil
 	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		activeCommands.Add(-1)
-		http.Error(w, fmt.Sprintf(`{"error":"stderr pipe: %s"}`, err), http.StatusInternalServerError)
-		return
+	var cgFile *os.File
+	if cg != nil {
+		cgFile, err = cg.Open()
+		if err != nil {
+			cg.Remove()
+			fail(http.StatusInternalServerError, fmt.Sprintf("open cgroup: %s", err))
+			return nil, nil
+		}
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgFile.Fd())
 	}
 
-	if err := cmd.Start(); err != nil {
-		activeCommands.Add(-1)
-		http.Error(w, fmt.Sprintf(`{"error":"start: %s"}`, err), http.StatusInternalServerError)
-		return
+	cio, err := startCommand(cmd, req)
+	if cgFile != nil {
+		cgFile.Close()
+	}
+	if err != nil {
+		if cg != nil {
+			cg.Remove()
+		}
+		fail(http.StatusInternalServerError, err.Error())
+		return nil, nil
 	}
 
-	cmdID := cmdstore.Store(cmd)
-
-	w.Header().Set("Content-Type", "application/x-ndjson")
-	w.Header().Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(http.StatusOK)
+	entry := cmdstore.Store(cmd, cio.stdin, cio.tty, sink.commandEvents(), cmdstore.Meta{
+		Cmd:       req.Cmd,
+		Args:      req.Args,
+		User:      req.User,
+		Cwd:       cmd.Dir,
+		Detached:  req.Detached,
+		TTY:       req.TTY,
+		ContextID: req.ContextID,
+	})
+	cmdID := entry.ID
+	startEnv := cmd.Env
 
-	var mu sync.Mutex
-	writeEvent(w, &mu, ndjsonEvent{
+	sink.started(entry)
+	sink.begin()
+	sink.send(ndjsonEvent{
 		Type:      "started",
 		ID:        cmdID,
 		PID:       cmd.Process.Pid,
 		Timestamp: now(),
 	})
 
-	// In detached mode, return after the started event; the process continues in background.
+	// Handle timeout: signal the whole process group, escalating to SIGKILL
+	// if it is still running after the grace period. A wall-time limit is
+	// the same mechanism, reported as a limit.
+	var timedOut atomic.Bool
+	var limitHit atomic.Value
+	var timer *time.Timer
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	timeoutLimit := ""
+	if wall := time.Duration(limits.WallTimeMs) * time.Millisecond; wall > 0 && (timeout == 0 || wall < timeout) {
+		timeout = wall
+		timeoutLimit = limitWall
+	}
+	if timeout > 0 {
+		timer = time.AfterFunc(timeout, func() {
+			timedOut.Store(true)
+			if timeoutLimit != "" {
+				limitHit.Store(timeoutLimit)
+			}
+			entry.Terminate(plan.killSignal, cmdstore.ScopeGroup, plan.killGrace)
+		})
+	}
+	if cg != nil && limits.CPUTimeMs > 0 {
+		go enforceCPUTime(entry, cg, time.Duration(limits.CPUTimeMs)*time.Millisecond, &limitHit)
+	}
+
+	// finish reaps the process once its output has been drained, records the
+	// result on the store entry and logs it.
+	var wg sync.WaitGroup
+	finish := func() cmdstore.Result {
+		wg.Wait()
+		err := cmd.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+		if cio.tty != nil {
+			cio.tty.Close()
+		}
+		release()
+
+		res := commandResult(cmd.ProcessState, err, timedOut.Load())
+		res.FinishedAt = time.Now()
+		if limit, ok := limitHit.Load().(string); ok {
+			res.Limit = limit
+		} else if cg != nil && cg.OOMKilled() {
+			res.Limit = limitMemory
+		}
+		if cg != nil {
+			cg.Remove()
+		}
+		if stateFile != nil {
+			if err := updateContext(plan.context, stateFile, startEnv); err != nil {
+				logger.Warn("exec.context", "cmd_id", cmdID, "context_id", req.ContextID, "error", err)
+			}
+		}
+		entry.Finish(res)
+		logResult(logger, cmdID, res, time.Since(start), req.Detached)
+		return res
+	}
+
+	// In detached mode, return after the started event; the process continues
+	// in background and its output is retained for GET /exec/{id}/logs. The
+	// exit event is still journaled for GET /exec/{id}/events.
+	finished := make(chan struct{})
 	if req.Detached {
+		drain := func(pipe io.Reader, streamType string) {
+			defer wg.Done()
+			io.Copy(entry.Output.Writer(streamType), pipe)
+		}
+		wg.Add(1)
+		go drain(cio.stdout, "stdout")
+		if cio.stderr != nil {
+			wg.Add(1)
+			go drain(cio.stderr, "stderr")
+		}
+		sink.detach()
 		go func() {
-			cmd.Wait()
-			activeCommands.Add(-1)
-			cmdstore.Remove(cmdID)
-			logger.Info("exec.done",
-				"cmd_id", cmdID,
-				"exit_code", -1,
-				"duration_ms", time.Since(start).Milliseconds(),
-				"detached", true,
-			)
+			defer close(finished)
+			sink.send(resultEvent(finish()))
 		}()
-		return
+		return entry, finished
 	}
 
-	// Stream stdout and stderr concurrently.
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	streamPipe := func(pipe io.ReadCloser, streamType string) {
+	// Stream stdout and stderr concurrently, retaining a copy in the log.
+	streamPipe := func(pipe io.Reader, streamType string) {
 		defer wg.Done()
-		scanner := bufio.NewScanner(pipe)
+		tee := io.TeeReader(pipe, entry.Output.Writer(streamType))
+		scanner := bufio.NewScanner(tee)
 		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
 		for scanner.Scan() {
-			writeEvent(w, &mu, ndjsonEvent{
+			sink.send(ndjsonEvent{
 				Type:      streamType,
 				Data:      scanner.Text(),
 				Timestamp: now(),
 			})
 		}
+		// Keep draining if the scanner gave up (e.g. a line over 1MB) so the
+		// command never blocks on a full pipe and the log stays complete.
+		io.Copy(io.Discard, tee)
 	}
 
-	go streamPipe(stdout, "stdout")
-	go streamPipe(stderr, "stderr")
+	// In base64 mode, forward raw reads instead of lines so output keeps its
+	// exact bytes regardless of line length or encoding. Offsets match the
+	// ones served by GET /exec/{id}/logs.
+	streamChunks := func(pipe io.Reader, streamType string) {
+		defer wg.Done()
+		buf := make([]byte, outputChunkSize)
+		for {
+			n, err := pipe.Read(buf)
+			if n > 0 {
+				offset := entry.Output.Append(streamType, buf[:n])
+				sink.send(ndjsonEvent{
+					Type:      streamType,
+					Data:      base64.StdEncoding.EncodeToString(buf[:n]),
+					Encoding:  encodingBase64,
+					Offset:    &offset,
+					Timestamp: now(),
+				})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
 
-	// Handle timeout.
-	var timedOut atomic.Bool
-	if req.TimeoutMs > 0 {
-		timer := time.AfterFunc(time.Duration(req.TimeoutMs)*time.Millisecond, func() {
-			timedOut.Store(true)
-			cmd.Process.Kill()
-		})
-		defer timer.Stop()
+	stream := streamPipe
+	if req.Encoding == encodingBase64 {
+		stream = streamChunks
+	}
+	wg.Add(1)
+	go stream(cio.stdout, "stdout")
+	if cio.stderr != nil {
+		wg.Add(1)
+		go stream(cio.stderr, "stderr")
+	}
+
+	var auxWG sync.WaitGroup
+	if req.StatsIntervalMs > 0 {
+		auxWG.Add(1)
+		go func() {
+			defer auxWG.Done()
+			streamStats(sink.send, entry, time.Duration(req.StatsIntervalMs)*time.Millisecond)
+		}()
+	}
+	if len(plan.expect) > 0 {
+		auxWG.Add(1)
+		go func() {
+			defer auxWG.Done()
+			runExpect(sink.send, entry, plan.expect, func() {
+				entry.MarkKilled()
+				entry.Terminate(plan.killSignal, cmdstore.ScopeTree, plan.killGrace)
+			})
+		}()
 	}
 
-	wg.Wait()
-	err = cmd.Wait()
-	activeCommands.Add(-1)
-	cmdstore.Remove(cmdID)
+	go func() {
+		defer close(finished)
+		res := finish()
+		// Make sure no stats or expect event can follow the terminal event.
+		auxWG.Wait()
+		sink.send(resultEvent(res))
+	}()
+	return entry, finished
+}
+
+// commandResult converts the outcome of cmd.Wait into a store result,
+// including resource usage and the terminating signal when available.
+func commandResult(state *os.ProcessState, err error, timedOut bool) cmdstore.Result {
+	var res cmdstore.Result
+	if state != nil {
+		res.Rusage = rusageFromState(state)
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			res.Signal = signals.Name(ws.Signal())
+		}
+	}
+
+	if timedOut {
+		res.TimedOut = true
+		return res
+	}
+	if err == nil {
+		code := 0
+		res.ExitCode = &code
+		return res
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code := exitErr.ExitCode()
+		res.ExitCode = &code
+		return res
+	}
+	res.Error = err.Error()
+	return res
+}
+
+// rusageFromState extracts the wait4 resource usage of a reaped process. It
+// covers the process and any descendants it waited for.
+func rusageFromState(state *os.ProcessState) *cmdstore.Rusage {
+	ru, ok := state.SysUsage().(*syscall.Rusage)
+	if !ok || ru == nil {
+		return nil
+	}
+	toMs := func(tv syscall.Timeval) int64 {
+		return tv.Sec*1000 + tv.Usec/1000
+	}
+	return &cmdstore.Rusage{
+		UserTimeMs:             toMs(ru.Utime),
+		SystemTimeMs:           toMs(ru.Stime),
+		MaxRSSKB:               ru.Maxrss,
+		MinorFaults:            ru.Minflt,
+		MajorFaults:            ru.Majflt,
+		InBlocks:               ru.Inblock,
+		OutBlocks:              ru.Oublock,
+		VoluntaryCtxSwitches:   ru.Nvcsw,
+		InvoluntaryCtxSwitches: ru.Nivcsw,
+	}
+}
+
+// resultEvent builds the terminal event (exit, timeout or error) for res.
+func resultEvent(res cmdstore.Result) ndjsonEvent {
+	ts := res.FinishedAt.UTC().Format(time.RFC3339Nano)
+	switch {
+	case res.TimedOut:
+		return ndjsonEvent{Type: "timeout", Limit: res.Limit, Signal: res.Signal, Rusage: res.Rusage, Timestamp: ts}
+	case res.Error != "":
+		return ndjsonEvent{Type: "error", Error: res.Error, Timestamp: ts}
+	default:
+		return ndjsonEvent{Type: "exit", ExitCode: res.ExitCode, Limit: res.Limit, Signal: res.Signal, Rusage: res.Rusage, Timestamp: ts}
+	}
+}
+
+// enforceCPUTime kills the command's process group once the CPU time used by
+// its cgroup exceeds limit.
+func enforceCPUTime(entry *cmdstore.Entry, cg *cgroup.Group, limit time.Duration, limitHit *atomic.Value) {
+	ticker := time.NewTicker(cpuTimePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-entry.Done():
+			return
+		case <-ticker.C:
+			used, err := cg.CPUUsage()
+			if err != nil || used < limit {
+				continue
+			}
+			limitHit.Store(limitCPU)
+			entry.Terminate(syscall.SIGKILL, cmdstore.ScopeGroup, 0)
+			return
+		}
+	}
+}
 
-	if timedOut.Load() {
+func logResult(logger *slog.Logger, cmdID string, res cmdstore.Result, duration time.Duration, detached bool) {
+	switch {
+	case res.TimedOut:
 		logger.Info("exec.done",
 			"cmd_id", cmdID,
 			"exit_code", -1,
-			"duration_ms", time.Since(start).Milliseconds(),
+			"duration_ms", duration.Milliseconds(),
 			"timeout", true,
+			"detached", detached,
 		)
-		writeEvent(w, &mu, ndjsonEvent{
-			Type:      "timeout",
-			Timestamp: now(),
-		})
+	case res.Error != "":
+		logger.Error("exec.done",
+			"cmd_id", cmdID,
+			"error", res.Error,
+			"duration_ms", duration.Milliseconds(),
+			"detached", detached,
+		)
+	default:
+		logger.Info("exec.done",
+			"cmd_id", cmdID,
+			"exit_code", *res.ExitCode,
+			"duration_ms", duration.Milliseconds(),
+			"detached", detached,
+			"limit", res.Limit,
+			"signal", res.Signal,
+		)
+	}
+}
+
+func handleKill(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, `{"error":"id is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	// The body is optional; an empty request kills the whole process group.
+	var req killRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	sig := syscall.SIGKILL
+	if req.Signal != "" {
+		parsed, err := signals.Parse(req.Signal)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"%s"}`, err), http.StatusBadRequest)
+			return
+		}
+		sig = parsed
+	}
+	if req.Scope == "" {
+		req.Scope = cmdstore.ScopeGroup
+	}
+
+	entry := cmdstore.Get(id)
+	if entry == nil {
+		http.Error(w, `{"error":"command not found"}`, http.StatusNotFound)
+		return
+	}
+	if _, finished := entry.Result(); finished {
+		http.Error(w, `{"error":"command has exited"}`, http.StatusConflict)
+		return
+	}
+
+	entry.MarkKilled()
+	grace := time.Duration(req.GraceMs) * time.Millisecond
+	if err := entry.Terminate(sig, req.Scope, grace); err != nil {
+		if errors.Is(err, cmdstore.ErrInvalidScope) {
+			http.Error(w, `{"error":"scope must be process, group or tree"}`, http.StatusBadRequest)
+			return
+		}
+		http.Error(w, fmt.Sprintf(`{"error":"kill: %s"}`, err), http.StatusInternalServerError)
+		return
+	}
+
+	status := "signaled"
+	if sig == syscall.SIGKILL {
+		status = "killed"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": status,
+		"signal": signals.Name(sig),
+		"scope":  req.Scope,
+	})
+}
+
+// handleStdin streams the request body into the stdin of a running command.
+// With ?eof=true the pipe is closed once the body has been copied, so an
+// empty body with eof=true simply delivers EOF.
+func handleStdin(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, `{"error":"id is required"}`, http.StatusBadRequest)
 		return
 	}
 
+	entry := cmdstore.Get(id)
+	if entry == nil {
+		http.Error(w, `{"error":"command not found"}`, http.StatusNotFound)
+		return
+	}
+
+	n, err := entry.CopyStdin(r.Body)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			code := exitErr.ExitCode()
-			logger.Info("exec.done",
-				"cmd_id", cmdID,
-				"exit_code", code,
-				"duration_ms", time.Since(start).Milliseconds(),
-			)
-			writeEvent(w, &mu, ndjsonEvent{
-				Type:      "exit",
-				ExitCode:  &code,
-				Timestamp: now(),
-			})
-		} else {
-			logger.Error("exec.done",
-				"cmd_id", cmdID,
-				"error", err.Error(),
-				"duration_ms", time.Since(start).Milliseconds(),
-			)
-			writeEvent(w, &mu, ndjsonEvent{
-				Type:      "error",
-				Error:     err.Error(),
-				Timestamp: now(),
-			})
+		if errors.Is(err, cmdstore.ErrStdinClosed) || errors.Is(err, os.ErrClosed) || errors.Is(err, syscall.EPIPE) {
+			http.Error(w, `{"error":"stdin is closed"}`, http.StatusConflict)
+			return
 		}
+		http.Error(w, fmt.Sprintf(`{"error":"write stdin: %s"}`, err), http.StatusInternalServerError)
 		return
 	}
 
-	code := 0
-	logger.Info("exec.done",
-		"cmd_id", cmdID,
-		"exit_code", code,
-		"duration_ms", time.Since(start).Milliseconds(),
-	)
-	writeEvent(w, &mu, ndjsonEvent{
-		Type:      "exit",
-		ExitCode:  &code,
-		Timestamp: now(),
+	closed := false
+	if eof, _ := strconv.ParseBool(r.URL.Query().Get("eof")); eof {
+		if err := entry.CloseStdin(); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":"close stdin: %s"}`, err), http.StatusInternalServerError)
+			return
+		}
+		closed = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"bytesWritten": n,
+		"closed":       closed,
 	})
 }
 
-func handleKill(w http.ResponseWriter, r *http.Request) {
+// handleResize changes the terminal size of a command started with tty=true.
+func handleResize(w http.ResponseWriter, r *http.Request) {
 	id := r.PathValue("id")
 	if id == "" {
 		http.Error(w, `{"error":"id is required"}`, http.StatusBadRequest)
 		return
 	}
 
-	cmd := cmdstore.Get(id)
-	if cmd == nil {
+	var req resizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if req.Cols == 0 || req.Rows == 0 {
+		http.Error(w, `{"error":"cols and rows are required"}`, http.StatusBadRequest)
+		return
+	}
+
+	entry := cmdstore.Get(id)
+	if entry == nil {
 		http.Error(w, `{"error":"command not found"}`, http.StatusNotFound)
 		return
 	}
+	if _, finished := entry.Result(); finished {
+		http.Error(w, `{"error":"command has exited"}`, http.StatusConflict)
+		return
+	}
 
-	if err := cmd.Process.Kill(); err != nil {
-		http.Error(w, fmt.Sprintf(`{"error":"kill: %s"}`, err), http.StatusInternalServerError)
+	if err := entry.Resize(req.Cols, req.Rows); err != nil {
+		if errors.Is(err, cmdstore.ErrNoTTY) {
+			http.Error(w, `{"error":"command has no tty"}`, http.StatusConflict)
+			return
+		}
+		http.Error(w, fmt.Sprintf(`{"error":"resize: %s"}`, err), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"ok":true}`))
+}
+
+// handleLogs replays a command's retained output starting at ?offset= (a byte
+// offset across both streams, default 0). With ?follow=true the response
+// stays open and tails new output until the command finishes. Once the
+// command has finished, the stream ends with its exit, timeout or error event.
+// ?encoding=base64 returns chunk data base64-encoded for binary output.
+func handleLogs(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, `{"error":"id is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	var offset int64
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, `{"error":"invalid offset"}`, http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+	follow, _ := strconv.ParseBool(r.URL.Query().Get("follow"))
+	encoding := r.URL.Query().Get("encoding")
+	if encoding != "" && encoding != encodingUTF8 && encoding != encodingBase64 {
+		http.Error(w, `{"error":"encoding must be utf8 or base64"}`, http.StatusBadRequest)
+		return
+	}
+
+	entry := cmdstore.Get(id)
+	if entry == nil {
+		http.Error(w, `{"error":"command not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]string{"status": "killed"})
+
+	var mu sync.Mutex
+	for {
+		// Grab the notify channel before reading so nothing appended in
+		// between is missed.
+		changed := entry.Output.Wait()
+		chunks, next, closed := entry.Output.Read(offset)
+		for _, c := range chunks {
+			chunkOffset := c.Offset
+			evt := ndjsonEvent{
+				Type:      c.Stream,
+				Data:      string(c.Data),
+				Offset:    &chunkOffset,
+				Timestamp: c.Time.UTC().Format(time.RFC3339Nano),
+			}
+			if encoding == encodingBase64 {
+				evt.Data = base64.StdEncoding.EncodeToString(c.Data)
+				evt.Encoding = encodingBase64
+			}
+			writeEvent(w, &mu, evt)
+		}
+		offset = next
+
+		if closed {
+			if res, ok := entry.Result(); ok {
+				writeEvent(w, &mu, resultEvent(res))
+			}
+			return
+		}
+		if !follow {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// handleListCommands returns JSON info for running and recently finished
+// commands, optionally filtered by ?state=.
+func handleListCommands(w http.ResponseWriter, r *http.Request) {
+	state := r.URL.Query().Get("state")
+	infos := cmdstore.List()
+	if state != "" {
+		filtered := infos[:0]
+		for _, info := range infos {
+			if info.State == state {
+				filtered = append(filtered, info)
+			}
+		}
+		infos = filtered
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// handleGetCommand returns JSON info for a single command.
+func handleGetCommand(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	entry := cmdstore.Get(id)
+	if entry == nil {
+		http.Error(w, `{"error":"command not found"}`, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry.Info())
 }
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/admission"
+	"github.com/angelorc/vmsan/agent/internal/cmdstore"
+)
+
+const maxBatchSteps = 100
+
+// batchStep is one command of a batch. Steps take the same fields as
+// POST /exec, except that detached, priority, queueTimeoutMs and
+// onDisconnect are not allowed per step.
+type batchStep struct {
+	runRequest
+	ContinueOnError bool `json:"continueOnError,omitempty"`
+}
+
+type batchRequest struct {
+	Steps []batchStep       `json:"steps"`
+	Env   map[string]string `json:"env,omitempty"` // shared, overridden by step env
+	Cwd   string            `json:"cwd,omitempty"` // used by steps without a cwd
+
+	// The batch holds a single admission slot for all of its steps.
+	QueueTimeoutMs int    `json:"queueTimeoutMs,omitempty"`
+	Priority       string `json:"priority,omitempty"`
+	OnDisconnect   string `json:"onDisconnect,omitempty"`
+}
+
+// batchSummary is carried by the final "summary" event of a batch.
+type batchSummary struct {
+	Succeeded  int               `json:"succeeded"`
+	Failed     int               `json:"failed"`
+	Skipped    int               `json:"skipped"`
+	Steps      []batchStepResult `json:"steps"`
+	DurationMs int64             `json:"durationMs"`
+}
+
+type batchStepResult struct {
+	Step       int    `json:"step"`
+	ID         string `json:"id,omitempty"`
+	State      string `json:"state"` // a command state, or skipped
+	ExitCode   *int   `json:"exitCode,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+const stateSkipped = "skipped"
+
+func makeBatchHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleBatch(w, r, logger, defaultUser)
+	}
+}
+
+// handleBatch runs steps in order under one admission slot, streaming all
+// their events in one response tagged with the step index. Each step's
+// command also journals its own events for GET /exec/{id}/events. A
+// failing step stops the batch unless it sets continueOnError; the
+// remaining steps are reported as skipped in the closing summary event.
+func handleBatch(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defaultUser string) {
+	var req batchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Steps) == 0 {
+		http.Error(w, `{"error":"steps are required"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Steps) > maxBatchSteps {
+		http.Error(w, fmt.Sprintf(`{"error":"at most %d steps are allowed"}`, maxBatchSteps), http.StatusBadRequest)
+		return
+	}
+	if !admission.ValidPriority(req.Priority) {
+		http.Error(w, fmt.Sprintf(`{"error":"%s"}`, admission.ErrInvalidPriority), http.StatusBadRequest)
+		return
+	}
+	switch req.OnDisconnect {
+	case "", disconnectKill, disconnectDetach, disconnectContinue:
+	default:
+		http.Error(w, `{"error":"onDisconnect must be kill, detach or continue"}`, http.StatusBadRequest)
+		return
+	}
+	// Only a kill policy stops the batch; otherwise it runs to completion
+	// in the background.
+	stopOnDisconnect := req.OnDisconnect == "" || req.OnDisconnect == disconnectKill
+
+	plans := make([]*execPlan, len(req.Steps))
+	for i, step := range req.Steps {
+		if step.Detached {
+			http.Error(w, fmt.Sprintf(`{"error":"steps[%d]: steps cannot be detached"}`, i), http.StatusBadRequest)
+			return
+		}
+		if step.Priority != "" || step.QueueTimeoutMs != 0 || step.OnDisconnect != "" {
+			http.Error(w, fmt.Sprintf(`{"error":"steps[%d]: priority, queueTimeoutMs and onDisconnect apply to the whole batch"}`, i), http.StatusBadRequest)
+			return
+		}
+		stepReq := step.runRequest
+		if len(req.Env) > 0 {
+			env := make(map[string]string, len(req.Env)+len(stepReq.Env))
+			for k, v := range req.Env {
+				env[k] = v
+			}
+			for k, v := range stepReq.Env {
+				env[k] = v
+			}
+			stepReq.Env = env
+		}
+		if stepReq.Cwd == "" {
+			stepReq.Cwd = req.Cwd
+		}
+		stepReq.OnDisconnect = req.OnDisconnect
+		plan, err := planExec(stepReq, defaultUser)
+		if err != nil {
+			encoded, _ := json.Marshal(fmt.Sprintf("steps[%d]: %s", i, err))
+			http.Error(w, `{"error":`+string(encoded)+`}`, http.StatusBadRequest)
+			return
+		}
+		plans[i] = plan
+	}
+
+	logger.Info("exec.batch", "steps", len(plans), "cwd", req.Cwd)
+
+	sink := newExecSink(newHTTPOutput(w, r))
+	if !admitExec(r.Context(), sink, logger, req.Priority, req.QueueTimeoutMs, "batch") {
+		return
+	}
+	sink.begin()
+
+	type runningStep struct {
+		entry *cmdstore.Entry
+		plan  *execPlan
+		// disconnect applies the policy at most once, as both the step's
+		// start and the client's disconnect may find it due.
+		disconnect sync.Once
+	}
+	var disconnected atomic.Bool
+	var current atomic.Pointer[runningStep]
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer sink.events.Close()
+		defer execAdmission.Release()
+		start := time.Now()
+
+		summary := batchSummary{Steps: make([]batchStepResult, 0, len(plans))}
+		stopped := false
+		for i, plan := range plans {
+			if stopped || (stopOnDisconnect && disconnected.Load()) {
+				stopped = true
+				summary.Skipped++
+				summary.Steps = append(summary.Steps, batchStepResult{Step: i, State: stateSkipped})
+				continue
+			}
+
+			sink.setStep(i, func(e *cmdstore.Entry) {
+				step := &runningStep{entry: e, plan: plan}
+				current.Store(step)
+				if disconnected.Load() {
+					step.disconnect.Do(func() { applyDisconnect(logger, plan, e) })
+				}
+			})
+			result := batchStepResult{Step: i, State: cmdstore.StateFailed}
+			if entry, finished := startExec(plan, sink, logger, func() {}); entry != nil {
+				<-finished
+				info := entry.Info()
+				result.ID = info.ID
+				result.State = info.State
+				result.ExitCode = info.ExitCode
+				result.DurationMs = info.DurationMs
+			}
+			summary.Steps = append(summary.Steps, result)
+
+			if result.State == cmdstore.StateExited && result.ExitCode != nil && *result.ExitCode == 0 {
+				summary.Succeeded++
+				continue
+			}
+			summary.Failed++
+			if !req.Steps[i].ContinueOnError {
+				stopped = true
+			}
+		}
+
+		sink.setStep(-1, nil)
+		summary.DurationMs = time.Since(start).Milliseconds()
+		sink.send(ndjsonEvent{Type: "summary", Summary: &summary, Timestamp: now()})
+		logger.Info("exec.batch.done",
+			"succeeded", summary.Succeeded,
+			"failed", summary.Failed,
+			"skipped", summary.Skipped,
+			"duration_ms", summary.DurationMs,
+		)
+	}()
+
+	select {
+	case <-done:
+	case <-r.Context().Done():
+		// The client went away. The batch's onDisconnect policy applies to
+		// the running step and, unless it is kill, to the remaining ones.
+		sink.detach()
+		disconnected.Store(true)
+		if step := current.Load(); step != nil {
+			if _, finished := step.entry.Result(); !finished {
+				step.disconnect.Do(func() { applyDisconnect(logger, step.plan, step.entry) })
+			}
+		}
+	}
+}
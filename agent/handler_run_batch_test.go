@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func runBatch(t *testing.T, body string) (*httptest.ResponseRecorder, []ndjsonEvent) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec := httptest.NewRecorder()
+	handleBatch(rec, httptest.NewRequest("POST", "/exec/batch", strings.NewReader(body)), logger, "")
+
+	var events []ndjsonEvent
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var evt ndjsonEvent
+		if err := json.Unmarshal([]byte(line), &evt); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		events = append(events, evt)
+	}
+	return rec, events
+}
+
+func TestHandleBatch_StopsAtFirstFailureUnlessContinued(t *testing.T) {
+	_, events := runBatch(t, `{"env":{"A":"shared"},"steps":[
+		{"script":"echo $A"},
+		{"cmd":"false","continueOnError":true},
+		{"cmd":"false"},
+		{"cmd":"echo","args":["never"]}
+	]}`)
+
+	if events[1].Type != "stdout" || events[1].Data != "shared" || events[1].Step == nil || *events[1].Step != 0 {
+		t.Fatalf("expected step 0 to print the shared env, got %+v", events[1])
+	}
+	last := events[len(events)-1]
+	if last.Type != "summary" || last.Step != nil || last.Summary == nil {
+		t.Fatalf("expected an untagged summary event last, got %+v", last)
+	}
+	s := last.Summary
+	if s.Succeeded != 1 || s.Failed != 2 || s.Skipped != 1 || len(s.Steps) != 4 {
+		t.Fatalf("unexpected summary %+v", s)
+	}
+	if s.Steps[3].State != stateSkipped {
+		t.Fatalf("expected the last step to be skipped, got %+v", s.Steps[3])
+	}
+	for i, evt := range events {
+		if evt.Seq != int64(i+1) {
+			t.Fatalf("expected seq %d, got %d", i+1, evt.Seq)
+		}
+	}
+}
+
+func TestHandleBatch_RejectsInvalidSteps(t *testing.T) {
+	rec, _ := runBatch(t, `{"steps":[{"cmd":"true"},{"cmd":"true","priority":"high"}]}`)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "steps[1]") {
+		t.Fatalf("expected a 400 naming the step, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandleBatch_StepEventsAreJournaledPerStep(t *testing.T) {
+	rec, events := runBatch(t, `{"steps":[{"cmd":"echo","args":["one"]},{"cmd":"echo","args":["two"]}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	summary := events[len(events)-1].Summary
+	if summary == nil || len(summary.Steps) != 2 {
+		t.Fatalf("expected a summary of two steps, got %+v", events[len(events)-1])
+	}
+
+	req := httptest.NewRequest("GET", "/exec/"+summary.Steps[1].ID+"/events?follow=false", nil)
+	req.SetPathValue("id", summary.Steps[1].ID)
+	rec = httptest.NewRecorder()
+	handleEvents(rec, req)
+
+	var types []string
+	for i, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var evt ndjsonEvent
+		if err := json.Unmarshal([]byte(line), &evt); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		if evt.Seq != int64(i+1) || evt.Step == nil || *evt.Step != 1 {
+			t.Fatalf("expected event %d of step 1 numbered on its own, got %+v", i, evt)
+		}
+		if evt.Type == "stdout" && evt.Data != "two" {
+			t.Fatalf("expected only the second step's output, got %q", evt.Data)
+		}
+		types = append(types, evt.Type)
+	}
+	if got := strings.Join(types, " "); got != "started stdout exit" {
+		t.Fatalf("expected the step's own events, got %q", got)
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/angelorc/vmsan/agent/internal/cmdstore"
+	"github.com/angelorc/vmsan/agent/internal/eventlog"
+)
+
+// eventOutput is a transport exec events are delivered over: an HTTP
+// response (NDJSON or SSE) or a WebSocket.
+type eventOutput interface {
+	// begin starts the stream, e.g. by sending the response headers.
+	begin()
+	// write delivers one encoded event.
+	write(evt eventlog.Event)
+	// reject reports a failure that happened before the stream began.
+	reject(status int, msg string)
+}
+
+// httpOutput streams events as NDJSON lines or, when the client accepts
+// text/event-stream, as Server-Sent Events whose id is the event's seq.
+type httpOutput struct {
+	w   http.ResponseWriter
+	sse bool
+}
+
+func newHTTPOutput(w http.ResponseWriter, r *http.Request) *httpOutput {
+	return &httpOutput{w: w, sse: strings.Contains(r.Header.Get("Accept"), "text/event-stream")}
+}
+
+func (o *httpOutput) begin() {
+	if o.sse {
+		o.w.Header().Set("Content-Type", "text/event-stream")
+		o.w.Header().Set("Cache-Control", "no-cache")
+	} else {
+		o.w.Header().Set("Content-Type", "application/x-ndjson")
+		o.w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	o.w.WriteHeader(http.StatusOK)
+}
+
+func (o *httpOutput) write(evt eventlog.Event) {
+	if !o.sse {
+		writeLine(o.w, evt.Data)
+		return
+	}
+	if evt.Seq > 0 {
+		fmt.Fprintf(o.w, "id: %d\n", evt.Seq)
+	}
+	fmt.Fprintf(o.w, "data: %s\n\n", evt.Data)
+	if f, ok := o.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (o *httpOutput) reject(status int, msg string) {
+	body, _ := json.Marshal(map[string]string{"error": msg})
+	http.Error(o.w, string(body), status)
+}
+
+// execSink numbers a command's stream events, journals them and delivers
+// them to an eventOutput. Once detached it keeps journaling but stops
+// delivering, so the command can outlive the client.
+type execSink struct {
+	mu       sync.Mutex
+	out      eventOutput
+	events   *eventlog.Log
+	begun    bool
+	detached bool
+	step     *int // tags events with a batch step index
+
+	// stepEvents journals the events of the current batch step once more,
+	// numbered on their own, as the step command's journal.
+	stepEvents *eventlog.Log
+
+	// onStart, if set, is called with the store entry once the command has
+	// started, before its first output is delivered.
+	onStart func(*cmdstore.Entry)
+}
+
+func newExecSink(out eventOutput) *execSink {
+	return &execSink{out: out, events: eventlog.New(cmdstore.EventLogBytes)}
+}
+
+// started calls onStart, if set, with the entry of the started command.
+func (s *execSink) started(entry *cmdstore.Entry) {
+	s.mu.Lock()
+	onStart := s.onStart
+	s.mu.Unlock()
+	if onStart != nil {
+		onStart(entry)
+	}
+}
+
+// begin starts the stream if it has not been started yet.
+func (s *execSink) begin() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.begun {
+		s.begun = true
+		s.out.begin()
+	}
+}
+
+func (s *execSink) send(evt ndjsonEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if evt.Step == nil {
+		evt.Step = s.step
+	}
+	encode := func(seq int64) []byte {
+		evt.Seq = seq
+		data, _ := json.Marshal(evt)
+		return data
+	}
+	if s.stepEvents != nil {
+		s.stepEvents.Append(encode)
+	}
+	journaled := s.events.Append(encode)
+	if !s.detached {
+		s.out.write(journaled)
+	}
+}
+
+// fail reports an error that prevented the command from running: as a
+// plain error before the stream began, or as an error event after (e.g.
+// once a queued event went out).
+func (s *execSink) fail(status int, msg string) {
+	s.mu.Lock()
+	begun := s.begun
+	s.mu.Unlock()
+	if begun {
+		s.send(ndjsonEvent{Type: "error", Error: msg, Timestamp: now()})
+		return
+	}
+	s.out.reject(status, msg)
+}
+
+// setStep tags subsequent events with the batch step index i and journals
+// them in a new journal of the step's own, or, if i is negative, ends the
+// last step. The journal of the previous step is closed, and onStart
+// replaces the sink's onStart.
+func (s *execSink) setStep(i int, onStart func(*cmdstore.Entry)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onStart = onStart
+	if s.stepEvents != nil {
+		s.stepEvents.Close()
+		s.stepEvents = nil
+	}
+	if i < 0 {
+		s.step = nil
+		return
+	}
+	s.step = &i
+	s.stepEvents = eventlog.New(cmdstore.EventLogBytes)
+}
+
+// commandEvents returns the journal of the command about to start: that of
+// the current batch step, else the stream's.
+func (s *execSink) commandEvents() *eventlog.Log {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stepEvents != nil {
+		return s.stepEvents
+	}
+	return s.events
+}
+
+// detach stops delivering to the output. Events sent afterwards are only
+// journaled.
+func (s *execSink) detach() {
+	s.mu.Lock()
+	s.detached = true
+	s.mu.Unlock()
+}
+
+// followEvents delivers the journaled events of entry with a seq greater
+// than after and, if follow is set, keeps delivering new ones until the
+// final event or until ctx is done.
+func followEvents(ctx context.Context, entry *cmdstore.Entry, after int64, follow bool, write func(eventlog.Event)) {
+	for {
+		// Grab the notify channel before reading so nothing appended in
+		// between is missed.
+		changed := entry.Events.Wait()
+		events, _, closed := entry.Events.After(after)
+		for _, evt := range events {
+			write(evt)
+			after = evt.Seq
+		}
+		if closed || !follow {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// handleEvents replays a command's journaled events with a seq greater than
+// ?after= (or the Last-Event-ID header of a reconnecting SSE client) and,
+// unless ?follow=false, keeps streaming new ones until the final event. If
+// older events were already evicted from the journal the response carries
+// X-Events-Truncated: true.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.Error(w, `{"error":"id is required"}`, http.StatusBadRequest)
+		return
+	}
+
+	after := r.URL.Query().Get("after")
+	if after == "" {
+		after = r.Header.Get("Last-Event-ID")
+	}
+	var afterSeq int64
+	if after != "" {
+		n, err := strconv.ParseInt(after, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, `{"error":"invalid after"}`, http.StatusBadRequest)
+			return
+		}
+		afterSeq = n
+	}
+	follow := true
+	if v := r.URL.Query().Get("follow"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, `{"error":"invalid follow"}`, http.StatusBadRequest)
+			return
+		}
+		follow = b
+	}
+
+	entry := cmdstore.Get(id)
+	if entry == nil {
+		http.Error(w, `{"error":"command not found"}`, http.StatusNotFound)
+		return
+	}
+
+	if _, missed, _ := entry.Events.After(afterSeq); missed {
+		w.Header().Set("X-Events-Truncated", "true")
+	}
+	out := newHTTPOutput(w, r)
+	out.begin()
+	followEvents(r.Context(), entry, afterSeq, follow, out.write)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/cmdstore"
+)
+
+const (
+	defaultExpectTimeout = 10 * time.Second
+	maxExpectSteps       = 1000
+
+	// expectWindowBytes bounds the unmatched output patterns are tried
+	// against; older output is dropped from the window.
+	expectWindowBytes = 64 * 1024
+)
+
+// expectStep is one step of an expect script. Exactly one of Expect, Send
+// or EOF is set, or only TimeoutMs, which then becomes the timeout of the
+// expect steps that follow.
+type expectStep struct {
+	// Expect waits for output matching this regular expression (RE2
+	// syntax), or this text if Literal is set.
+	Expect  *string `json:"expect,omitempty"`
+	Literal bool    `json:"literal,omitempty"`
+	// Send writes text to the terminal. Enter is "\r".
+	Send *string `json:"send,omitempty"`
+	// EOF waits for the command to close the terminal, usually by exiting.
+	EOF bool `json:"eof,omitempty"`
+
+	TimeoutMs int `json:"timeoutMs,omitempty"`
+}
+
+// expectEvent reports the outcome of an expect step.
+type expectEvent struct {
+	Index  int      `json:"index"`
+	Status string   `json:"status"` // matched, sent, eof or failed
+	Match  string   `json:"match,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Error  string   `json:"error,omitempty"`
+}
+
+const (
+	expectMatched = "matched"
+	expectSent    = "sent"
+	expectEOF     = "eof"
+	expectFailed  = "failed"
+)
+
+// expectAction is a validated expect step. Timeout-only steps are folded
+// into the steps after them.
+type expectAction struct {
+	index   int // position in the request
+	re      *regexp.Regexp
+	send    *string
+	eof     bool
+	timeout time.Duration
+}
+
+// planExpect validates an expect script.
+func planExpect(steps []expectStep) ([]expectAction, error) {
+	if len(steps) > maxExpectSteps {
+		return nil, fmt.Errorf("at most %d expect steps are allowed", maxExpectSteps)
+	}
+	timeout := defaultExpectTimeout
+	actions := make([]expectAction, 0, len(steps))
+	for i, step := range steps {
+		if step.TimeoutMs < 0 {
+			return nil, fmt.Errorf("expect[%d]: timeoutMs must not be negative", i)
+		}
+		kinds := 0
+		for _, set := range []bool{step.Expect != nil, step.Send != nil, step.EOF} {
+			if set {
+				kinds++
+			}
+		}
+		if kinds > 1 {
+			return nil, fmt.Errorf("expect[%d]: expect, send and eof are mutually exclusive", i)
+		}
+		if kinds == 0 {
+			if step.TimeoutMs == 0 {
+				return nil, fmt.Errorf("expect[%d]: one of expect, send, eof or timeoutMs is required", i)
+			}
+			timeout = time.Duration(step.TimeoutMs) * time.Millisecond
+			continue
+		}
+
+		action := expectAction{index: i, send: step.Send, eof: step.EOF, timeout: timeout}
+		if step.TimeoutMs > 0 {
+			action.timeout = time.Duration(step.TimeoutMs) * time.Millisecond
+		}
+		if step.Expect != nil {
+			pattern := *step.Expect
+			if step.Literal {
+				pattern = regexp.QuoteMeta(pattern)
+			}
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("expect[%d]: %w", i, err)
+			}
+			action.re = re
+		}
+		actions = append(actions, action)
+	}
+	return actions, nil
+}
+
+// runExpect plays an expect script against the terminal output of entry,
+// sending an "expect" event per step. When a step fails it calls abort and
+// stops.
+func runExpect(emit func(ndjsonEvent), entry *cmdstore.Entry, actions []expectAction, abort func()) {
+	report := func(evt expectEvent) {
+		emit(ndjsonEvent{Type: "expect", Expect: &evt, Timestamp: now()})
+	}
+
+	var window []byte
+	var offset int64
+	closed := false
+	// read moves new output into the window and returns a channel that is
+	// closed when more output (or the end of it) is available.
+	read := func() <-chan struct{} {
+		changed := entry.Output.Wait()
+		chunks, next, done := entry.Output.Read(offset)
+		for _, c := range chunks {
+			window = append(window, c.Data...)
+		}
+		if over := len(window) - expectWindowBytes; over > 0 {
+			window = append(window[:0], window[over:]...)
+		}
+		offset, closed = next, done
+		return changed
+	}
+
+	for _, action := range actions {
+		if action.send != nil {
+			if _, err := entry.CopyStdin(strings.NewReader(*action.send)); err != nil {
+				report(expectEvent{Index: action.index, Status: expectFailed, Error: err.Error()})
+				abort()
+				return
+			}
+			report(expectEvent{Index: action.index, Status: expectSent})
+			continue
+		}
+
+		timer := time.NewTimer(action.timeout)
+		var err error
+		for {
+			changed := read()
+			if action.re != nil {
+				if m := action.re.FindSubmatchIndex(window); m != nil {
+					evt := expectEvent{Index: action.index, Status: expectMatched, Match: string(window[m[0]:m[1]])}
+					for i := 2; i < len(m); i += 2 {
+						group := ""
+						if m[i] >= 0 {
+							group = string(window[m[i]:m[i+1]])
+						}
+						evt.Groups = append(evt.Groups, group)
+					}
+					window = append(window[:0], window[m[1]:]...)
+					report(evt)
+					break
+				}
+				if closed {
+					err = errors.New("output ended before a match")
+					break
+				}
+			} else if closed {
+				window = window[:0]
+				report(expectEvent{Index: action.index, Status: expectEOF})
+				break
+			}
+
+			select {
+			case <-changed:
+				continue
+			case <-timer.C:
+				err = fmt.Errorf("timed out after %s", action.timeout)
+			}
+			break
+		}
+		timer.Stop()
+		if err != nil {
+			report(expectEvent{Index: action.index, Status: expectFailed, Error: err.Error()})
+			abort()
+			return
+		}
+	}
+}
+
+func makeExpectHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleExpect(w, r, logger, defaultUser)
+	}
+}
+
+// handleExpect runs a command under a pseudo-terminal and plays an expect
+// script against it server-side. It takes the same body as POST /exec plus
+// the script in "expect" and streams the same events, with an "expect"
+// event per step. A failed step kills the command.
+func handleExpect(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defaultUser string) {
+	var req runRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Expect) == 0 {
+		http.Error(w, `{"error":"expect is required"}`, http.StatusBadRequest)
+		return
+	}
+	req.TTY = true
+	runExec(r.Context(), req, newExecSink(newHTTPOutput(w, r)), logger, defaultUser)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func runExpectRequest(t *testing.T, body string) []ndjsonEvent {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec := httptest.NewRecorder()
+	handleExpect(rec, httptest.NewRequest("POST", "/exec/expect", strings.NewReader(body)), logger, "")
+
+	var events []ndjsonEvent
+	for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+		var evt ndjsonEvent
+		if err := json.Unmarshal([]byte(line), &evt); err != nil {
+			t.Fatalf("decode %q: %v", line, err)
+		}
+		if evt.Type == "expect" || evt.Type == "exit" {
+			events = append(events, evt)
+		}
+	}
+	return events
+}
+
+func TestHandleExpect_AnswersPrompts(t *testing.T) {
+	events := runExpectRequest(t, `{"script":"printf 'Name: '; read name; echo \"hi $name\"","expect":[
+		{"expect":"Name: ","literal":true},
+		{"send":"bob\r"},
+		{"expect":"hi (\\w+)"},
+		{"eof":true}
+	]}`)
+
+	want := []string{expectMatched, expectSent, expectMatched, expectEOF}
+	if len(events) != len(want)+1 || events[len(want)].Type != "exit" {
+		t.Fatalf("expected %d expect events and an exit, got %+v", len(want), events)
+	}
+	for i, status := range want {
+		if events[i].Expect.Index != i || events[i].Expect.Status != status {
+			t.Fatalf("step %d: expected %s, got %+v", i, status, events[i].Expect)
+		}
+	}
+	if groups := events[2].Expect.Groups; len(groups) != 1 || groups[0] != "bob" {
+		t.Fatalf("expected the captured name, got %v", groups)
+	}
+	if code := events[4].ExitCode; code == nil || *code != 0 {
+		t.Fatalf("expected a clean exit, got %+v", events[4])
+	}
+}
+
+func TestHandleExpect_FailedStepKillsCommand(t *testing.T) {
+	events := runExpectRequest(t, `{"cmd":"sleep","args":["30"],"expect":[{"timeoutMs":100},{"expect":"never"}]}`)
+
+	if len(events) != 2 || events[0].Expect.Index != 1 || events[0].Expect.Status != expectFailed {
+		t.Fatalf("expected step 1 to fail, got %+v", events)
+	}
+	if events[1].Type != "exit" || events[1].Signal != "SIGTERM" {
+		t.Fatalf("expected the command to be terminated, got %+v", events[1])
+	}
+}
+
+func TestPlanExpect_Validation(t *testing.T) {
+	text, bad := "x", "("
+	for _, steps := range [][]expectStep{
+		{{}},
+		{{Expect: &text, Send: &text}},
+		{{Expect: &text, TimeoutMs: -1}},
+		{{Expect: &text}, {Expect: &bad}},
+	} {
+		if _, err := planExpect(steps); err == nil {
+			t.Fatalf("expected %+v to be rejected", steps)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"os"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/cmdstore"
+	"github.com/angelorc/vmsan/agent/internal/procfs"
+)
+
+const minStatsInterval = 250 * time.Millisecond
+
+// execStats is the payload of a "stats" event, aggregated over the command's
+// process tree.
+type execStats struct {
+	CPUPercent  float64 `json:"cpuPercent"`
+	RSSBytes    int64   `json:"rssBytes"`
+	OpenFDs     int     `json:"openFds"`
+	Children    int     `json:"children"`
+	StdoutBytes int64   `json:"stdoutBytes"`
+	StderrBytes int64   `json:"stderrBytes"`
+}
+
+// treeSampler computes CPU usage between successive samples of the processes
+// belonging to a command (see procfs.Workload).
+type treeSampler struct {
+	pid       int
+	lastTicks uint64
+	lastAt    time.Time
+}
+
+// sample reads the current tree usage. CPU% is relative to one CPU, so a
+// tree saturating two cores reports 200.
+func (s *treeSampler) sample() execStats {
+	tree, _ := procfs.Workload(s.pid)
+	pageSize := int64(os.Getpagesize())
+
+	var stats execStats
+	var ticks uint64
+	for _, st := range tree {
+		if st.PID != s.pid {
+			stats.Children++
+		}
+		// Include the times of already-reaped children so CPU spent by
+		// short-lived subprocesses is not lost between samples.
+		ticks += st.UTime + st.STime + st.CUTime + st.CSTime
+		stats.RSSBytes += st.RSS * pageSize
+		if n, err := procfs.CountFDs(st.PID); err == nil {
+			stats.OpenFDs += n
+		}
+	}
+
+	now := time.Now()
+	if !s.lastAt.IsZero() && ticks >= s.lastTicks {
+		elapsed := now.Sub(s.lastAt).Seconds()
+		if elapsed > 0 {
+			cpu := float64(ticks-s.lastTicks) / procfs.ClockTicks / elapsed * 100
+			stats.CPUPercent = math.Round(cpu*10) / 10
+		}
+	}
+	s.lastTicks = ticks
+	s.lastAt = now
+	return stats
+}
+
+// streamStats emits a "stats" event every interval until the command
+// finishes. Besides reporting usage it keeps otherwise silent streams alive
+// through idle-timeout proxies.
+func streamStats(emit func(ndjsonEvent), entry *cmdstore.Entry, interval time.Duration) {
+	if interval < minStatsInterval {
+		interval = minStatsInterval
+	}
+	sampler := &treeSampler{pid: entry.Cmd.Process.Pid}
+	sampler.sample() // prime the CPU baseline
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-entry.Done():
+			return
+		case <-ticker.C:
+			stats := sampler.sample()
+			stats.StdoutBytes = entry.Output.Written("stdout")
+			stats.StderrBytes = entry.Output.Written("stderr")
+			emit(ndjsonEvent{
+				Type:      "stats",
+				Stats:     &stats,
+				Timestamp: now(),
+			})
+		}
+	}
+}
@@ -1,7 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/cmdstore"
 )
 
 func TestBuildCommand_WrapsBareCommandsWithEnv(t *testing.T) {
@@ -41,3 +55,282 @@ func TestBuildCommand_PreservesExplicitPath(t *testing.T) {
 		}
 	}
 }
+
+func TestStartCommand_TTY(t *testing.T) {
+	cmd := buildCommand("/bin/sh", []string{"-c", "stty size"})
+	cio, err := startCommand(cmd, runRequest{TTY: true, Cols: 120, Rows: 40})
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer cio.tty.Close()
+
+	if cio.stderr != nil {
+		t.Fatal("expected stderr to be merged into the tty")
+	}
+
+	out, _ := io.ReadAll(cio.stdout)
+	cmd.Wait()
+	if got := strings.TrimSpace(string(out)); got != "40 120" {
+		t.Fatalf("expected tty size %q, got %q", "40 120", got)
+	}
+}
+
+func TestCommandResult_SignalAndRusage(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "kill -TERM $$")
+	err := cmd.Run()
+
+	res := commandResult(cmd.ProcessState, err, false)
+	if res.Signal != "SIGTERM" {
+		t.Fatalf("expected SIGTERM, got %q", res.Signal)
+	}
+	if res.ExitCode == nil || *res.ExitCode != -1 {
+		t.Fatalf("expected exit code -1 for a signaled process, got %v", res.ExitCode)
+	}
+	if res.Rusage == nil || res.Rusage.MaxRSSKB <= 0 {
+		t.Fatalf("expected rusage with max RSS, got %+v", res.Rusage)
+	}
+}
+
+func TestCommandResult_ExitCode(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	err := cmd.Run()
+
+	res := commandResult(cmd.ProcessState, err, false)
+	if res.ExitCode == nil || *res.ExitCode != 3 {
+		t.Fatalf("expected exit code 3, got %v", res.ExitCode)
+	}
+	if res.Signal != "" {
+		t.Fatalf("expected no signal, got %q", res.Signal)
+	}
+}
+
+func TestExecSink_NumbersAndJournalsEvents(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sink := newExecSink(&httpOutput{w: rec})
+	sink.begin()
+	sink.send(ndjsonEvent{Type: "started"})
+	sink.detach()
+	sink.send(ndjsonEvent{Type: "exit"})
+
+	if got := rec.Body.String(); got != `{"type":"started","seq":1,"ts":""}`+"\n" {
+		t.Fatalf("expected only the pre-detach event on the wire, got %q", got)
+	}
+	events, _, _ := sink.events.After(1)
+	if len(events) != 1 || events[0].Seq != 2 || !strings.Contains(string(events[0].Data), `"seq":2`) {
+		t.Fatalf("expected the detached event to be journaled as seq 2, got %+v", events)
+	}
+}
+
+func TestExecSink_SSEAndEarlyFailure(t *testing.T) {
+	req := httptest.NewRequest("POST", "/exec", nil)
+	req.Header.Set("Accept", "text/event-stream")
+
+	rec := httptest.NewRecorder()
+	sink := newExecSink(newHTTPOutput(rec, req))
+	sink.fail(http.StatusTooManyRequests, "busy")
+	if rec.Code != http.StatusTooManyRequests || !strings.Contains(rec.Body.String(), `{"error":"busy"}`) {
+		t.Fatalf("expected a plain 429 before the stream began, got %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	sink = newExecSink(newHTTPOutput(rec, req))
+	sink.begin()
+	sink.fail(http.StatusServiceUnavailable, "timed out")
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("expected text/event-stream, got %q", ct)
+	}
+	if got := rec.Body.String(); !strings.HasPrefix(got, "id: 1\ndata: {\"type\":\"error\",\"seq\":1,") || !strings.HasSuffix(got, "}\n\n") {
+		t.Fatalf("expected an SSE error event, got %q", got)
+	}
+}
+
+func TestBuildShellCommand_PipefailArgsAndErrexit(t *testing.T) {
+	cmd := buildShellCommand("/bin/bash", "false | true", nil, false, false)
+	if err := cmd.Run(); err == nil {
+		t.Fatal("expected pipefail to surface the failing pipeline stage")
+	}
+
+	cmd = buildShellCommand("/bin/bash", `cd / && echo "$1-$#" | tr a-z A-Z`, []string{"arg", "two"}, false, false)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if string(out) != "ARG-2\n" {
+		t.Fatalf("expected args as positional parameters, got %q", out)
+	}
+
+	cmd = buildShellCommand("/bin/bash", "false; echo unreachable", nil, false, true)
+	out, err = cmd.Output()
+	if err == nil || len(out) != 0 {
+		t.Fatalf("expected errexit to stop at the first failure, got %q, %v", out, err)
+	}
+}
+
+func TestBuildShellCommand_FallsBackForNonPOSIXShells(t *testing.T) {
+	for _, shell := range []string{"", "/usr/bin/fish", "/usr/sbin/nologin", "bash"} {
+		cmd := buildShellCommand(shell, "true", nil, true, false)
+		if cmd.Path != fallbackShell {
+			t.Fatalf("%q: expected fallback %s, got %s", shell, fallbackShell, cmd.Path)
+		}
+		if cmd.Args[1] != "-l" || cmd.Args[2] != "-c" {
+			t.Fatalf("%q: expected -l -c, got %v", shell, cmd.Args)
+		}
+	}
+	if out, err := buildShellCommand("", "false | true; echo ok", nil, false, false).Output(); err != nil || string(out) != "ok\n" {
+		t.Fatalf("expected the pipefail probe to be harmless under %s, got %q, %v", fallbackShell, out, err)
+	}
+}
+
+// disconnectDuring starts the command in body through POST /exec, drops the
+// connection once the started event and a first line of output have
+// arrived, and waits for the handler to return. It returns the command's
+// store entry, the pid of a background child it printed and the server.
+func disconnectDuring(t *testing.T, body string) (*cmdstore.Entry, int, *httptest.Server) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	handled := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /exec", func(w http.ResponseWriter, r *http.Request) {
+		defer close(handled)
+		handleRun(w, r, logger, "")
+	})
+	mux.HandleFunc("GET /exec/{id}/logs", handleLogs)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", srv.URL+"/exec", strings.NewReader(body))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var id string
+	child := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for child == 0 && scanner.Scan() {
+		var evt ndjsonEvent
+		if err := json.Unmarshal(scanner.Bytes(), &evt); err != nil {
+			t.Fatalf("decode %q: %v", scanner.Text(), err)
+		}
+		switch evt.Type {
+		case "started":
+			id = evt.ID
+		case "stdout":
+			fmt.Sscanf(evt.Data, "child %d", &child)
+		}
+	}
+	if id == "" || child == 0 {
+		t.Fatalf("expected a started event and the child pid, got id %q, child %d", id, child)
+	}
+	cancel()
+
+	select {
+	case <-handled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the handler to return once the client went away")
+	}
+	return cmdstore.Get(id), child, srv
+}
+
+// processGone reports whether pid has exited, counting an unreaped zombie
+// as gone.
+func processGone(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(data[strings.LastIndexByte(string(data), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func waitDone(t *testing.T, entry *cmdstore.Entry) {
+	t.Helper()
+	select {
+	case <-entry.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected the command to finish")
+	}
+}
+
+const disconnectScript = `sleep 60 & echo child $!; i=0; while [ $i -lt 20 ]; do echo tick; i=$((i+1)); sleep 0.05; done; kill $!`
+
+func disconnectBody(policy string) string {
+	return fmt.Sprintf(`{"cmd":"/bin/sh","args":["-c",%q],"onDisconnect":%q}`, disconnectScript, policy)
+}
+
+func TestRun_DisconnectKillsProcessTree(t *testing.T) {
+	for _, policy := range []string{"", disconnectKill} {
+		entry, child, _ := disconnectDuring(t, disconnectBody(policy))
+		waitDone(t, entry)
+		if info := entry.Info(); info.State != cmdstore.StateKilled {
+			t.Fatalf("policy %q: expected state %q, got %q", policy, cmdstore.StateKilled, info.State)
+		}
+		deadline := time.Now().Add(5 * time.Second)
+		for !processGone(child) {
+			if time.Now().After(deadline) {
+				t.Fatalf("policy %q: expected background child %d to be killed with the tree", policy, child)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestRun_DisconnectDetaches(t *testing.T) {
+	entry, _, srv := disconnectDuring(t, disconnectBody(disconnectDetach))
+	if info := entry.Info(); !info.Detached || info.State != cmdstore.StateRunning {
+		t.Fatalf("expected a running detached command, got detached %v, state %q", info.Detached, info.State)
+	}
+	waitDone(t, entry)
+	if info := entry.Info(); info.State != cmdstore.StateExited {
+		t.Fatalf("expected the detached command to run to completion, got state %q", info.State)
+	}
+
+	// Output written after the client went away is retained for /logs.
+	resp, err := http.Get(srv.URL + "/exec/" + entry.ID + "/logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if n := strings.Count(string(logs), `tick\n`); n != 20 {
+		t.Fatalf("expected all 20 ticks in the logs, got %d: %s", n, logs)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		events, _, closed := entry.Events.After(0)
+		if closed {
+			if last := events[len(events)-1]; !strings.Contains(string(last.Data), `"type":"exit"`) {
+				t.Fatalf("expected the journal to end with the exit event, got %s", last.Data)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the events journal to be closed once the command finished")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRun_DisconnectContinues(t *testing.T) {
+	entry, _, _ := disconnectDuring(t, disconnectBody(disconnectContinue))
+	if info := entry.Info(); info.Detached || info.State != cmdstore.StateRunning {
+		t.Fatalf("expected a running command that is not detached, got detached %v, state %q", info.Detached, info.State)
+	}
+	waitDone(t, entry)
+	if info := entry.Info(); info.State != cmdstore.StateExited || info.Detached {
+		t.Fatalf("expected the command to run to completion undetached, got detached %v, state %q", info.Detached, info.State)
+	}
+}
+
+func TestRun_RejectsUnknownOnDisconnect(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec := httptest.NewRecorder()
+	handleRun(rec, httptest.NewRequest("POST", "/exec", strings.NewReader(`{"cmd":"true","onDisconnect":"ignore"}`)), logger, "")
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "onDisconnect must be") {
+		t.Fatalf("expected an unknown onDisconnect to be rejected, got %d %s", rec.Code, rec.Body.String())
+	}
+}
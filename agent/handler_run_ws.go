@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/cmdstore"
+	"github.com/angelorc/vmsan/agent/internal/eventlog"
+	"github.com/angelorc/vmsan/agent/internal/signals"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxExecWSReadSize = 1024 * 1024 // 1MB max incoming WebSocket message
+	execWSWriteWait   = 10 * time.Second
+)
+
+var execUpgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+// wsControl is a message sent by the client over an exec WebSocket.
+type wsControl struct {
+	Type string `json:"type"` // stdin, resize or signal
+
+	// stdin: Data is written to the command (base64-decoded first when
+	// Encoding is base64); EOF closes stdin afterwards.
+	Data     string `json:"data,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	EOF      bool   `json:"eof,omitempty"`
+
+	// resize
+	Cols uint16 `json:"cols,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+
+	// signal: Signal defaults to SIGKILL and Scope to group, and GraceMs
+	// escalates to SIGKILL, as for POST /exec/{id}/kill.
+	Signal  string `json:"signal,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+	GraceMs int    `json:"graceMs,omitempty"`
+}
+
+// wsOutput delivers exec events as WebSocket text messages. A write that
+// cannot complete within execWSWriteWait closes the connection, which the
+// read loop reports as a disconnect.
+type wsOutput struct {
+	mu   sync.Mutex
+	conn *websocket.Conn
+}
+
+func (o *wsOutput) begin() {}
+
+func (o *wsOutput) write(evt eventlog.Event) {
+	o.writeMessage(evt.Data)
+}
+
+func (o *wsOutput) reject(status int, msg string) {
+	o.writeEvent(ndjsonEvent{Type: "error", Error: msg, Timestamp: now()})
+}
+
+// writeEvent sends an unjournaled event, such as the reply to a control
+// message that could not be applied.
+func (o *wsOutput) writeEvent(evt ndjsonEvent) {
+	data, _ := json.Marshal(evt)
+	o.writeMessage(data)
+}
+
+func (o *wsOutput) writeMessage(data []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.conn.SetWriteDeadline(time.Now().Add(execWSWriteWait))
+	if err := o.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		o.conn.Close()
+	}
+}
+
+// close ends the stream with a normal closure.
+func (o *wsOutput) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.conn.SetWriteDeadline(time.Now().Add(execWSWriteWait))
+	o.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	o.conn.Close()
+}
+
+// readControls applies control messages to the command returned by entry
+// until the connection fails, then calls cancel. entry returns nil while the
+// command has not started yet.
+func readControls(out *wsOutput, entry func() *cmdstore.Entry, cancel context.CancelFunc) {
+	defer cancel()
+	out.conn.SetReadLimit(maxExecWSReadSize)
+	for {
+		_, data, err := out.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var msg wsControl
+		if err := json.Unmarshal(data, &msg); err != nil {
+			out.writeEvent(ndjsonEvent{Type: "error", Error: "invalid control message", Timestamp: now()})
+			continue
+		}
+		e := entry()
+		if e == nil {
+			out.writeEvent(ndjsonEvent{Type: "error", Error: "command has not started", Timestamp: now()})
+			continue
+		}
+		if err := applyControl(e, msg); err != nil {
+			out.writeEvent(ndjsonEvent{Type: "error", Error: fmt.Sprintf("%s: %s", msg.Type, err), Timestamp: now()})
+		}
+	}
+}
+
+// applyControl performs a stdin, resize or signal control message with the
+// same semantics as the corresponding REST endpoints.
+func applyControl(entry *cmdstore.Entry, msg wsControl) error {
+	if _, done := entry.Result(); done {
+		return errors.New("command has exited")
+	}
+	switch msg.Type {
+	case "stdin":
+		data := []byte(msg.Data)
+		if msg.Encoding == encodingBase64 {
+			decoded, err := base64.StdEncoding.DecodeString(msg.Data)
+			if err != nil {
+				return errors.New("invalid base64 data")
+			}
+			data = decoded
+		}
+		if len(data) > 0 {
+			if _, err := entry.CopyStdin(bytes.NewReader(data)); err != nil {
+				return err
+			}
+		}
+		if msg.EOF {
+			return entry.CloseStdin()
+		}
+		return nil
+	case "resize":
+		if msg.Cols == 0 || msg.Rows == 0 {
+			return errors.New("cols and rows are required")
+		}
+		return entry.Resize(msg.Cols, msg.Rows)
+	case "signal":
+		sig := syscall.SIGKILL
+		if msg.Signal != "" {
+			parsed, err := signals.Parse(msg.Signal)
+			if err != nil {
+				return err
+			}
+			sig = parsed
+		}
+		scope := msg.Scope
+		if scope == "" {
+			scope = cmdstore.ScopeGroup
+		}
+		entry.MarkKilled()
+		return entry.Terminate(sig, scope, time.Duration(msg.GraceMs)*time.Millisecond)
+	default:
+		return errors.New("type must be stdin, resize or signal")
+	}
+}
+
+func makeExecWSHandler(logger *slog.Logger, defaultUser string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleExecWS(w, r, logger, defaultUser)
+	}
+}
+
+// handleExecWS runs a command over a WebSocket. The first client message is
+// the same JSON body POST /exec takes; the server then sends the command's
+// events as text messages, and the client may send stdin, resize and signal
+// control messages. Closing the socket counts as a client disconnect.
+func handleExecWS(w http.ResponseWriter, r *http.Request, logger *slog.Logger, defaultUser string) {
+	conn, err := execUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Error("websocket upgrade", "error", err)
+		return
+	}
+	// Closing the connection on every path also ends readControls.
+	defer conn.Close()
+	out := &wsOutput{conn: conn}
+
+	var req runRequest
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &req); err != nil {
+		out.reject(http.StatusBadRequest, "invalid request body")
+		out.close()
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var started atomic.Pointer[cmdstore.Entry]
+	sink := newExecSink(out)
+	sink.onStart = func(e *cmdstore.Entry) { started.Store(e) }
+	go readControls(out, started.Load, cancel)
+
+	runExec(ctx, req, sink, logger, defaultUser)
+	if ctx.Err() == nil {
+		out.close()
+	}
+}
+
+// handleExecWSAttach attaches to a running or recently finished command over
+// a WebSocket, replaying its events after ?after= and following new ones.
+// Control messages work as on the socket that started the command.
+func handleExecWSAttach(w http.ResponseWriter, r *http.Request) {
+	entry := cmdstore.Get(r.PathValue("id"))
+	if entry == nil {
+		http.Error(w, `{"error":"command not found"}`, http.StatusNotFound)
+		return
+	}
+	var after int64
+	if v := r.URL.Query().Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, `{"error":"invalid after"}`, http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+
+	conn, err := execUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	out := &wsOutput{conn: conn}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go readControls(out, func() *cmdstore.Entry { return entry }, cancel)
+
+	followEvents(ctx, entry, after, true, out.write)
+	if ctx.Err() == nil {
+		out.close()
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/cmdstore"
+)
+
+func TestApplyControl_StdinAndValidation(t *testing.T) {
+	cmd := exec.Command("cat")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	cmd.Stdout = &out
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	entry := cmdstore.Store(cmd, stdin, nil, nil, cmdstore.Meta{Cmd: "cat"})
+	defer cmdstore.Remove(entry.ID)
+
+	if err := applyControl(entry, wsControl{Type: "stdin", Data: "aGk=", Encoding: "base64", EOF: true}); err != nil {
+		t.Fatalf("stdin: %v", err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if out.String() != "hi" {
+		t.Fatalf("expected decoded stdin to reach the command, got %q", out.String())
+	}
+
+	if err := applyControl(entry, wsControl{Type: "resize"}); err == nil {
+		t.Fatal("expected resize without cols and rows to fail")
+	}
+	if err := applyControl(entry, wsControl{Type: "bogus"}); err == nil {
+		t.Fatal("expected unknown control type to fail")
+	}
+
+	entry.Finish(cmdstore.Result{})
+	if err := applyControl(entry, wsControl{Type: "stdin", Data: "x"}); err == nil || err.Error() != "command has exited" {
+		t.Fatalf("expected command has exited, got %v", err)
+	}
+}
+
+func TestApplyControl_SignalEscalatesAfterGrace(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "trap '' TERM; echo ready; sleep 30")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	entry := cmdstore.Store(cmd, nil, nil, nil, cmdstore.Meta{Cmd: "sh"})
+	defer cmdstore.Remove(entry.ID)
+	// Wait for the trap to be installed.
+	if _, err := stdout.Read(make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if err := applyControl(entry, wsControl{Type: "signal", Signal: "SIGTERM", Scope: cmdstore.ScopeProcess, GraceMs: 100}); err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+	err = cmd.Wait()
+	if ee, ok := err.(*exec.ExitError); !ok || ee.Sys().(syscall.WaitStatus).Signal() != syscall.SIGKILL {
+		t.Fatalf("expected the shell to be killed after the grace period, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("escalation took %s", elapsed)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/probe"
+)
+
+const (
+	defaultWaitTimeout  = 30 * time.Second
+	maxWaitTimeout      = 10 * time.Minute
+	defaultWaitInterval = 250 * time.Millisecond
+	minWaitInterval     = 50 * time.Millisecond
+
+	// waitAttemptTimeout bounds a single tcp or http check.
+	waitAttemptTimeout = 5 * time.Second
+)
+
+// waitRequest describes the condition POST /wait blocks on.
+type waitRequest struct {
+	Type string `json:"type"` // tcp, http, file or process
+
+	// tcp: Host defaults to 127.0.0.1.
+	Host string `json:"host,omitempty"`
+	Port int    `json:"port,omitempty"`
+
+	// http: Status defaults to any 2xx; Insecure skips TLS verification.
+	URL      string `json:"url,omitempty"`
+	Status   int    `json:"status,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"`
+
+	// file: Path must exist and, if set, its content match Pattern.
+	// process: a process named Name whose command line matches Pattern.
+	Path    string `json:"path,omitempty"`
+	Name    string `json:"name,omitempty"`
+	Pattern string `json:"pattern,omitempty"`
+
+	TimeoutMs  int `json:"timeoutMs,omitempty"`
+	IntervalMs int `json:"intervalMs,omitempty"`
+}
+
+type waitResponse struct {
+	OK         bool   `json:"ok"`
+	Type       string `json:"type"`
+	Attempts   int    `json:"attempts"`
+	DurationMs int64  `json:"durationMs"`
+	PIDs       []int  `json:"pids,omitempty"`  // process: the matching processes
+	Error      string `json:"error,omitempty"` // why the last check failed
+}
+
+// waitCheck checks a condition once, returning the matching PIDs for process
+// conditions.
+type waitCheck func(ctx context.Context) ([]int, error)
+
+// planWait validates req and returns its check. Its errors are client errors.
+func planWait(req waitRequest) (waitCheck, error) {
+	var pattern *regexp.Regexp
+	if req.Pattern != "" {
+		if req.Type != "file" && req.Type != "process" {
+			return nil, errors.New("pattern applies to file and process conditions only")
+		}
+		re, err := regexp.Compile(req.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern: %w", err)
+		}
+		pattern = re
+	}
+
+	switch req.Type {
+	case "tcp":
+		if req.Port < 1 || req.Port > 65535 {
+			return nil, errors.New("port must be between 1 and 65535")
+		}
+		host := req.Host
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(req.Port))
+		return func(ctx context.Context) ([]int, error) {
+			return nil, probe.TCP(ctx, addr)
+		}, nil
+	case "http":
+		if req.URL == "" {
+			return nil, errors.New("url is required")
+		}
+		if _, err := http.NewRequest(http.MethodGet, req.URL, nil); err != nil {
+			return nil, fmt.Errorf("url: %w", err)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.DisableKeepAlives = true
+		if req.Insecure {
+			transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		}
+		client := &http.Client{Transport: transport}
+		return func(ctx context.Context) ([]int, error) {
+			return nil, probe.HTTP(ctx, client, req.URL, req.Status)
+		}, nil
+	case "file":
+		if req.Path == "" {
+			return nil, errors.New("path is required")
+		}
+		return func(ctx context.Context) ([]int, error) {
+			return nil, probe.File(ctx, req.Path, pattern)
+		}, nil
+	case "process":
+		if req.Name == "" && pattern == nil {
+			return nil, errors.New("name or pattern is required")
+		}
+		return func(context.Context) ([]int, error) {
+			return probe.Process(req.Name, pattern)
+		}, nil
+	default:
+		return nil, errors.New("type must be tcp, http, file or process")
+	}
+}
+
+func makeWaitHandler(logger *slog.Logger) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		handleWait(w, r, logger)
+	}
+}
+
+// handleWait polls a condition every intervalMs until it holds or timeoutMs
+// elapses. It answers 200 once the condition holds and 504 if it did not in
+// time, with the reason of the last failed check.
+func handleWait(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	var req waitRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"error":"invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	check, err := planWait(req)
+	if err != nil {
+		body, _ := json.Marshal(map[string]string{"error": err.Error()})
+		http.Error(w, string(body), http.StatusBadRequest)
+		return
+	}
+
+	timeout := defaultWaitTimeout
+	if req.TimeoutMs > 0 {
+		timeout = min(time.Duration(req.TimeoutMs)*time.Millisecond, maxWaitTimeout)
+	}
+	interval := defaultWaitInterval
+	if req.IntervalMs > 0 {
+		interval = max(time.Duration(req.IntervalMs)*time.Millisecond, minWaitInterval)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	start := time.Now()
+	resp := waitResponse{Type: req.Type}
+	for {
+		resp.Attempts++
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, waitAttemptTimeout)
+		pids, err := check(attemptCtx)
+		cancelAttempt()
+		if err == nil {
+			resp.OK = true
+			resp.PIDs = pids
+			resp.Error = ""
+			break
+		}
+		resp.Error = err.Error()
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+			continue
+		case <-ctx.Done():
+			timer.Stop()
+		}
+		break
+	}
+	resp.DurationMs = time.Since(start).Milliseconds()
+
+	if r.Context().Err() != nil {
+		return
+	}
+	logger.Info("wait",
+		"type", req.Type,
+		"ok", resp.OK,
+		"attempts", resp.Attempts,
+		"duration_ms", resp.DurationMs,
+	)
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.OK {
+		w.WriteHeader(http.StatusGatewayTimeout)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
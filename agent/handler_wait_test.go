@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func runWait(t *testing.T, body string) (int, waitResponse) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	rec := httptest.NewRecorder()
+	handleWait(rec, httptest.NewRequest("POST", "/wait", strings.NewReader(body)), logger)
+	var resp waitResponse
+	json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp
+}
+
+func TestHandleWait_TCPAndTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	code, resp := runWait(t, fmt.Sprintf(`{"type":"tcp","port":%d}`, port))
+	if code != 200 || !resp.OK || resp.Attempts != 1 {
+		t.Fatalf("expected the open port to be ready, got %d %+v", code, resp)
+	}
+
+	ln.Close()
+	code, resp = runWait(t, fmt.Sprintf(`{"type":"tcp","port":%d,"timeoutMs":200,"intervalMs":50}`, port))
+	if code != 504 || resp.OK || resp.Attempts < 2 || resp.Error == "" {
+		t.Fatalf("expected a timeout with the last error, got %d %+v", code, resp)
+	}
+}
+
+func TestHandleWait_FilePattern(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.log")
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(path, []byte("starting\n"), 0o644)
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(path, []byte("starting\nlistening on :3000\n"), 0o644)
+	}()
+
+	code, resp := runWait(t, fmt.Sprintf(`{"type":"file","path":%q,"pattern":"listening on :\\d+","intervalMs":50}`, path))
+	if code != 200 || !resp.OK || resp.Attempts < 3 {
+		t.Fatalf("expected the pattern to show up after a few attempts, got %d %+v", code, resp)
+	}
+}
+
+func TestHandleWait_Validation(t *testing.T) {
+	for _, body := range []string{
+		`{"type":"udp"}`,
+		`{"type":"tcp","port":0}`,
+		`{"type":"http"}`,
+		`{"type":"tcp","port":80,"pattern":"x"}`,
+		`{"type":"process"}`,
+		`{"type":"file","path":"/x","pattern":"("}`,
+	} {
+		if code, _ := runWait(t, body); code != 400 {
+			t.Fatalf("expected 400 for %s, got %d", body, code)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+// Package admission bounds the number of concurrently running workloads and
+// queues excess requests in FIFO order per priority class.
+package admission
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Priority classes, highest first. A queued request is admitted before any
+// request of a lower class, and in arrival order within its class.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+var priorities = map[string]int{
+	PriorityHigh:   0,
+	PriorityNormal: 1,
+	PriorityLow:    2,
+}
+
+var (
+	// ErrBusy is returned when no slot is free and the caller did not ask
+	// to wait.
+	ErrBusy = errors.New("too many concurrent commands")
+	// ErrQueueFull is returned when the wait queue is at capacity.
+	ErrQueueFull = errors.New("admission queue is full")
+	// ErrQueueTimeout is returned when no slot freed up within the wait.
+	ErrQueueTimeout = errors.New("timed out waiting in admission queue")
+	// ErrInvalidPriority is returned for an unknown priority class.
+	ErrInvalidPriority = errors.New("priority must be high, normal or low")
+)
+
+type waiter struct {
+	ready    chan struct{} // closed when a slot is handed over
+	admitted bool
+}
+
+// Controller hands out a fixed number of slots.
+type Controller struct {
+	mu       sync.Mutex
+	limit    int
+	maxQueue int
+	active   int
+	queues   [3][]*waiter
+}
+
+// New creates a Controller allowing limit concurrent slots and at most
+// maxQueue waiting requests.
+func New(limit, maxQueue int) *Controller {
+	return &Controller{limit: limit, maxQueue: maxQueue}
+}
+
+// ValidPriority reports whether p is a known priority class. The empty
+// string is accepted as PriorityNormal.
+func ValidPriority(p string) bool {
+	if p == "" {
+		return true
+	}
+	_, ok := priorities[p]
+	return ok
+}
+
+// Acquire takes a slot. If none is free and wait is zero it fails with
+// ErrBusy; otherwise it queues for up to wait, calling onQueued with the
+// request's 1-based queue position once it has been queued. Every
+// successful Acquire must be paired with Release.
+func (c *Controller) Acquire(ctx context.Context, priority string, wait time.Duration, onQueued func(position int)) error {
+	if priority == "" {
+		priority = PriorityNormal
+	}
+	class, ok := priorities[priority]
+	if !ok {
+		return ErrInvalidPriority
+	}
+
+	c.mu.Lock()
+	if c.active < c.limit && c.queuedLocked() == 0 {
+		c.active++
+		c.mu.Unlock()
+		return nil
+	}
+	if wait <= 0 {
+		c.mu.Unlock()
+		return ErrBusy
+	}
+	if c.queuedLocked() >= c.maxQueue {
+		c.mu.Unlock()
+		return ErrQueueFull
+	}
+	w := &waiter{ready: make(chan struct{})}
+	c.queues[class] = append(c.queues[class], w)
+	position := c.positionLocked(class, w)
+	c.mu.Unlock()
+
+	if onQueued != nil {
+		onQueued(position)
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	c.mu.Lock()
+	if w.admitted {
+		// The slot was handed over while we were giving up; pass it on.
+		c.mu.Unlock()
+		c.Release()
+		return err
+	}
+	c.removeLocked(class, w)
+	c.mu.Unlock()
+	return err
+}
+
+// Release returns a slot, handing it directly to the next queued request if
+// there is one.
+func (c *Controller) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for class := range c.queues {
+		if len(c.queues[class]) == 0 {
+			continue
+		}
+		next := c.queues[class][0]
+		c.queues[class] = c.queues[class][1:]
+		next.admitted = true
+		close(next.ready)
+		return
+	}
+	if c.active > 0 {
+		c.active--
+	}
+}
+
+// Stats returns the number of held slots and queued requests.
+func (c *Controller) Stats() (active, queued int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.active, c.queuedLocked()
+}
+
+func (c *Controller) queuedLocked() int {
+	n := 0
+	for _, q := range c.queues {
+		n += len(q)
+	}
+	return n
+}
+
+// positionLocked returns w's 1-based position: everyone queued in a higher
+// class plus those ahead of it in its own class.
+func (c *Controller) positionLocked(class int, w *waiter) int {
+	pos := 0
+	for i := 0; i < class; i++ {
+		pos += len(c.queues[i])
+	}
+	for _, other := range c.queues[class] {
+		pos++
+		if other == w {
+			break
+		}
+	}
+	return pos
+}
+
+func (c *Controller) removeLocked(class int, w *waiter) {
+	q := c.queues[class]
+	for i, other := range q {
+		if other == w {
+			c.queues[class] = append(q[:i:i], q[i+1:]...)
+			return
+		}
+	}
+}
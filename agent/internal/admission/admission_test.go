@@ -0,0 +1,130 @@
+package admission
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquire_BusyWithoutWait(t *testing.T) {
+	c := New(1, 4)
+	if err := c.Acquire(context.Background(), "", 0, nil); err != nil {
+		t.Fatalf("first acquire: %v", err)
+	}
+	if err := c.Acquire(context.Background(), "", 0, nil); !errors.Is(err, ErrBusy) {
+		t.Fatalf("expected ErrBusy, got %v", err)
+	}
+	c.Release()
+	if err := c.Acquire(context.Background(), "", 0, nil); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+}
+
+func TestAcquire_QueueTimeout(t *testing.T) {
+	c := New(1, 4)
+	c.Acquire(context.Background(), "", 0, nil)
+
+	var position int
+	err := c.Acquire(context.Background(), "", 20*time.Millisecond, func(p int) { position = p })
+	if !errors.Is(err, ErrQueueTimeout) {
+		t.Fatalf("expected ErrQueueTimeout, got %v", err)
+	}
+	if position != 1 {
+		t.Fatalf("expected queue position 1, got %d", position)
+	}
+	if active, queued := c.Stats(); active != 1 || queued != 0 {
+		t.Fatalf("expected 1 active and empty queue, got %d/%d", active, queued)
+	}
+}
+
+func TestAcquire_QueueFull(t *testing.T) {
+	c := New(1, 1)
+	c.Acquire(context.Background(), "", 0, nil)
+
+	queued := make(chan struct{})
+	go c.Acquire(context.Background(), "", time.Second, func(int) { close(queued) })
+	<-queued
+
+	if err := c.Acquire(context.Background(), "", time.Second, nil); !errors.Is(err, ErrQueueFull) {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+}
+
+func TestRelease_AdmitsByPriorityThenFIFO(t *testing.T) {
+	c := New(1, 8)
+	c.Acquire(context.Background(), "", 0, nil)
+
+	order := make(chan string, 3)
+	enqueue := func(name, priority string) {
+		queued := make(chan struct{})
+		go func() {
+			if err := c.Acquire(context.Background(), priority, time.Second, func(int) { close(queued) }); err != nil {
+				t.Errorf("%s: %v", name, err)
+				return
+			}
+			order <- name
+		}()
+		<-queued
+	}
+	enqueue("low", PriorityLow)
+	enqueue("normal-1", PriorityNormal)
+	enqueue("normal-2", PriorityNormal)
+
+	var got []string
+	for i := 0; i < 3; i++ {
+		c.Release()
+		got = append(got, <-order)
+	}
+	want := []string{"normal-1", "normal-2", "low"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected admission order %v, got %v", want, got)
+		}
+	}
+}
+
+func TestAcquire_PositionAccountsForHigherClasses(t *testing.T) {
+	c := New(1, 8)
+	c.Acquire(context.Background(), "", 0, nil)
+
+	queued := make(chan int, 1)
+	go c.Acquire(context.Background(), PriorityHigh, time.Second, func(p int) { queued <- p })
+	if p := <-queued; p != 1 {
+		t.Fatalf("expected high priority at position 1, got %d", p)
+	}
+	go c.Acquire(context.Background(), PriorityLow, time.Second, func(p int) { queued <- p })
+	if p := <-queued; p != 2 {
+		t.Fatalf("expected low priority at position 2, got %d", p)
+	}
+	go c.Acquire(context.Background(), PriorityHigh, time.Second, func(p int) { queued <- p })
+	if p := <-queued; p != 2 {
+		t.Fatalf("expected second high priority at position 2, got %d", p)
+	}
+}
+
+func TestAcquire_ContextCancel(t *testing.T) {
+	c := New(1, 4)
+	c.Acquire(context.Background(), "", 0, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- c.Acquire(ctx, "", time.Second, nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, queued := c.Stats(); queued != 0 {
+		t.Fatalf("expected cancelled waiter to leave the queue, got %d queued", queued)
+	}
+}
+
+func TestAcquire_InvalidPriority(t *testing.T) {
+	c := New(1, 1)
+	if err := c.Acquire(context.Background(), "urgent", 0, nil); !errors.Is(err, ErrInvalidPriority) {
+		t.Fatalf("expected ErrInvalidPriority, got %v", err)
+	}
+}
@@ -0,0 +1,315 @@
+// Package cgroup places agent workloads in cgroup v2 leaves under a
+// dedicated vmsan slice and applies per-workload resource limits.
+package cgroup
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Root is the cgroup v2 mount point. Tests may point it at a temp dir.
+var Root = "/sys/fs/cgroup"
+
+// SliceName is the parent group every leaf is created under.
+const SliceName = "vmsan.slice"
+
+// cpuPeriod is the cpu.max period used for CPU quotas, in microseconds.
+const cpuPeriod = 100000
+
+// ErrUnavailable is returned when cgroup v2 is not mounted at Root or the
+// agent lacks the privileges to manage it.
+var ErrUnavailable = errors.New("cgroup v2 is not available")
+
+// Limits are the resource limits applied to a leaf. Zero values mean
+// "unlimited" / kernel default.
+type Limits struct {
+	MemoryMax  int64   `json:"memoryMax,omitempty"`  // bytes
+	CPUQuota   float64 `json:"cpuQuota,omitempty"`   // CPUs, e.g. 0.5 or 2
+	CPUWeight  int     `json:"cpuWeight,omitempty"`  // 1-10000
+	PidsMax    int64   `json:"pidsMax,omitempty"`    // max tasks
+	IOWeight   int     `json:"ioWeight,omitempty"`   // 1-10000
+	WallTimeMs int     `json:"wallTimeMs,omitempty"` // enforced by the caller
+	CPUTimeMs  int     `json:"cpuTimeMs,omitempty"`  // enforced by the caller via CPUUsage
+}
+
+// Validate checks that every limit is within the range the kernel accepts.
+func (l Limits) Validate() error {
+	switch {
+	case l.MemoryMax < 0:
+		return errors.New("memoryMax must be positive")
+	case l.CPUQuota < 0:
+		return errors.New("cpuQuota must be positive")
+	case l.CPUWeight != 0 && (l.CPUWeight < 1 || l.CPUWeight > 10000):
+		return errors.New("cpuWeight must be between 1 and 10000")
+	case l.PidsMax < 0:
+		return errors.New("pidsMax must be positive")
+	case l.IOWeight != 0 && (l.IOWeight < 1 || l.IOWeight > 10000):
+		return errors.New("ioWeight must be between 1 and 10000")
+	case l.WallTimeMs < 0 || l.CPUTimeMs < 0:
+		return errors.New("time limits must be positive")
+	}
+	return nil
+}
+
+// NeedsCgroup reports whether any limit other than wall time is set, i.e.
+// whether l can only be enforced with cgroup v2.
+func (l Limits) NeedsCgroup() bool {
+	return len(l.controllers()) > 0
+}
+
+// controllers returns the cgroup controllers needed to enforce l.
+func (l Limits) controllers() []string {
+	var out []string
+	if l.MemoryMax > 0 {
+		out = append(out, "memory")
+	}
+	if l.CPUQuota > 0 || l.CPUWeight > 0 || l.CPUTimeMs > 0 {
+		out = append(out, "cpu")
+	}
+	if l.PidsMax > 0 {
+		out = append(out, "pids")
+	}
+	if l.IOWeight > 0 {
+		out = append(out, "io")
+	}
+	return out
+}
+
+// Available reports whether cgroup v2 can be managed at Root.
+func Available() bool {
+	if os.Geteuid() != 0 {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(Root, "cgroup.controllers"))
+	return err == nil
+}
+
+// Group is a leaf cgroup owned by one workload.
+type Group struct {
+	Path string
+}
+
+// New creates a leaf named "<prefix>-<random>" under the vmsan slice and
+// applies limits. It fails if a controller required by limits cannot be
+// enabled.
+func New(prefix string, limits Limits) (*Group, error) {
+	if !Available() {
+		return nil, ErrUnavailable
+	}
+	slice := filepath.Join(Root, SliceName)
+	if err := os.MkdirAll(slice, 0o755); err != nil {
+		return nil, fmt.Errorf("create slice: %w", err)
+	}
+	reclaim()
+
+	available, err := readControllers(filepath.Join(Root, "cgroup.controllers"))
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range limits.controllers() {
+		if !available[c] {
+			return nil, fmt.Errorf("cgroup controller %q is not available", c)
+		}
+	}
+
+	// Delegate every available controller we use to the slice's children.
+	// Root and slice both need it in cgroup.subtree_control; errors are
+	// checked below by looking at what the slice actually exposes.
+	for _, c := range []string{"memory", "cpu", "pids", "io"} {
+		if !available[c] {
+			continue
+		}
+		writeFile(filepath.Join(Root, "cgroup.subtree_control"), "+"+c)
+		writeFile(filepath.Join(slice, "cgroup.subtree_control"), "+"+c)
+	}
+	enabled, err := readControllers(filepath.Join(slice, "cgroup.subtree_control"))
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range limits.controllers() {
+		if !enabled[c] {
+			return nil, fmt.Errorf("enable cgroup controller %q failed", c)
+		}
+	}
+
+	g := &Group{Path: filepath.Join(slice, prefix+"-"+randomSuffix())}
+	if err := os.Mkdir(g.Path, 0o755); err != nil {
+		return nil, fmt.Errorf("create cgroup: %w", err)
+	}
+	if err := g.apply(limits); err != nil {
+		os.Remove(g.Path)
+		return nil, err
+	}
+	return g, nil
+}
+
+func (g *Group) apply(l Limits) error {
+	if l.MemoryMax > 0 {
+		if err := writeFile(filepath.Join(g.Path, "memory.max"), strconv.FormatInt(l.MemoryMax, 10)); err != nil {
+			return fmt.Errorf("set memory.max: %w", err)
+		}
+		// Without this the limit only covers RAM and the workload can keep
+		// growing into swap. Not every kernel has swap accounting.
+		if err := writeFile(filepath.Join(g.Path, "memory.swap.max"), "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("set memory.swap.max: %w", err)
+		}
+	}
+	if l.CPUQuota > 0 {
+		quota := int64(l.CPUQuota * cpuPeriod)
+		if quota < 1000 {
+			quota = 1000 // kernel minimum is 1ms per period
+		}
+		if err := writeFile(filepath.Join(g.Path, "cpu.max"), fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return fmt.Errorf("set cpu.max: %w", err)
+		}
+	}
+	if l.CPUWeight > 0 {
+		if err := writeFile(filepath.Join(g.Path, "cpu.weight"), strconv.Itoa(l.CPUWeight)); err != nil {
+			return fmt.Errorf("set cpu.weight: %w", err)
+		}
+	}
+	if l.PidsMax > 0 {
+		if err := writeFile(filepath.Join(g.Path, "pids.max"), strconv.FormatInt(l.PidsMax, 10)); err != nil {
+			return fmt.Errorf("set pids.max: %w", err)
+		}
+	}
+	if l.IOWeight > 0 {
+		if err := writeFile(filepath.Join(g.Path, "io.weight"), "default "+strconv.Itoa(l.IOWeight)); err != nil {
+			return fmt.Errorf("set io.weight: %w", err)
+		}
+	}
+	return nil
+}
+
+// Open returns the cgroup directory for use as SysProcAttr.CgroupFD. The
+// caller closes it once the process has started.
+func (g *Group) Open() (*os.File, error) {
+	return os.Open(g.Path)
+}
+
+// OOMKilled reports whether the kernel OOM killer has killed a process in
+// the group because of memory.max.
+func (g *Group) OOMKilled() bool {
+	events, err := readKeyed(filepath.Join(g.Path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	return events["oom_kill"] > 0
+}
+
+// CPUUsage returns the total CPU time consumed by the group.
+func (g *Group) CPUUsage() (time.Duration, error) {
+	stat, err := readKeyed(filepath.Join(g.Path, "cpu.stat"))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(stat["usage_usec"]) * time.Microsecond, nil
+}
+
+// Remove deletes the leaf. It fails with EBUSY while processes remain, in
+// which case the leaf is retried by later calls to New once it empties.
+func (g *Group) Remove() error {
+	err := os.Remove(g.Path)
+	if errors.Is(err, syscall.EBUSY) {
+		pendingMu.Lock()
+		pending[g] = true
+		pendingMu.Unlock()
+	}
+	return err
+}
+
+var (
+	pendingMu sync.Mutex
+	pending   = make(map[*Group]bool) // finished leaves still busy on Remove
+)
+
+// reclaim retries removing the finished leaves that were still busy. Only
+// leaves this process created and finished are touched: an empty sibling may
+// be a leaf another workload has just created and not yet populated.
+func reclaim() {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	for g := range pending {
+		if err := os.Remove(g.Path); err == nil || errors.Is(err, os.ErrNotExist) {
+			delete(pending, g)
+		}
+	}
+}
+
+// Sweep removes the empty leaves a previous agent run left behind. It must
+// run once at startup, before any New; populated leaves refuse rmdir.
+func Sweep() {
+	if !Available() {
+		return
+	}
+	entries, err := os.ReadDir(filepath.Join(Root, SliceName))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			os.Remove(filepath.Join(Root, SliceName, e.Name()))
+		}
+	}
+}
+
+func readControllers(path string) (map[string]bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]bool)
+	for _, c := range strings.Fields(string(data)) {
+		out[c] = true
+	}
+	return out, nil
+}
+
+// readKeyed parses flat-keyed cgroup files such as memory.events and
+// cpu.stat ("key value" per line).
+func readKeyed(path string) (map[string]int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	out := make(map[string]int64)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if v, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			out[fields[0]] = v
+		}
+	}
+	return out, scanner.Err()
+}
+
+func writeFile(path, value string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(value)
+	return err
+}
+
+func randomSuffix() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,185 @@
+package cgroup
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func touch(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range names {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func readString(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGroupApply_WritesLimitFiles(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "memory.max", "memory.swap.max", "cpu.max", "cpu.weight", "pids.max", "io.weight")
+
+	g := &Group{Path: dir}
+	err := g.apply(Limits{
+		MemoryMax: 512 << 20,
+		CPUQuota:  1.5,
+		CPUWeight: 50,
+		PidsMax:   64,
+		IOWeight:  200,
+	})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	want := map[string]string{
+		"memory.max":      "536870912",
+		"memory.swap.max": "0",
+		"cpu.max":         "150000 100000",
+		"cpu.weight":      "50",
+		"pids.max":        "64",
+		"io.weight":       "default 200",
+	}
+	for name, value := range want {
+		if got := readString(t, filepath.Join(dir, name)); got != value {
+			t.Fatalf("%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestGroupApply_MissingSwapAccountingIsIgnored(t *testing.T) {
+	dir := t.TempDir()
+	touch(t, dir, "memory.max")
+
+	g := &Group{Path: dir}
+	if err := g.apply(Limits{MemoryMax: 1 << 20}); err != nil {
+		t.Fatalf("expected missing memory.swap.max to be ignored, got %v", err)
+	}
+}
+
+func TestGroup_OOMKilledAndCPUUsage(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "memory.events"), []byte("low 0\nhigh 0\nmax 3\noom 1\noom_kill 1\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "cpu.stat"), []byte("usage_usec 2500000\nuser_usec 2000000\nsystem_usec 500000\n"), 0o644)
+
+	g := &Group{Path: dir}
+	if !g.OOMKilled() {
+		t.Fatal("expected OOMKilled with oom_kill 1")
+	}
+	used, err := g.CPUUsage()
+	if err != nil {
+		t.Fatalf("cpu usage: %v", err)
+	}
+	if used != 2500*time.Millisecond {
+		t.Fatalf("expected 2.5s, got %v", used)
+	}
+
+	os.WriteFile(filepath.Join(dir, "memory.events"), []byte("oom 0\noom_kill 0\n"), 0o644)
+	if g.OOMKilled() {
+		t.Fatal("expected no OOM kill")
+	}
+}
+
+func TestLimits_Validate(t *testing.T) {
+	valid := Limits{MemoryMax: 1, CPUQuota: 0.5, CPUWeight: 100, PidsMax: 10, IOWeight: 100, WallTimeMs: 10, CPUTimeMs: 10}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("expected valid limits, got %v", err)
+	}
+	for _, l := range []Limits{
+		{MemoryMax: -1},
+		{CPUWeight: 20000},
+		{IOWeight: -5},
+		{CPUTimeMs: -1},
+	} {
+		if err := l.Validate(); err == nil {
+			t.Fatalf("expected error for %+v", l)
+		}
+	}
+}
+
+func TestLimits_NeedsCgroup(t *testing.T) {
+	if (Limits{WallTimeMs: 1000}).NeedsCgroup() {
+		t.Fatal("wall time alone should not need cgroups")
+	}
+	if !(Limits{PidsMax: 10}).NeedsCgroup() {
+		t.Fatal("pids limit should need cgroups")
+	}
+}
+
+func TestNew_UnavailableWithoutV2(t *testing.T) {
+	old := Root
+	Root = t.TempDir()
+	defer func() { Root = old }()
+
+	if _, err := New("exec", Limits{}); err != ErrUnavailable {
+		t.Fatalf("expected ErrUnavailable, got %v", err)
+	}
+}
+
+// fakeRoot points Root at a temp dir laid out like an empty cgroup v2 mount.
+// New then only needs root for Available.
+func fakeRoot(t *testing.T) {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir := t.TempDir()
+	touch(t, dir, "cgroup.controllers", "cgroup.subtree_control")
+	os.Mkdir(filepath.Join(dir, SliceName), 0o755)
+	touch(t, filepath.Join(dir, SliceName), "cgroup.subtree_control")
+	old := Root
+	Root = dir
+	t.Cleanup(func() { Root = old })
+}
+
+func TestNew_ConcurrentLeavesSurvive(t *testing.T) {
+	fakeRoot(t)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 64)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g, err := New("exec", Limits{})
+			if err != nil {
+				errs <- err
+				return
+			}
+			// Another New must not remove the still empty leaf.
+			time.Sleep(time.Millisecond)
+			f, err := g.Open()
+			if err != nil {
+				errs <- err
+				return
+			}
+			f.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+}
+
+func TestSweep_RemovesLeftoverLeaves(t *testing.T) {
+	fakeRoot(t)
+	leftover := filepath.Join(Root, SliceName, "exec-old")
+	os.Mkdir(leftover, 0o755)
+
+	Sweep()
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Fatalf("expected the leftover leaf to be removed, got %v", err)
+	}
+}
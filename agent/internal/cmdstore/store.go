@@ -3,13 +3,139 @@ package cmdstore
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"io"
+	"os"
 	"os/exec"
+	"sort"
 	"sync"
+	"syscall"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/eventlog"
+	"github.com/angelorc/vmsan/agent/internal/outlog"
+	"github.com/angelorc/vmsan/agent/internal/procfs"
+	"github.com/creack/pty"
+)
+
+// Retention is how long finished commands stay in the store so their output
+// and exit status can still be fetched.
+var Retention = 10 * time.Minute
+
+// OutputLogBytes bounds the output retained per command.
+const OutputLogBytes = 1 << 20 // 1MB
+
+// EventLogBytes bounds the encoded events journaled per command.
+const EventLogBytes = 1 << 20 // 1MB
+
+// ErrStdinClosed is returned when writing to a command whose stdin has
+// already been closed (or was never opened).
+var ErrStdinClosed = errors.New("stdin is closed")
+
+// ErrNoTTY is returned when resizing a command that was not started under a
+// pseudo-terminal.
+var ErrNoTTY = errors.New("command has no tty")
+
+// Command states reported by Info.
+const (
+	StateRunning = "running"
+	StateExited  = "exited"
+	StateKilled  = "killed"
+	StateTimeout = "timeout"
+	StateFailed  = "failed"
+)
+
+// Signal scopes accepted by Entry.Signal. Commands are started as the leader
+// of their own process group, so ScopeGroup reaches everything they fork
+// unless a descendant moves itself into a new group or session; ScopeTree
+// additionally walks /proc to catch those.
+const (
+	ScopeProcess = "process"
+	ScopeGroup   = "group"
+	ScopeTree    = "tree"
 )
 
+// ErrInvalidScope is returned for an unknown signal scope.
+var ErrInvalidScope = errors.New("invalid signal scope")
+
+// Meta describes how a command was requested.
+type Meta struct {
+	Cmd       string
+	Args      []string
+	User      string
+	Cwd       string
+	Detached  bool
+	TTY       bool
+	ContextID string
+}
+
+// Rusage is the resource usage of a finished command as reported by wait4.
+type Rusage struct {
+	UserTimeMs             int64 `json:"userTimeMs"`
+	SystemTimeMs           int64 `json:"systemTimeMs"`
+	MaxRSSKB               int64 `json:"maxRssKb"`
+	MinorFaults            int64 `json:"minorFaults"`
+	MajorFaults            int64 `json:"majorFaults"`
+	InBlocks               int64 `json:"inBlocks"`
+	OutBlocks              int64 `json:"outBlocks"`
+	VoluntaryCtxSwitches   int64 `json:"voluntaryCtxSwitches"`
+	InvoluntaryCtxSwitches int64 `json:"involuntaryCtxSwitches"`
+}
+
+// Result describes how a finished command ended.
+type Result struct {
+	ExitCode   *int
+	TimedOut   bool
+	Error      string
+	Limit      string // resource limit that ended the command, if any
+	Signal     string // terminating signal name, if the process was signaled
+	Rusage     *Rusage
+	FinishedAt time.Time
+}
+
+// Info is the exported struct for JSON serialization.
+type Info struct {
+	ID         string     `json:"id"`
+	PID        int        `json:"pid"`
+	Cmd        string     `json:"cmd"`
+	Args       []string   `json:"args,omitempty"`
+	User       string     `json:"user,omitempty"`
+	Cwd        string     `json:"cwd,omitempty"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	Detached   bool       `json:"detached"`
+	TTY        bool       `json:"tty"`
+	ContextID  string     `json:"contextId,omitempty"`
+	State      string     `json:"state"`
+	ExitCode   *int       `json:"exitCode,omitempty"`
+	Limit      string     `json:"limit,omitempty"`
+	Signal     string     `json:"signal,omitempty"`
+	Rusage     *Rusage    `json:"rusage,omitempty"`
+	DurationMs int64      `json:"durationMs"`
+}
+
+// Entry is a command tracked by the store, running or recently finished.
+type Entry struct {
+	ID        string
+	Cmd       *exec.Cmd
+	TTY       *os.File      // pseudo-terminal master, nil for pipe-based commands
+	Output    *outlog.Log   // retained stdout/stderr
+	Events    *eventlog.Log // journaled stream events, for resuming
+	Meta      Meta
+	StartedAt time.Time
+
+	stdinMu sync.Mutex
+	stdin   io.WriteCloser
+
+	resultMu sync.Mutex
+	result   *Result
+	killed   bool
+	done     chan struct{}
+}
+
 var (
 	mu    sync.RWMutex
-	store = make(map[string]*exec.Cmd)
+	store = make(map[string]*Entry)
 )
 
 func generateID() string {
@@ -18,25 +144,249 @@ func generateID() string {
 	return hex.EncodeToString(b)
 }
 
-// Store registers a running command and returns its ID.
-func Store(cmd *exec.Cmd) string {
-	id := generateID()
+// Store registers a running command and returns its entry. stdin may be nil
+// when the command was started without an input pipe, and tty is nil unless
+// the command runs under a pseudo-terminal. events is the journal the
+// command's stream events were already being recorded in, or nil to start a
+// new one.
+func Store(cmd *exec.Cmd, stdin io.WriteCloser, tty *os.File, events *eventlog.Log, meta Meta) *Entry {
+	if events == nil {
+		events = eventlog.New(EventLogBytes)
+	}
+	e := &Entry{
+		ID:        generateID(),
+		Cmd:       cmd,
+		TTY:       tty,
+		Output:    outlog.New(OutputLogBytes),
+		Events:    events,
+		Meta:      meta,
+		StartedAt: time.Now(),
+		stdin:     stdin,
+		done:      make(chan struct{}),
+	}
 	mu.Lock()
-	store[id] = cmd
+	store[e.ID] = e
 	mu.Unlock()
-	return id
+	return e
 }
 
-// Get returns the command for the given ID, or nil.
-func Get(id string) *exec.Cmd {
+// Get returns the entry for the given ID, or nil.
+func Get(id string) *Entry {
 	mu.RLock()
 	defer mu.RUnlock()
 	return store[id]
 }
 
+// List returns info for all tracked commands, oldest first.
+func List() []Info {
+	mu.RLock()
+	entries := make([]*Entry, 0, len(store))
+	for _, e := range store {
+		entries = append(entries, e)
+	}
+	mu.RUnlock()
+
+	infos := make([]Info, 0, len(entries))
+	for _, e := range entries {
+		infos = append(infos, e.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].StartedAt.Before(infos[j].StartedAt)
+	})
+	return infos
+}
+
 // Remove deletes a command from the store.
 func Remove(id string) {
 	mu.Lock()
 	delete(store, id)
 	mu.Unlock()
 }
+
+// CopyStdin streams r into the command's stdin. The stdin lock is held for
+// the whole copy so concurrent callers never interleave their input.
+func (e *Entry) CopyStdin(r io.Reader) (int64, error) {
+	e.stdinMu.Lock()
+	defer e.stdinMu.Unlock()
+	if e.stdin == nil {
+		return 0, ErrStdinClosed
+	}
+	return io.Copy(e.stdin, r)
+}
+
+// CloseStdin closes the command's stdin, delivering EOF to the process.
+// Closing an already-closed stdin is a no-op.
+func (e *Entry) CloseStdin() error {
+	e.stdinMu.Lock()
+	defer e.stdinMu.Unlock()
+	if e.stdin == nil {
+		return nil
+	}
+	err := e.stdin.Close()
+	e.stdin = nil
+	return err
+}
+
+// Resize sets the window size of the command's pseudo-terminal.
+func (e *Entry) Resize(cols, rows uint16) error {
+	if e.TTY == nil {
+		return ErrNoTTY
+	}
+	return pty.Setsize(e.TTY, &pty.Winsize{Cols: cols, Rows: rows})
+}
+
+// Finish records the command's result, closes its output log and schedules
+// the entry for removal after Retention. Only the first call has an effect.
+func (e *Entry) Finish(res Result) {
+	e.resultMu.Lock()
+	if e.result != nil {
+		e.resultMu.Unlock()
+		return
+	}
+	if res.FinishedAt.IsZero() {
+		res.FinishedAt = time.Now()
+	}
+	e.result = &res
+	e.resultMu.Unlock()
+
+	// exec.Cmd.Wait already closed the pipe; drop it so later writes report
+	// ErrStdinClosed instead of touching a dead descriptor.
+	e.stdinMu.Lock()
+	e.stdin = nil
+	e.stdinMu.Unlock()
+
+	e.Output.Close()
+	close(e.done)
+
+	time.AfterFunc(Retention, func() { Remove(e.ID) })
+}
+
+// Result returns the command's result and whether it has finished.
+func (e *Entry) Result() (Result, bool) {
+	e.resultMu.Lock()
+	defer e.resultMu.Unlock()
+	if e.result == nil {
+		return Result{}, false
+	}
+	return *e.result, true
+}
+
+// Done returns a channel that is closed once the command has finished.
+func (e *Entry) Done() <-chan struct{} {
+	return e.done
+}
+
+// MarkKilled records that the command was killed on request, so its final
+// state is reported as killed rather than exited.
+func (e *Entry) MarkKilled() {
+	e.resultMu.Lock()
+	e.killed = true
+	e.resultMu.Unlock()
+}
+
+// MarkDetached records that the command now runs as a detached job, e.g.
+// because the client streaming its output went away.
+func (e *Entry) MarkDetached() {
+	e.resultMu.Lock()
+	e.Meta.Detached = true
+	e.resultMu.Unlock()
+}
+
+// Info returns an exported Info for JSON serialization.
+func (e *Entry) Info() Info {
+	e.resultMu.Lock()
+	defer e.resultMu.Unlock()
+
+	info := Info{
+		ID:        e.ID,
+		Cmd:       e.Meta.Cmd,
+		Args:      e.Meta.Args,
+		User:      e.Meta.User,
+		Cwd:       e.Meta.Cwd,
+		StartedAt: e.StartedAt,
+		Detached:  e.Meta.Detached,
+		TTY:       e.Meta.TTY,
+		ContextID: e.Meta.ContextID,
+		State:     StateRunning,
+	}
+	if e.Cmd.Process != nil {
+		info.PID = e.Cmd.Process.Pid
+	}
+	if e.result == nil {
+		info.DurationMs = time.Since(e.StartedAt).Milliseconds()
+		return info
+	}
+
+	finishedAt := e.result.FinishedAt
+	info.FinishedAt = &finishedAt
+	info.ExitCode = e.result.ExitCode
+	info.Limit = e.result.Limit
+	info.Signal = e.result.Signal
+	info.Rusage = e.result.Rusage
+	info.DurationMs = finishedAt.Sub(e.StartedAt).Milliseconds()
+	switch {
+	case e.result.TimedOut:
+		info.State = StateTimeout
+	case e.result.Error != "":
+		info.State = StateFailed
+	case e.killed && e.result.Signal != "":
+		// Only report killed when the signal actually terminated the
+		// command; one that handled it and exited normally is just exited.
+		info.State = StateKilled
+	default:
+		info.State = StateExited
+	}
+	return info
+}
+
+// Signal delivers sig to the command according to scope.
+func (e *Entry) Signal(sig syscall.Signal, scope string) error {
+	pid := e.Cmd.Process.Pid
+	switch scope {
+	case ScopeProcess:
+		return e.Cmd.Process.Signal(sig)
+	case ScopeGroup:
+		return ignoreESRCH(syscall.Kill(-pid, sig))
+	case ScopeTree:
+		// Snapshot descendants before signalling: once a parent dies its
+		// children are reparented and can no longer be found from pid.
+		descendants, _ := procfs.Descendants(pid)
+		err := ignoreESRCH(syscall.Kill(-pid, sig))
+		for _, child := range descendants {
+			syscall.Kill(child, sig)
+		}
+		return err
+	default:
+		return ErrInvalidScope
+	}
+}
+
+// Terminate sends sig according to scope and, if the command is still
+// running after grace, escalates to SIGKILL with the same scope. A zero grace
+// (or sig == SIGKILL) disables escalation.
+func (e *Entry) Terminate(sig syscall.Signal, scope string, grace time.Duration) error {
+	if err := e.Signal(sig, scope); err != nil {
+		return err
+	}
+	if grace <= 0 || sig == syscall.SIGKILL {
+		return nil
+	}
+	go func() {
+		timer := time.NewTimer(grace)
+		defer timer.Stop()
+		select {
+		case <-e.done:
+		case <-timer.C:
+			e.Signal(syscall.SIGKILL, scope)
+		}
+	}()
+	return nil
+}
+
+// ignoreESRCH treats "no such process" as success: the target already exited.
+func ignoreESRCH(err error) error {
+	if errors.Is(err, syscall.ESRCH) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package cmdstore
+
+import (
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestEntryStdin_CopyAndClose(t *testing.T) {
+	cmd := exec.Command("cat")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("stdin pipe: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("stdout pipe: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+
+	e := Store(cmd, stdin, nil, nil, Meta{Cmd: "cat"})
+	defer Remove(e.ID)
+
+	if got := Get(e.ID); got != e {
+		t.Fatalf("expected Get to return stored entry")
+	}
+
+	if _, err := e.CopyStdin(strings.NewReader("hello\n")); err != nil {
+		t.Fatalf("copy stdin: %v", err)
+	}
+	if err := e.CloseStdin(); err != nil {
+		t.Fatalf("close stdin: %v", err)
+	}
+	if err := e.CloseStdin(); err != nil {
+		t.Fatalf("second close should be a no-op, got %v", err)
+	}
+
+	out, err := io.ReadAll(stdout)
+	if err != nil {
+		t.Fatalf("read stdout: %v", err)
+	}
+	if string(out) != "hello\n" {
+		t.Fatalf("expected echoed input, got %q", out)
+	}
+	cmd.Wait()
+
+	if _, err := e.CopyStdin(strings.NewReader("late")); !errors.Is(err, ErrStdinClosed) {
+		t.Fatalf("expected ErrStdinClosed after close, got %v", err)
+	}
+}
+
+func TestEntryStdin_NilPipe(t *testing.T) {
+	e := Store(exec.Command("true"), nil, nil, nil, Meta{Cmd: "true"})
+	defer Remove(e.ID)
+
+	if _, err := e.CopyStdin(strings.NewReader("x")); !errors.Is(err, ErrStdinClosed) {
+		t.Fatalf("expected ErrStdinClosed without a pipe, got %v", err)
+	}
+	if err := e.CloseStdin(); err != nil {
+		t.Fatalf("close on nil pipe should be a no-op, got %v", err)
+	}
+}
+
+func TestEntryResize_WithoutTTY(t *testing.T) {
+	e := Store(exec.Command("true"), nil, nil, nil, Meta{Cmd: "true"})
+	defer Remove(e.ID)
+
+	if err := e.Resize(80, 24); !errors.Is(err, ErrNoTTY) {
+		t.Fatalf("expected ErrNoTTY, got %v", err)
+	}
+}
+
+func TestEntryInfo_States(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	e := Store(cmd, nil, nil, nil, Meta{Cmd: "true", User: "ubuntu", Detached: true})
+	defer Remove(e.ID)
+
+	info := e.Info()
+	if info.State != StateRunning || info.FinishedAt != nil {
+		t.Fatalf("expected running entry, got state=%s finishedAt=%v", info.State, info.FinishedAt)
+	}
+	if info.PID != cmd.Process.Pid || !info.Detached || info.User != "ubuntu" {
+		t.Fatalf("unexpected info: %+v", info)
+	}
+
+	cmd.Wait()
+	code := 0
+	e.Finish(Result{ExitCode: &code})
+	select {
+	case <-e.Done():
+	default:
+		t.Fatal("expected Done to be closed after Finish")
+	}
+
+	info = e.Info()
+	if info.State != StateExited || info.ExitCode == nil || *info.ExitCode != 0 {
+		t.Fatalf("expected exited with code 0, got %+v", info)
+	}
+	if info.FinishedAt == nil {
+		t.Fatal("expected finishedAt to be set")
+	}
+
+	found := false
+	for _, listed := range List() {
+		if listed.ID == e.ID {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected finished entry to remain listed until retention expires")
+	}
+}
+
+func TestEntryInfo_KilledAndTimeout(t *testing.T) {
+	killed := Store(exec.Command("true"), nil, nil, nil, Meta{})
+	defer Remove(killed.ID)
+	killed.MarkKilled()
+	code := -1
+	killed.Finish(Result{ExitCode: &code, Signal: "SIGKILL"})
+	if state := killed.Info().State; state != StateKilled {
+		t.Fatalf("expected killed state, got %s", state)
+	}
+
+	timedOut := Store(exec.Command("true"), nil, nil, nil, Meta{})
+	defer Remove(timedOut.ID)
+	timedOut.Finish(Result{TimedOut: true})
+	if state := timedOut.Info().State; state != StateTimeout {
+		t.Fatalf("expected timeout state, got %s", state)
+	}
+}
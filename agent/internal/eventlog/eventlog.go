@@ -0,0 +1,88 @@
+// Package eventlog keeps a bounded, sequence-numbered journal of encoded
+// events so that clients can resume a stream after reconnecting.
+package eventlog
+
+import "sync"
+
+// Event is one journaled event.
+type Event struct {
+	Seq  int64
+	Data []byte // encoded event, including its sequence number
+}
+
+// Log is a journal of events numbered from 1. Once more than maxBytes are
+// retained, the oldest events are evicted; the most recent event is always
+// kept so a finished command's final event stays available.
+type Log struct {
+	mu       sync.Mutex
+	maxBytes int
+	events   []Event
+	size     int
+	seq      int64
+	closed   bool
+	notify   chan struct{}
+}
+
+// New creates an empty Log retaining at most maxBytes of encoded events.
+func New(maxBytes int) *Log {
+	return &Log{maxBytes: maxBytes, notify: make(chan struct{})}
+}
+
+// Append assigns the next sequence number, records encode(seq) under it,
+// wakes any followers and returns the encoded event. Appending to a closed
+// log still encodes the event but does not record it.
+func (l *Log) Append(encode func(seq int64) []byte) Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return Event{Data: encode(0)}
+	}
+	l.seq++
+	evt := Event{Seq: l.seq, Data: encode(l.seq)}
+	l.events = append(l.events, evt)
+	l.size += len(evt.Data)
+	for l.size > l.maxBytes && len(l.events) > 1 {
+		l.size -= len(l.events[0].Data)
+		l.events[0] = Event{}
+		l.events = l.events[1:]
+	}
+	close(l.notify)
+	l.notify = make(chan struct{})
+	return evt
+}
+
+// After returns the retained events with a sequence number greater than
+// seq, whether events after seq were already evicted, and whether the log
+// is closed.
+func (l *Log) After(seq int64) (events []Event, missed, closed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, evt := range l.events {
+		if evt.Seq > seq {
+			events = append(events, l.events[i:]...)
+			missed = evt.Seq > seq+1
+			break
+		}
+	}
+	return events, missed, l.closed
+}
+
+// Wait returns a channel that is closed on the next Append or Close.
+func (l *Log) Wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.notify
+}
+
+// Close marks the log complete and wakes any followers. Closing twice is a
+// no-op.
+func (l *Log) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
@@ -0,0 +1,75 @@
+package eventlog
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func appendN(l *Log, n int) {
+	for i := 0; i < n; i++ {
+		l.Append(func(seq int64) []byte { return []byte(fmt.Sprintf("event-%02d", seq)) })
+	}
+}
+
+func TestLog_AfterReturnsMissedEvents(t *testing.T) {
+	l := New(1024)
+	appendN(l, 3)
+
+	events, missed, closed := l.After(1)
+	if len(events) != 2 || events[0].Seq != 2 || events[1].Seq != 3 {
+		t.Fatalf("expected events 2 and 3, got %+v", events)
+	}
+	if string(events[0].Data) != "event-02" {
+		t.Fatalf("expected encoded data to carry its seq, got %q", events[0].Data)
+	}
+	if missed || closed {
+		t.Fatalf("expected missed=false closed=false, got %v %v", missed, closed)
+	}
+
+	if events, _, _ := l.After(3); len(events) != 0 {
+		t.Fatalf("expected nothing after the last event, got %+v", events)
+	}
+}
+
+func TestLog_EvictsOldestButKeepsLast(t *testing.T) {
+	l := New(16) // two 8-byte events
+	appendN(l, 3)
+
+	events, missed, _ := l.After(0)
+	if len(events) != 2 || events[0].Seq != 2 {
+		t.Fatalf("expected events 2 and 3 to be retained, got %+v", events)
+	}
+	if !missed {
+		t.Fatal("expected evicted event 1 to be reported as missed")
+	}
+
+	big := New(4)
+	appendN(big, 2)
+	if events, _, _ := big.After(0); len(events) != 1 || events[0].Seq != 2 {
+		t.Fatalf("expected the oversized last event to be kept, got %+v", events)
+	}
+}
+
+func TestLog_CloseWakesFollowers(t *testing.T) {
+	l := New(1024)
+	changed := l.Wait()
+	l.Close()
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("expected Close to wake followers")
+	}
+	if _, _, closed := l.After(0); !closed {
+		t.Fatal("expected log to report closed")
+	}
+
+	evt := l.Append(func(seq int64) []byte { return []byte("late") })
+	if evt.Seq != 0 || string(evt.Data) != "late" {
+		t.Fatalf("expected unrecorded late event, got %+v", evt)
+	}
+	if events, _, _ := l.After(0); len(events) != 0 {
+		t.Fatalf("expected closed log to stay empty, got %+v", events)
+	}
+}
@@ -0,0 +1,233 @@
+// Package execctx keeps exec contexts: a working directory, environment and
+// user shared by successive commands, so that they behave like consecutive
+// lines in one shell.
+package execctx
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxContexts bounds the number of live contexts.
+	MaxContexts = 256
+
+	// TTL is how long a context may go unused before it is discarded.
+	TTL = time.Hour
+
+	// SweepInterval is how often the agent calls Sweep.
+	SweepInterval = time.Minute
+)
+
+// ErrTooMany is returned by Create when MaxContexts contexts exist.
+var ErrTooMany = errors.New("too many contexts")
+
+// Context is a shared working directory, environment and user. Env holds
+// overrides on top of the agent's environment; Unset lists variables removed
+// from it.
+type Context struct {
+	ID        string
+	User      string
+	CreatedAt time.Time
+
+	mu       sync.Mutex
+	cwd      string
+	env      map[string]string
+	unset    map[string]bool
+	lastUsed time.Time
+}
+
+// Info is the exported struct for JSON serialization.
+type Info struct {
+	ID         string            `json:"id"`
+	User       string            `json:"user,omitempty"`
+	Cwd        string            `json:"cwd,omitempty"`
+	Env        map[string]string `json:"env"`
+	Unset      []string          `json:"unset,omitempty"`
+	CreatedAt  time.Time         `json:"createdAt"`
+	LastUsedAt time.Time         `json:"lastUsedAt"`
+}
+
+var (
+	mu       sync.RWMutex
+	contexts = make(map[string]*Context)
+)
+
+func generateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Create registers a new context.
+func Create(user, cwd string, env map[string]string) (*Context, error) {
+	Sweep()
+
+	now := time.Now()
+	c := &Context{
+		ID:        generateID(),
+		User:      user,
+		CreatedAt: now,
+		cwd:       cwd,
+		env:       make(map[string]string, len(env)),
+		unset:     make(map[string]bool),
+		lastUsed:  now,
+	}
+	for k, v := range env {
+		c.env[k] = v
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(contexts) >= MaxContexts {
+		return nil, ErrTooMany
+	}
+	contexts[c.ID] = c
+	return c, nil
+}
+
+// Get returns the context with the given ID, or nil.
+func Get(id string) *Context {
+	mu.RLock()
+	defer mu.RUnlock()
+	return contexts[id]
+}
+
+// List returns info for all contexts, oldest first.
+func List() []Info {
+	mu.RLock()
+	all := make([]*Context, 0, len(contexts))
+	for _, c := range contexts {
+		all = append(all, c)
+	}
+	mu.RUnlock()
+
+	infos := make([]Info, 0, len(all))
+	for _, c := range all {
+		infos = append(infos, c.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreatedAt.Before(infos[j].CreatedAt)
+	})
+	return infos
+}
+
+// Remove deletes a context and reports whether it existed.
+func Remove(id string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := contexts[id]
+	delete(contexts, id)
+	return ok
+}
+
+// Sweep discards the contexts that have not been used for longer than TTL.
+func Sweep() {
+	mu.Lock()
+	defer mu.Unlock()
+	for id, c := range contexts {
+		c.mu.Lock()
+		idle := time.Since(c.lastUsed) > TTL
+		c.mu.Unlock()
+		if idle {
+			delete(contexts, id)
+		}
+	}
+}
+
+// Environ applies the context's environment to base, a list of key=value
+// entries, and returns its working directory.
+func (c *Context) Environ(base []string) (cwd string, env []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastUsed = time.Now()
+
+	env = make([]string, 0, len(base)+len(c.env))
+	for _, kv := range base {
+		k, _, _ := strings.Cut(kv, "=")
+		if c.unset[k] {
+			continue
+		}
+		if _, overridden := c.env[k]; overridden {
+			continue
+		}
+		env = append(env, kv)
+	}
+	keys := make([]string, 0, len(c.env))
+	for k := range c.env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		env = append(env, k+"="+c.env[k])
+	}
+	return c.cwd, env
+}
+
+// Update records the state a command left behind: its final working
+// directory and the difference between the environment it started with and
+// the one it ended with. Keys in ignore are left untouched.
+func (c *Context) Update(cwd string, before, after []string, ignore map[string]bool) {
+	start := toMap(before)
+	end := toMap(after)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastUsed = time.Now()
+	if cwd != "" {
+		c.cwd = cwd
+	}
+	for k, v := range end {
+		if ignore[k] {
+			continue
+		}
+		if old, ok := start[k]; !ok || old != v {
+			c.env[k] = v
+			delete(c.unset, k)
+		}
+	}
+	for k := range start {
+		if _, ok := end[k]; ok || ignore[k] {
+			continue
+		}
+		delete(c.env, k)
+		c.unset[k] = true
+	}
+}
+
+// Info returns an exported Info for JSON serialization.
+func (c *Context) Info() Info {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	info := Info{
+		ID:         c.ID,
+		User:       c.User,
+		Cwd:        c.cwd,
+		Env:        make(map[string]string, len(c.env)),
+		CreatedAt:  c.CreatedAt,
+		LastUsedAt: c.lastUsed,
+	}
+	for k, v := range c.env {
+		info.Env[k] = v
+	}
+	for k := range c.unset {
+		info.Unset = append(info.Unset, k)
+	}
+	sort.Strings(info.Unset)
+	return info
+}
+
+func toMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			m[k] = v
+		}
+	}
+	return m
+}
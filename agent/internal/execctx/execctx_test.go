@@ -0,0 +1,107 @@
+package execctx
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestContext_EnvironAppliesOverridesAndUnsets(t *testing.T) {
+	c, err := Create("ubuntu", "/srv", map[string]string{"FOO": "ctx"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(c.ID)
+
+	cwd, env := c.Environ([]string{"FOO=base", "KEEP=1"})
+	if cwd != "/srv" {
+		t.Fatalf("expected cwd /srv, got %q", cwd)
+	}
+	if want := []string{"KEEP=1", "FOO=ctx"}; !reflect.DeepEqual(env, want) {
+		t.Fatalf("expected %v, got %v", want, env)
+	}
+}
+
+func TestContext_UpdateRecordsChanges(t *testing.T) {
+	c, err := Create("", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(c.ID)
+
+	before := []string{"A=1", "B=2", "PWD=/", "C=3"}
+	after := []string{"A=1", "B=changed", "NEW=x", "PWD=/tmp"}
+	c.Update("/tmp", before, after, map[string]bool{"PWD": true})
+
+	info := c.Info()
+	if info.Cwd != "/tmp" {
+		t.Fatalf("expected cwd /tmp, got %q", info.Cwd)
+	}
+	if want := map[string]string{"B": "changed", "NEW": "x"}; !reflect.DeepEqual(info.Env, want) {
+		t.Fatalf("expected env %v, got %v", want, info.Env)
+	}
+	if want := []string{"C"}; !reflect.DeepEqual(info.Unset, want) {
+		t.Fatalf("expected unset %v, got %v", want, info.Unset)
+	}
+
+	_, env := c.Environ([]string{"A=1", "B=2", "C=3"})
+	if want := []string{"A=1", "B=changed", "NEW=x"}; !reflect.DeepEqual(env, want) {
+		t.Fatalf("expected %v, got %v", want, env)
+	}
+
+	// Re-exporting an unset variable brings it back.
+	c.Update("", []string{"A=1"}, []string{"A=1", "C=again"}, nil)
+	if info := c.Info(); info.Env["C"] != "again" || len(info.Unset) != 0 || info.Cwd != "/tmp" {
+		t.Fatalf("unexpected info after re-export: %+v", info)
+	}
+}
+
+func TestCreate_EnforcesLimitAndRemove(t *testing.T) {
+	var ids []string
+	defer func() {
+		for _, id := range ids {
+			Remove(id)
+		}
+	}()
+	for i := len(List()); i < MaxContexts; i++ {
+		c, err := Create("", "", nil)
+		if err != nil {
+			t.Fatalf("create %d: %v", i, err)
+		}
+		ids = append(ids, c.ID)
+	}
+	if _, err := Create("", "", nil); err != ErrTooMany {
+		t.Fatalf("expected ErrTooMany, got %v", err)
+	}
+	if !Remove(ids[0]) || Remove(ids[0]) {
+		t.Fatal("expected Remove to report existence once")
+	}
+	if Get(ids[0]) != nil {
+		t.Fatal("expected removed context to be gone")
+	}
+}
+
+func TestSweep_DiscardsIdleContexts(t *testing.T) {
+	idle, err := Create("", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := Create("", "/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer Remove(used.ID)
+
+	idle.mu.Lock()
+	idle.lastUsed = time.Now().Add(-TTL - time.Minute)
+	idle.mu.Unlock()
+	used.mu.Lock()
+	used.lastUsed = time.Now().Add(-TTL - time.Minute)
+	used.mu.Unlock()
+	used.Environ(nil)
+	Sweep()
+
+	if Get(idle.ID) != nil || Get(used.ID) == nil {
+		t.Fatal("expected only the idle context to be discarded")
+	}
+}
@@ -0,0 +1,140 @@
+// Package globs matches slash-separated relative paths against glob
+// patterns, including "**", and implements .gitignore rules on top of them.
+package globs
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Match reports whether the relative path name matches pattern. Segments
+// are matched with path.Match, and a "**" segment matches any number of
+// segments, including none. A pattern without a slash matches the last
+// segment of name, at any depth. Malformed patterns match nothing.
+func Match(pattern, name string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// MatchAny reports whether name matches any of patterns.
+func MatchAny(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if Match(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+type rule struct {
+	base     string // directory of the .gitignore, relative; "" for the root
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+// GitIgnore holds the rules of the .gitignore files loaded so far. Rules of
+// a file apply to paths below its directory, and later (deeper) files take
+// precedence, as in git.
+type GitIgnore struct {
+	rules []rule
+}
+
+// Load reads the .gitignore in dir, whose path relative to the tree root is
+// rel, if there is one.
+func (g *GitIgnore) Load(dir, rel string) error {
+	data, err := os.ReadFile(filepath.Join(dir, ".gitignore"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	g.Parse(data, rel)
+	return nil
+}
+
+// Parse adds the rules of a .gitignore file in the directory rel.
+func (g *GitIgnore) Parse(data []byte, rel string) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := rule{base: rel}
+		if strings.HasPrefix(line, "!") {
+			r.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			r.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		r.anchored = strings.Contains(line, "/")
+		r.pattern = strings.TrimPrefix(line, "/")
+		g.rules = append(g.rules, r)
+	}
+}
+
+// Ignored reports whether the relative path name, a directory if dir is
+// set, is ignored: the last rule matching it is not a negation.
+func (g *GitIgnore) Ignored(name string, dir bool) bool {
+	ignored := false
+	for _, r := range g.rules {
+		if r.dirOnly && !dir {
+			continue
+		}
+		rel := name
+		if r.base != "" {
+			if !strings.HasPrefix(name, r.base+"/") {
+				continue
+			}
+			rel = name[len(r.base)+1:]
+		}
+		var ok bool
+		if r.anchored {
+			ok = matchSegments(strings.Split(r.pattern, "/"), strings.Split(rel, "/"))
+		} else {
+			ok, _ = path.Match(r.pattern, path.Base(rel))
+		}
+		if ok {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
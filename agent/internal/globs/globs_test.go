@@ -0,0 +1,56 @@
+package globs
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.js", "main.js", true},
+		{"*.js", "dist/assets/main.js", true},
+		{"*.js", "main.jsx", false},
+		{"dist/*.js", "dist/main.js", true},
+		{"dist/*.js", "dist/assets/main.js", false},
+		{"dist/**", "dist/assets/main.js", true},
+		{"dist/**/*.map", "dist/main.js.map", true},
+		{"dist/**/*.map", "dist/a/b/main.js.map", true},
+		{"**/node_modules", "a/b/node_modules", true},
+		{"/src/*.go", "src/main.go", true},
+		{"src/[", "src/[", false},
+	} {
+		if got := Match(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("Match(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestGitIgnore(t *testing.T) {
+	var g GitIgnore
+	g.Parse([]byte("# build output\nnode_modules/\n*.log\n!keep.log\n/dist\ndocs/*.tmp\n"), "")
+	g.Parse([]byte("*.gen.go\n!important.log\n"), "pkg")
+
+	for _, tc := range []struct {
+		name string
+		dir  bool
+		want bool
+	}{
+		{"node_modules", true, true},
+		{"web/node_modules", true, true},
+		{"node_modules", false, false}, // dir-only rule
+		{"app.log", false, true},
+		{"logs/keep.log", false, false},
+		{"dist", true, true},
+		{"web/dist", true, false}, // anchored to the root
+		{"docs/a.tmp", false, true},
+		{"docs/sub/a.tmp", false, false},
+		{"pkg/x.gen.go", false, true},
+		{"x.gen.go", false, false}, // pkg rules only apply below pkg
+		{"pkg/important.log", false, false},
+		{"main.go", false, false},
+	} {
+		if got := g.Ignored(tc.name, tc.dir); got != tc.want {
+			t.Errorf("Ignored(%q, %v) = %v, want %v", tc.name, tc.dir, got, tc.want)
+		}
+	}
+}
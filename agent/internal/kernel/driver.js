@@ -0,0 +1,103 @@
+// vmsan kernel driver for Node.js.
+//
+// Requests arrive as JSON lines on fd 3 and messages go out as JSON lines on
+// fd 4. Output written by the code goes to fd 1 and 2 as usual (synchronously,
+// as stdio pipes are on Linux); once a cell has finished, its token is
+// written to both so the agent knows it has seen all of the cell's output.
+'use strict';
+
+const fs = require('fs');
+const readline = require('readline');
+const util = require('util');
+const vm = require('vm');
+
+function send(msg) {
+  fs.writeSync(4, JSON.stringify(msg) + '\n');
+}
+
+function bundle(value) {
+  return { 'text/plain': util.inspect(value) };
+}
+
+// display(value) sends value as a display output. display(data, mime) sends
+// data under the given MIME type, base64-encoding buffers, and
+// display(bundle, { raw: true }) sends a MIME bundle as-is.
+function display(value, mime) {
+  if (mime && typeof mime === 'object' && mime.raw) {
+    send({ type: 'display', bundle: value });
+    return;
+  }
+  if (typeof mime === 'string') {
+    const data = Buffer.isBuffer(value) ? value.toString('base64') : value;
+    send({ type: 'display', bundle: { [mime]: data, 'text/plain': `<${mime}>` } });
+    return;
+  }
+  send({ type: 'display', bundle: bundle(value) });
+}
+
+// Interrupting while awaiting a cell's promise rejects the wait; the
+// synchronous part of a cell is interrupted by vm's breakOnSigint.
+let interruptWait = null;
+process.on('SIGINT', () => {
+  if (interruptWait) interruptWait();
+});
+
+// Errors escaping a cell's callbacks are reported instead of killing the
+// kernel.
+for (const event of ['uncaughtException', 'unhandledRejection']) {
+  process.on(event, (err) => {
+    process.stderr.write(`Uncaught ${util.inspect(err)}\n`);
+  });
+}
+
+Object.assign(globalThis, { require, module, display });
+
+async function run(code, filename) {
+  let value = vm.runInThisContext(code, { filename, breakOnSigint: true });
+  if (value && typeof value.then === 'function') {
+    value = await new Promise((resolve, reject) => {
+      interruptWait = () => {
+        const err = new Error('Script execution was interrupted by `SIGINT`');
+        err.code = 'ERR_SCRIPT_EXECUTION_INTERRUPTED';
+        reject(err);
+      };
+      value.then(resolve, reject);
+    }).finally(() => {
+      interruptWait = null;
+    });
+  }
+  if (value !== undefined) {
+    globalThis._ = value;
+    send({ type: 'result', bundle: bundle(value) });
+  }
+}
+
+async function main() {
+  send({ type: 'ready', version: process.versions.node });
+  const requests = readline.createInterface({ input: fs.createReadStream(null, { fd: 3 }), crlfDelay: Infinity });
+  let count = 0;
+  for await (const line of requests) {
+    const req = JSON.parse(line);
+    count++;
+    let status = 'ok';
+    try {
+      await run(req.code, `cell-${count}`);
+    } catch (err) {
+      const interrupted = err && err.code === 'ERR_SCRIPT_EXECUTION_INTERRUPTED';
+      status = interrupted ? 'interrupted' : 'error';
+      const isError = err instanceof Error;
+      send({
+        type: 'error',
+        name: interrupted ? 'Interrupted' : isError ? err.name : typeof err,
+        value: isError ? err.message : util.inspect(err),
+        // Hide the driver's and vm's own frames.
+        traceback: isError && err.stack ? err.stack.split('\n').filter((l) => !/^\s+at /.test(l) || /cell-\d+/.test(l)) : [],
+      });
+    }
+    fs.writeSync(1, req.token);
+    fs.writeSync(2, req.token);
+    send({ type: 'done', status, executionCount: count });
+  }
+}
+
+main();
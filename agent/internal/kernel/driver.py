@@ -0,0 +1,178 @@
+# vmsan kernel driver for Python.
+#
+# Requests arrive as JSON lines on fd 3 and messages go out as JSON lines on
+# fd 4. Output printed by the code goes to fd 1 and 2 as usual; once a cell
+# has finished, its token is written to both so the agent knows it has seen
+# all of the cell's output.
+import ast
+import asyncio
+import base64
+import builtins
+import inspect
+import json
+import linecache
+import os
+import signal
+import sys
+import threading
+import traceback
+
+_requests = os.fdopen(3, "r", encoding="utf-8")
+_messages = os.fdopen(4, "w", encoding="utf-8")
+_lock = threading.Lock()
+_executing = False
+_loop = asyncio.new_event_loop()
+_shown = set()
+
+_REPRS = [
+    ("_repr_html_", "text/html"),
+    ("_repr_markdown_", "text/markdown"),
+    ("_repr_svg_", "image/svg+xml"),
+    ("_repr_png_", "image/png"),
+    ("_repr_jpeg_", "image/jpeg"),
+    ("_repr_latex_", "text/latex"),
+    ("_repr_json_", "application/json"),
+    ("_repr_javascript_", "application/javascript"),
+]
+
+
+def _send(msg):
+    with _lock:
+        _messages.write(json.dumps(msg, default=repr) + "\n")
+        _messages.flush()
+
+
+def _figure_png(fig):
+    import io
+
+    buf = io.BytesIO()
+    fig.savefig(buf, format="png", bbox_inches="tight")
+    _shown.add(id(fig))
+    return base64.b64encode(buf.getvalue()).decode()
+
+
+def _bundle(obj):
+    data = {}
+    method = getattr(obj, "_repr_mimebundle_", None)
+    if callable(method) and not inspect.isclass(obj):
+        try:
+            result = method()
+            if isinstance(result, tuple):
+                result = result[0]
+            data.update(result or {})
+        except Exception:
+            pass
+    for attr, mime in _REPRS:
+        method = getattr(obj, attr, None)
+        if mime in data or not callable(method) or inspect.isclass(obj):
+            continue
+        try:
+            value = method()
+        except Exception:
+            continue
+        if value is None:
+            continue
+        if isinstance(value, tuple):
+            value = value[0]
+        if isinstance(value, bytes):
+            value = base64.b64encode(value).decode()
+        data[mime] = value
+    if "image/png" not in data and type(obj).__module__.startswith("matplotlib") and hasattr(obj, "savefig"):
+        data["image/png"] = _figure_png(obj)
+    for mime, value in list(data.items()):
+        if isinstance(value, bytes):
+            data[mime] = base64.b64encode(value).decode()
+    data["text/plain"] = repr(obj)
+    return data
+
+
+def display(*objs, raw=False):
+    """Send each object as a rich display output, or as-is when raw."""
+    for obj in objs:
+        _send({"type": "display", "bundle": obj if raw else _bundle(obj)})
+
+
+def _flush_figures():
+    plt = sys.modules.get("matplotlib.pyplot")
+    if plt is None:
+        return
+    for num in plt.get_fignums():
+        fig = plt.figure(num)
+        if id(fig) not in _shown:
+            _send({"type": "display", "bundle": {"image/png": _figure_png(fig), "text/plain": repr(fig)}})
+    plt.close("all")
+    _shown.clear()
+
+
+def _run(code, filename, ns):
+    global _executing
+    linecache.cache[filename] = (len(code), None, code.splitlines(True), filename)
+    flags = ast.PyCF_ALLOW_TOP_LEVEL_AWAIT
+    tree = ast.parse(code, filename, "exec")
+    last = None
+    if tree.body and isinstance(tree.body[-1], ast.Expr):
+        last = ast.Expression(tree.body.pop().value)
+
+    def evaluate(node, mode):
+        compiled = compile(node, filename, mode, flags=flags)
+        value = eval(compiled, ns)
+        if compiled.co_flags & inspect.CO_COROUTINE:
+            value = _loop.run_until_complete(value)
+        return value
+
+    _executing = True
+    try:
+        evaluate(tree, "exec")
+        value = evaluate(last, "eval") if last is not None else None
+    finally:
+        _executing = False
+    if value is not None:
+        ns["_"] = value
+        _send({"type": "result", "bundle": _bundle(value)})
+
+
+def _on_sigint(signum, frame):
+    if _executing:
+        raise KeyboardInterrupt
+
+
+def main():
+    signal.signal(signal.SIGINT, _on_sigint)
+    ns = {"__name__": "__main__", "__builtins__": builtins, "display": display}
+    sys.argv = [""]
+    count = 0
+    _send({"type": "ready", "version": sys.version.split()[0]})
+    while True:
+        line = _requests.readline()
+        if not line:
+            return
+        req = json.loads(line)
+        count += 1
+        status = "ok"
+        try:
+            _run(req["code"], "<cell-%d>" % count, ns)
+        except BaseException as e:
+            status = "interrupted" if isinstance(e, KeyboardInterrupt) else "error"
+            # Hide the driver's own frames.
+            te = traceback.TracebackException(type(e), e, e.__traceback__)
+            driver = _run.__code__.co_filename
+            te.stack = traceback.StackSummary.from_list([f for f in te.stack if f.filename != driver])
+            _send({
+                "type": "error",
+                "name": type(e).__name__,
+                "value": str(e),
+                "traceback": list(te.format()),
+            })
+        try:
+            _flush_figures()
+        except Exception:
+            pass
+        sys.stdout.flush()
+        sys.stderr.flush()
+        token = req["token"].encode()
+        os.write(1, token)
+        os.write(2, token)
+        _send({"type": "done", "status": status, "executionCount": count})
+
+
+main()
@@ -0,0 +1,799 @@
+// Package kernel runs persistent language interpreters (REPL kernels) whose
+// state survives from one execution to the next, as in a notebook.
+//
+// Each kernel is an interpreter running a small embedded driver. The agent
+// sends it code on fd 3 and reads structured messages (display outputs, the
+// value of the last expression, errors, completion) from fd 4, while plain
+// stdout and stderr are streamed from fds 1 and 2.
+package kernel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/angelorc/vmsan/agent/internal/cgroup"
+)
+
+//go:embed driver.py
+var pythonDriver string
+
+//go:embed driver.js
+var nodeDriver string
+
+// Supported languages.
+const (
+	LanguagePython = "python"
+	LanguageNode   = "node"
+)
+
+// Kernel states reported by Info.
+const (
+	StateStarting = "starting"
+	StateIdle     = "idle"
+	StateBusy     = "busy"
+	StateDead     = "dead"
+)
+
+// Execution statuses reported in a Reply.
+const (
+	StatusOK          = "ok"
+	StatusError       = "error"
+	StatusInterrupted = "interrupted"
+	StatusTimeout     = "timeout"
+	StatusDied        = "died"
+)
+
+// MaxKernels bounds the number of live kernels.
+const MaxKernels = 32
+
+// StartTimeout bounds how long an interpreter may take to become ready.
+var StartTimeout = 30 * time.Second
+
+// InterruptGrace is how long an interrupted execution (on timeout or client
+// disconnect) may take to stop before the kernel is killed.
+var InterruptGrace = 5 * time.Second
+
+// IdleTimeout is how long a kernel may go without executing code before
+// Sweep shuts it down.
+var IdleTimeout = time.Hour
+
+// SweepInterval is how often the agent calls Sweep.
+const SweepInterval = time.Minute
+
+var (
+	ErrTooMany             = errors.New("too many kernels")
+	ErrUnsupportedLanguage = errors.New("language must be python or node")
+	ErrDead                = errors.New("kernel is dead; restart it")
+	ErrRestarting          = errors.New("kernel is restarting")
+	ErrLimits              = errors.New("limits")
+)
+
+// Spawner builds the command that runs an interpreter. It is where the
+// caller applies the user, working directory and environment.
+type Spawner func(name string, args ...string) *exec.Cmd
+
+// Output is one piece of an execution's output.
+type Output struct {
+	Type   string         `json:"type"` // stdout, stderr, display, result or error
+	Data   string         `json:"data,omitempty"`
+	Bundle map[string]any `json:"bundle,omitempty"` // MIME type to data
+	Error  *Error         `json:"error,omitempty"`
+}
+
+// Error describes an exception raised by executed code.
+type Error struct {
+	Name      string   `json:"name"`
+	Value     string   `json:"value"`
+	Traceback []string `json:"traceback,omitempty"`
+}
+
+// Reply is the outcome of an execution.
+type Reply struct {
+	Status         string `json:"status"`
+	ExecutionCount int    `json:"executionCount,omitempty"`
+}
+
+// Kernel is a persistent interpreter.
+type Kernel struct {
+	ID        string
+	Language  string
+	User      string
+	CreatedAt time.Time
+
+	spawn     Spawner
+	limits    cgroup.Limits
+	slot      chan struct{} // held by the running execution
+	restartMu sync.Mutex
+
+	mu         sync.Mutex
+	proc       *process
+	state      string
+	version    string
+	executions int
+	lastUsed   time.Time
+}
+
+// Info is the exported struct for JSON serialization.
+type Info struct {
+	ID             string    `json:"id"`
+	Language       string    `json:"language"`
+	Version        string    `json:"version,omitempty"`
+	User           string    `json:"user,omitempty"`
+	State          string    `json:"state"`
+	PID            int       `json:"pid,omitempty"`
+	ExecutionCount int       `json:"executionCount"`
+	CreatedAt      time.Time `json:"createdAt"`
+	LastUsedAt     time.Time `json:"lastUsedAt"`
+}
+
+var (
+	mu       sync.RWMutex
+	kernels  = make(map[string]*Kernel)
+	starting int
+)
+
+func generateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Create starts a kernel for language and registers it once its interpreter
+// is ready. The interpreter runs in a cgroup leaf of its own, confined to
+// limits; the time limits are not enforced for kernels.
+func Create(language, user string, limits cgroup.Limits, spawn Spawner) (*Kernel, error) {
+	if language != LanguagePython && language != LanguageNode {
+		return nil, ErrUnsupportedLanguage
+	}
+	Sweep()
+
+	mu.Lock()
+	if len(kernels)+starting >= MaxKernels {
+		mu.Unlock()
+		return nil, ErrTooMany
+	}
+	starting++
+	mu.Unlock()
+
+	now := time.Now()
+	k := &Kernel{
+		ID:        generateID(),
+		Language:  language,
+		User:      user,
+		CreatedAt: now,
+		spawn:     spawn,
+		limits:    limits,
+		slot:      make(chan struct{}, 1),
+		lastUsed:  now,
+	}
+	p, version, err := k.start()
+
+	mu.Lock()
+	defer mu.Unlock()
+	starting--
+	if err != nil {
+		return nil, err
+	}
+	k.proc, k.version, k.state = p, version, StateIdle
+	kernels[k.ID] = k
+	return k, nil
+}
+
+// Get returns the kernel with the given ID, or nil.
+func Get(id string) *Kernel {
+	mu.RLock()
+	defer mu.RUnlock()
+	return kernels[id]
+}
+
+// List returns info for all kernels, oldest first.
+func List() []Info {
+	mu.RLock()
+	all := make([]*Kernel, 0, len(kernels))
+	for _, k := range kernels {
+		all = append(all, k)
+	}
+	mu.RUnlock()
+
+	result := make([]Info, 0, len(all))
+	for _, k := range all {
+		result = append(result, k.Info())
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].CreatedAt.Before(result[j].CreatedAt) })
+	return result
+}
+
+// Remove shuts a kernel down and forgets it. It reports whether the kernel
+// existed.
+func Remove(id string) bool {
+	mu.Lock()
+	k, ok := kernels[id]
+	delete(kernels, id)
+	mu.Unlock()
+	if ok {
+		k.mu.Lock()
+		p := k.proc
+		k.state = StateDead
+		k.mu.Unlock()
+		if p != nil {
+			p.kill()
+		}
+	}
+	return ok
+}
+
+// Sweep shuts down the kernels that have not executed code for longer than
+// IdleTimeout. Kernels with an execution running or waiting are kept.
+func Sweep() {
+	mu.RLock()
+	all := make([]*Kernel, 0, len(kernels))
+	for _, k := range kernels {
+		all = append(all, k)
+	}
+	mu.RUnlock()
+
+	for _, k := range all {
+		// Holding the slot keeps an execution from starting meanwhile.
+		select {
+		case k.slot <- struct{}{}:
+		default:
+			continue
+		}
+		k.mu.Lock()
+		idle := k.state != StateStarting && time.Since(k.lastUsed) > IdleTimeout
+		k.mu.Unlock()
+		if idle {
+			Remove(k.ID)
+		}
+		<-k.slot
+	}
+}
+
+// Info returns an exported Info for JSON serialization.
+func (k *Kernel) Info() Info {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	info := Info{
+		ID:             k.ID,
+		Language:       k.Language,
+		Version:        k.version,
+		User:           k.User,
+		State:          k.state,
+		ExecutionCount: k.executions,
+		CreatedAt:      k.CreatedAt,
+		LastUsedAt:     k.lastUsed,
+	}
+	if k.state == StateIdle || k.state == StateBusy {
+		info.PID = k.proc.cmd.Process.Pid
+	}
+	return info
+}
+
+// Execute runs code in the kernel, passing its output to emit as it is
+// produced, and returns once the code has finished. Executions run one at a
+// time; others wait their turn until ctx is done. If timeout elapses or ctx
+// is done while the code runs, it is interrupted, and the kernel is killed
+// if it does not stop within InterruptGrace.
+func (k *Kernel) Execute(ctx context.Context, code string, timeout time.Duration, emit func(Output)) (Reply, error) {
+	select {
+	case k.slot <- struct{}{}:
+	case <-ctx.Done():
+		return Reply{}, ctx.Err()
+	}
+	defer func() { <-k.slot }()
+
+	k.mu.Lock()
+	p := k.proc
+	switch k.state {
+	case StateDead:
+		k.mu.Unlock()
+		return Reply{}, ErrDead
+	case StateStarting:
+		k.mu.Unlock()
+		return Reply{}, ErrRestarting
+	}
+	k.state = StateBusy
+	k.lastUsed = time.Now()
+	k.mu.Unlock()
+
+	x := &execution{emit: emit, token: newToken(), sentinels: make(chan struct{}, 2)}
+	p.setCurrent(x)
+	defer p.setCurrent(nil)
+
+	req, _ := json.Marshal(struct {
+		Code  string `json:"code"`
+		Token string `json:"token"`
+	}{code, string(x.token)})
+	if _, err := p.requests.Write(append(req, '\n')); err != nil {
+		return k.died(p, x, Reply{Status: StatusDied}), nil
+	}
+
+	var deadline, escalate <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	cancelled := ctx.Done()
+	interrupt := func() {
+		p.interrupt()
+		if escalate == nil {
+			escalate = time.After(InterruptGrace)
+		}
+	}
+
+	var reply Reply
+	status := ""
+	done, sentinels := false, 0
+	for !done || sentinels < 2 {
+		select {
+		case m, ok := <-p.messages:
+			if !ok {
+				if status == "" {
+					status = StatusDied
+				}
+				return k.died(p, x, Reply{Status: status}), nil
+			}
+			switch m.Type {
+			case "display", "result":
+				x.output(Output{Type: m.Type, Bundle: m.Bundle})
+			case "error":
+				x.output(Output{Type: m.Type, Error: &Error{Name: m.Name, Value: m.Value, Traceback: m.Traceback}})
+			case "done":
+				done = true
+				reply = Reply{Status: m.Status, ExecutionCount: m.ExecutionCount}
+			}
+		case <-x.sentinels:
+			sentinels++
+		case <-deadline:
+			deadline = nil
+			status = StatusTimeout
+			interrupt()
+		case <-cancelled:
+			cancelled = nil
+			if status == "" {
+				status = StatusInterrupted
+			}
+			interrupt()
+		case <-escalate:
+			escalate = nil
+			p.kill()
+		}
+	}
+	if status != "" && reply.Status != StatusOK {
+		reply.Status = status
+	}
+
+	k.mu.Lock()
+	if k.proc == p {
+		k.state = StateIdle
+		k.executions = reply.ExecutionCount
+	}
+	k.lastUsed = time.Now()
+	k.mu.Unlock()
+	return reply, nil
+}
+
+// died handles the interpreter going away during an execution: it makes
+// sure the whole process group is gone, delivers the output still in the
+// pipes and marks the kernel dead unless it was restarted meanwhile.
+func (k *Kernel) died(p *process, x *execution, reply Reply) Reply {
+	p.kill()
+	p.drain(time.Second)
+	x.output(Output{Type: "error", Error: &Error{Name: "KernelDied", Value: p.exitStatus()}})
+	k.mu.Lock()
+	if k.proc == p {
+		k.state = StateDead
+	}
+	k.lastUsed = time.Now()
+	k.mu.Unlock()
+	return reply
+}
+
+// Interrupt sends SIGINT to the interpreter, which stops the running
+// execution with a KeyboardInterrupt (Python) or an interrupted error
+// (Node). It does nothing while the kernel is idle.
+func (k *Kernel) Interrupt() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	switch k.state {
+	case StateDead:
+		return ErrDead
+	case StateStarting:
+		return ErrRestarting
+	case StateBusy:
+		k.proc.interrupt()
+	}
+	return nil
+}
+
+// Restart kills the interpreter, ending any running execution, and starts a
+// fresh one with empty state.
+func (k *Kernel) Restart() error {
+	k.restartMu.Lock()
+	defer k.restartMu.Unlock()
+
+	k.mu.Lock()
+	old := k.proc
+	k.state = StateStarting
+	k.mu.Unlock()
+	if old != nil {
+		old.kill()
+		<-old.exited
+	}
+
+	p, version, err := k.start()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.lastUsed = time.Now()
+	if err != nil {
+		k.state = StateDead
+		return err
+	}
+	k.proc, k.version, k.state, k.executions = p, version, StateIdle, 0
+	return nil
+}
+
+// start launches the interpreter and waits for its driver to report ready.
+func (k *Kernel) start() (*process, string, error) {
+	var cmd *exec.Cmd
+	switch k.Language {
+	case LanguagePython:
+		cmd = k.spawn("python3", "-u", "-c", pythonDriver)
+	case LanguageNode:
+		cmd = k.spawn("node", "-e", nodeDriver)
+	}
+	if cmd.Env == nil {
+		cmd.Env = cmd.Environ()
+	}
+	cmd.Env = append(cmd.Env, "PYTHONUNBUFFERED=1")
+	if !hasEnv(cmd.Env, "MPLBACKEND") {
+		cmd.Env = append(cmd.Env, "MPLBACKEND=Agg")
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	// Without cgroup v2 kernels still start, unless limits were asked for.
+	cg, err := cgroup.New("kernel", k.limits)
+	if err != nil {
+		if k.limits.NeedsCgroup() {
+			return nil, "", fmt.Errorf("%w: %s", ErrLimits, err)
+		}
+		cg = nil
+	}
+	if cg != nil {
+		cgFile, err := cg.Open()
+		if err != nil {
+			cg.Remove()
+			return nil, "", fmt.Errorf("open cgroup: %w", err)
+		}
+		defer cgFile.Close()
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgFile.Fd())
+	}
+
+	p, err := startProcess(cmd, cg)
+	if err != nil {
+		if cg != nil {
+			cg.Remove()
+		}
+		return nil, "", err
+	}
+	timer := time.NewTimer(StartTimeout)
+	defer timer.Stop()
+	select {
+	case m, ok := <-p.messages:
+		if ok && m.Type == "ready" {
+			return p, m.Version, nil
+		}
+	case <-timer.C:
+	}
+	p.kill()
+	p.drain(time.Second)
+	msg := "interpreter did not start: " + p.exitStatus()
+	if out := strings.TrimSpace(p.stderrTail()); out != "" {
+		msg += ": " + out
+	}
+	return nil, "", errors.New(msg)
+}
+
+func hasEnv(env []string, key string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, key+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+func newToken() []byte {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return []byte("\x00vmsan-kernel-" + hex.EncodeToString(b) + "\x00")
+}
+
+// message is a line sent by the driver on fd 4.
+type message struct {
+	Type           string         `json:"type"`
+	Version        string         `json:"version"`
+	Bundle         map[string]any `json:"bundle"`
+	Name           string         `json:"name"`
+	Value          string         `json:"value"`
+	Traceback      []string       `json:"traceback"`
+	Status         string         `json:"status"`
+	ExecutionCount int            `json:"executionCount"`
+}
+
+// execution routes the output of the running code to its caller.
+type execution struct {
+	mu        sync.Mutex
+	emit      func(Output)
+	token     []byte
+	sentinels chan struct{}
+	seen      [2]bool // token seen on stdout, stderr; guarded by process.mu
+	replied   bool    // done message passed on; guarded by process.mu
+}
+
+func (x *execution) output(o Output) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.emit(o)
+}
+
+// stderrTailBytes bounds the stderr kept from outside executions, which is
+// reported if the interpreter fails to start.
+const stderrTailBytes = 4096
+
+// process is one run of an interpreter.
+type process struct {
+	cmd      *exec.Cmd
+	requests *os.File
+	messages chan message
+	exited   chan struct{}
+	pumps    sync.WaitGroup
+
+	mu      sync.Mutex
+	current *execution
+	ready   bool
+	tail    []byte
+}
+
+// startProcess starts cmd. cg, if not nil, is the cgroup leaf cmd starts
+// in; it is removed once the interpreter has exited.
+func startProcess(cmd *exec.Cmd, cg *cgroup.Group) (*process, error) {
+	var parent, child []*os.File
+	closeAll := func(files []*os.File) {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	pipe := func() (r, w *os.File) {
+		r, w, err := os.Pipe()
+		if err == nil {
+			parent, child = append(parent, r), append(child, w)
+		}
+		return r, w
+	}
+	stdoutR, stdoutW := pipe()
+	stderrR, stderrW := pipe()
+	msgR, msgW := pipe()
+	reqR, reqW, err := os.Pipe()
+	if err != nil || len(parent) != 3 {
+		closeAll(parent)
+		closeAll(child)
+		return nil, fmt.Errorf("create pipes: %w", err)
+	}
+	parent, child = append(parent, reqW), append(child, reqR)
+
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	cmd.ExtraFiles = []*os.File{reqR, msgW}
+	if err := cmd.Start(); err != nil {
+		closeAll(parent)
+		closeAll(child)
+		return nil, err
+	}
+	closeAll(child)
+
+	p := &process{
+		cmd:      cmd,
+		requests: reqW,
+		messages: make(chan message, 64),
+		exited:   make(chan struct{}),
+	}
+	p.pumps.Add(2)
+	go p.pump(stdoutR, 0)
+	go p.pump(stderrR, 1)
+	go p.readMessages(msgR)
+	go func() {
+		cmd.Wait()
+		reqW.Close()
+		if cg != nil {
+			cg.Remove()
+		}
+		close(p.exited)
+	}()
+	return p, nil
+}
+
+func (p *process) readMessages(r *os.File) {
+	defer close(p.messages)
+	defer r.Close()
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			var m message
+			if json.Unmarshal(line, &m) == nil && p.accept(m) {
+				p.messages <- m
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// accept reports whether m is to be passed on: the ready message, or a
+// message of the running execution up to its done message. Messages sent
+// while no execution is in flight, e.g. by a timer or thread the code left
+// behind, are dropped, so they neither fill the channel nor end up in the
+// next execution's output.
+func (p *process) accept(m message) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if m.Type == "ready" && !p.ready {
+		p.ready = true
+		return true
+	}
+	x := p.current
+	if x == nil || x.replied {
+		return false
+	}
+	if m.Type == "done" {
+		x.replied = true
+	}
+	return true
+}
+
+func (p *process) setCurrent(x *execution) {
+	p.mu.Lock()
+	p.current = x
+	p.mu.Unlock()
+}
+
+// pump streams fd 1 (stream 0) or fd 2 (stream 1) to the running
+// execution until the pipe closes.
+func (p *process) pump(r *os.File, stream int) {
+	defer p.pumps.Done()
+	defer r.Close()
+	buf := make([]byte, 32*1024)
+	var pending []byte
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			pending = p.deliver(stream, append(pending, buf[:n]...), false)
+		}
+		if err != nil {
+			p.deliver(stream, pending, true)
+			return
+		}
+	}
+}
+
+// deliver passes data to the running execution, stopping at the execution's
+// token, and returns the bytes it held back: a possible start of the token
+// or an incomplete UTF-8 sequence, unless final is set.
+func (p *process) deliver(stream int, data []byte, final bool) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	x := p.current
+	if x != nil && x.seen[stream] {
+		x = nil
+	}
+	if x == nil {
+		if stream == 1 {
+			p.tail = append(p.tail, data...)
+			if len(p.tail) > stderrTailBytes {
+				p.tail = p.tail[len(p.tail)-stderrTailBytes:]
+			}
+		}
+		return nil
+	}
+
+	keep := 0
+	if i := bytes.Index(data, x.token); i >= 0 {
+		x.seen[stream] = true
+		x.sentinels <- struct{}{}
+		data = data[:i]
+	} else if !final {
+		keep = holdBack(data, x.token)
+	}
+	if out := data[:len(data)-keep]; len(out) > 0 {
+		typ := "stdout"
+		if stream == 1 {
+			typ = "stderr"
+		}
+		x.output(Output{Type: typ, Data: string(out)})
+	}
+	return append([]byte(nil), data[len(data)-keep:]...)
+}
+
+// holdBack returns how many trailing bytes of data must wait for more input:
+// those that could begin token, or an incomplete UTF-8 sequence.
+func holdBack(data, token []byte) int {
+	for k := min(len(token)-1, len(data)); k > 0; k-- {
+		if bytes.HasSuffix(data, token[:k]) {
+			return k
+		}
+	}
+	for k := 1; k <= utf8.UTFMax && k <= len(data); k++ {
+		if utf8.RuneStart(data[len(data)-k]) {
+			if !utf8.FullRune(data[len(data)-k:]) {
+				return k
+			}
+			break
+		}
+	}
+	return 0
+}
+
+func (p *process) stderrTail() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return string(p.tail)
+}
+
+func (p *process) interrupt() {
+	p.cmd.Process.Signal(syscall.SIGINT)
+}
+
+// kill kills the interpreter's process group.
+func (p *process) kill() {
+	syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// drain waits up to timeout for the interpreter to exit and its output
+// pipes to be read to the end.
+func (p *process) drain(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		<-p.exited
+		p.pumps.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+// exitStatus describes how the interpreter exited.
+func (p *process) exitStatus() string {
+	select {
+	case <-p.exited:
+	default:
+		return "interpreter is not responding"
+	}
+	if state := p.cmd.ProcessState; state != nil {
+		return "interpreter " + state.String()
+	}
+	return "interpreter exited"
+}
@@ -0,0 +1,193 @@
+package kernel
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/cgroup"
+)
+
+func startKernel(t *testing.T, language, binary string) *Kernel {
+	t.Helper()
+	if _, err := exec.LookPath(binary); err != nil {
+		t.Skipf("%s not available", binary)
+	}
+	k, err := Create(language, "", cgroup.Limits{}, exec.Command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Remove(k.ID) })
+	return k
+}
+
+func execute(t *testing.T, k *Kernel, code string, timeout time.Duration) (Reply, []Output) {
+	t.Helper()
+	var outputs []Output
+	reply, err := k.Execute(context.Background(), code, timeout, func(o Output) { outputs = append(outputs, o) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply, outputs
+}
+
+func collect(outputs []Output, typ string) string {
+	var b strings.Builder
+	for _, o := range outputs {
+		if o.Type == typ {
+			b.WriteString(o.Data)
+		}
+	}
+	return b.String()
+}
+
+func find(outputs []Output, typ string) *Output {
+	for i := range outputs {
+		if outputs[i].Type == typ {
+			return &outputs[i]
+		}
+	}
+	return nil
+}
+
+func TestPythonKernel_StateOutputAndResult(t *testing.T) {
+	k := startKernel(t, LanguagePython, "python3")
+
+	if reply, _ := execute(t, k, "x = 40", 0); reply.Status != StatusOK || reply.ExecutionCount != 1 {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	reply, outputs := execute(t, k, "import os, sys\nprint('hi')\nos.system('echo from-child')\nprint('oops', file=sys.stderr)\nx + 2", 0)
+	if reply.Status != StatusOK {
+		t.Fatalf("unexpected reply %+v: %+v", reply, outputs)
+	}
+	if got := collect(outputs, "stdout"); got != "hi\nfrom-child\n" {
+		t.Fatalf("unexpected stdout %q", got)
+	}
+	if got := collect(outputs, "stderr"); got != "oops\n" {
+		t.Fatalf("unexpected stderr %q", got)
+	}
+	result := find(outputs, "result")
+	if result == nil || result.Bundle["text/plain"] != "42" {
+		t.Fatalf("expected result 42, got %+v", outputs)
+	}
+
+	_, outputs = execute(t, k, "class H:\n    def _repr_html_(self): return '<b>h</b>'\ndisplay(H())", 0)
+	display := find(outputs, "display")
+	if display == nil || display.Bundle["text/html"] != "<b>h</b>" {
+		t.Fatalf("expected an html display, got %+v", outputs)
+	}
+
+	reply, outputs = execute(t, k, "1/0", 0)
+	if e := find(outputs, "error"); reply.Status != StatusError || e == nil || e.Error.Name != "ZeroDivisionError" {
+		t.Fatalf("expected a ZeroDivisionError, got %+v %+v", reply, outputs)
+	}
+}
+
+func TestPythonKernel_TimeoutInterruptsAndRestartClearsState(t *testing.T) {
+	k := startKernel(t, LanguagePython, "python3")
+
+	execute(t, k, "x = 1", 0)
+	reply, outputs := execute(t, k, "import time\nwhile True: time.sleep(0.01)", 200*time.Millisecond)
+	if e := find(outputs, "error"); reply.Status != StatusTimeout || e == nil || e.Error.Name != "KeyboardInterrupt" {
+		t.Fatalf("expected an interrupted timeout, got %+v %+v", reply, outputs)
+	}
+	if _, outputs = execute(t, k, "x", 0); find(outputs, "result") == nil {
+		t.Fatal("expected state to survive an interrupt")
+	}
+
+	if err := k.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	reply, outputs = execute(t, k, "x", 0)
+	if e := find(outputs, "error"); reply.Status != StatusError || e == nil || e.Error.Name != "NameError" {
+		t.Fatalf("expected restart to clear state, got %+v %+v", reply, outputs)
+	}
+}
+
+func TestNodeKernel_StateOutputAndResult(t *testing.T) {
+	k := startKernel(t, LanguageNode, "node")
+
+	execute(t, k, "var x = 40; let y = 2", 0)
+	reply, outputs := execute(t, k, "console.log('hi'); Promise.resolve(x + y)", 0)
+	if reply.Status != StatusOK || collect(outputs, "stdout") != "hi\n" {
+		t.Fatalf("unexpected reply %+v: %+v", reply, outputs)
+	}
+	if result := find(outputs, "result"); result == nil || result.Bundle["text/plain"] != "42" {
+		t.Fatalf("expected result 42, got %+v", outputs)
+	}
+
+	reply, outputs = execute(t, k, "while (true) {}", 200*time.Millisecond)
+	if reply.Status != StatusTimeout || find(outputs, "error") == nil {
+		t.Fatalf("expected an interrupted timeout, got %+v %+v", reply, outputs)
+	}
+	if k.Info().State != StateIdle {
+		t.Fatalf("expected the kernel to survive an interrupt, got %s", k.Info().State)
+	}
+}
+
+func TestNodeKernel_DropsMessagesBetweenExecutions(t *testing.T) {
+	k := startKernel(t, LanguageNode, "node")
+
+	// More leftover displays than the message channel holds.
+	execute(t, k, "setTimeout(() => { for (let i = 0; i < 200; i++) display('late ' + i) }, 100)", 0)
+	time.Sleep(500 * time.Millisecond)
+
+	reply, outputs := execute(t, k, "display('now')", 5*time.Second)
+	if reply.Status != StatusOK {
+		t.Fatalf("unexpected reply %+v", reply)
+	}
+	if len(outputs) != 1 || outputs[0].Bundle["text/plain"] != "'now'" {
+		t.Fatalf("expected only the current display, got %+v", outputs)
+	}
+}
+
+func TestSweep_ShutsDownIdleKernels(t *testing.T) {
+	idle := startKernel(t, LanguagePython, "python3")
+	used := startKernel(t, LanguagePython, "python3")
+
+	for _, k := range []*Kernel{idle, used} {
+		k.mu.Lock()
+		k.lastUsed = time.Now().Add(-IdleTimeout - time.Minute)
+		k.mu.Unlock()
+	}
+	execute(t, used, "1", 0)
+	Sweep()
+
+	if Get(idle.ID) != nil || Get(used.ID) == nil {
+		t.Fatal("expected only the idle kernel to be shut down")
+	}
+	if info := idle.Info(); info.State != StateDead {
+		t.Fatalf("expected the idle kernel to be dead, got %q", info.State)
+	}
+}
+
+func TestCreate_RefusesLimitsWithoutCgroups(t *testing.T) {
+	if cgroup.Available() {
+		t.Skip("cgroup v2 is available")
+	}
+	if _, err := Create(LanguagePython, "", cgroup.Limits{PidsMax: 16}, exec.Command); !errors.Is(err, ErrLimits) {
+		t.Fatalf("expected limits to be refused without cgroup v2, got %v", err)
+	}
+}
+
+func TestHoldBack(t *testing.T) {
+	token := []byte("\x00tok\x00")
+	cases := []struct {
+		data string
+		want int
+	}{
+		{"abc", 0},
+		{"abc\x00", 1},
+		{"abc\x00to", 3},
+		{"abc\xe2\x82", 2}, // incomplete euro sign
+		{"abc\xe2\x82\xac", 0},
+	}
+	for _, c := range cases {
+		if got := holdBack([]byte(c.data), token); got != c.want {
+			t.Errorf("holdBack(%q) = %d, want %d", c.data, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Package outlog keeps a bounded, offset-addressed log of command output so
+// that clients can replay it and follow new output as it is produced.
+package outlog
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Chunk is a contiguous piece of output read from one stream.
+type Chunk struct {
+	Stream string
+	Offset int64 // byte offset of Data[0], counted across all streams
+	Data   []byte
+	Time   time.Time
+}
+
+// Log is a ring buffer of output chunks. Once more than maxBytes are
+// retained, the oldest chunks are evicted; offsets keep counting so readers
+// can detect the gap.
+type Log struct {
+	mu       sync.Mutex
+	maxBytes int
+	chunks   []Chunk
+	size     int
+	next     int64
+	written  map[string]int64
+	closed   bool
+	notify   chan struct{}
+}
+
+// New creates an empty Log retaining at most maxBytes of output.
+func New(maxBytes int) *Log {
+	return &Log{maxBytes: maxBytes, written: make(map[string]int64), notify: make(chan struct{})}
+}
+
+// Append copies p into the log as output of the given stream, wakes any
+// followers and returns the offset assigned to p[0]. Appending to a closed
+// log is a no-op.
+func (l *Log) Append(stream string, p []byte) int64 {
+	data := make([]byte, len(p))
+	copy(data, p)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	offset := l.next
+	if l.closed || len(p) == 0 {
+		return offset
+	}
+	l.chunks = append(l.chunks, Chunk{Stream: stream, Offset: offset, Data: data, Time: time.Now()})
+	l.next += int64(len(data))
+	l.written[stream] += int64(len(data))
+	l.size += len(data)
+	l.evict()
+	l.wake()
+	return offset
+}
+
+// evict drops the oldest output until the log fits in maxBytes. A single
+// oversized chunk is trimmed from the front rather than dropped entirely.
+func (l *Log) evict() {
+	for l.size > l.maxBytes && len(l.chunks) > 0 {
+		first := &l.chunks[0]
+		excess := l.size - l.maxBytes
+		if excess < len(first.Data) {
+			first.Data = first.Data[excess:]
+			first.Offset += int64(excess)
+			l.size -= excess
+			return
+		}
+		l.size -= len(first.Data)
+		l.chunks[0] = Chunk{}
+		l.chunks = l.chunks[1:]
+	}
+}
+
+// wake releases everyone blocked on the current notify channel. Callers must
+// hold l.mu.
+func (l *Log) wake() {
+	close(l.notify)
+	l.notify = make(chan struct{})
+}
+
+// Writer returns an io.Writer that appends to the log under stream.
+func (l *Log) Writer(stream string) io.Writer {
+	return streamWriter{log: l, stream: stream}
+}
+
+type streamWriter struct {
+	log    *Log
+	stream string
+}
+
+func (w streamWriter) Write(p []byte) (int, error) {
+	w.log.Append(w.stream, p)
+	return len(p), nil
+}
+
+// Read returns the retained chunks at or after offset, the offset to pass to
+// the next Read, and whether the log is closed. When offset points before the
+// oldest retained byte, reading resumes at the oldest retained chunk.
+func (l *Log) Read(offset int64) (chunks []Chunk, next int64, closed bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.chunks {
+		end := c.Offset + int64(len(c.Data))
+		if end <= offset {
+			continue
+		}
+		if c.Offset < offset {
+			skip := offset - c.Offset
+			c.Data = c.Data[skip:]
+			c.Offset = offset
+		}
+		chunks = append(chunks, c)
+	}
+	next = offset
+	if next < l.next {
+		next = l.next
+	}
+	return chunks, next, l.closed
+}
+
+// Written returns the total number of bytes ever appended for stream,
+// including bytes since evicted.
+func (l *Log) Written(stream string) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.written[stream]
+}
+
+// Wait returns a channel that is closed on the next Append or Close. Obtain
+// it before calling Read to avoid missing output written in between.
+func (l *Log) Wait() <-chan struct{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		ch := make(chan struct{})
+		close(ch)
+		return ch
+	}
+	return l.notify
+}
+
+// Close marks the log as complete and wakes all followers.
+func (l *Log) Close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+	l.wake()
+}
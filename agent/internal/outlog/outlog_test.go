@@ -0,0 +1,95 @@
+package outlog
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLog_ReadFromOffset(t *testing.T) {
+	l := New(1024)
+	l.Append("stdout", []byte("hello "))
+	l.Append("stderr", []byte("world"))
+
+	chunks, next, closed := l.Read(0)
+	if len(chunks) != 2 {
+		t.Fatalf("expected 2 chunks, got %d", len(chunks))
+	}
+	if next != 11 {
+		t.Fatalf("expected next offset 11, got %d", next)
+	}
+	if closed {
+		t.Fatal("expected log to be open")
+	}
+
+	chunks, _, _ = l.Read(3)
+	if string(chunks[0].Data) != "lo " || chunks[0].Offset != 3 {
+		t.Fatalf("expected partial first chunk at offset 3, got %q at %d", chunks[0].Data, chunks[0].Offset)
+	}
+	if chunks[1].Stream != "stderr" || chunks[1].Offset != 6 {
+		t.Fatalf("expected stderr chunk at offset 6, got %s at %d", chunks[1].Stream, chunks[1].Offset)
+	}
+}
+
+func TestLog_AppendReturnsOffset(t *testing.T) {
+	l := New(1024)
+	if off := l.Append("stdout", []byte("abc")); off != 0 {
+		t.Fatalf("expected first offset 0, got %d", off)
+	}
+	if off := l.Append("stderr", []byte("de")); off != 3 {
+		t.Fatalf("expected second offset 3, got %d", off)
+	}
+	if off := l.Append("stdout", nil); off != 5 {
+		t.Fatalf("expected empty append to report next offset 5, got %d", off)
+	}
+}
+
+func TestLog_EvictsOldestOutput(t *testing.T) {
+	l := New(8)
+	l.Append("stdout", []byte("aaaa"))
+	l.Append("stdout", []byte("bbbb"))
+	l.Append("stdout", []byte("cccccc"))
+
+	chunks, next, _ := l.Read(0)
+	if next != 14 {
+		t.Fatalf("expected next offset 14, got %d", next)
+	}
+	var got string
+	for _, c := range chunks {
+		got += string(c.Data)
+	}
+	if got != "bbcccccc" {
+		t.Fatalf("expected last 8 bytes retained, got %q", got)
+	}
+	if chunks[0].Offset != 6 {
+		t.Fatalf("expected oldest retained offset 6, got %d", chunks[0].Offset)
+	}
+	if w := l.Written("stdout"); w != 14 {
+		t.Fatalf("expected 14 bytes written including evicted, got %d", w)
+	}
+}
+
+func TestLog_WaitWakesOnAppendAndClose(t *testing.T) {
+	l := New(64)
+
+	ch := l.Wait()
+	go l.Append("stdout", []byte("x"))
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("expected Wait channel to close on Append")
+	}
+
+	ch = l.Wait()
+	l.Close()
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("expected Wait channel to close on Close")
+	}
+
+	l.Append("stdout", []byte("ignored"))
+	_, next, closed := l.Read(0)
+	if !closed || next != 1 {
+		t.Fatalf("expected closed log with next=1, got closed=%v next=%d", closed, next)
+	}
+}
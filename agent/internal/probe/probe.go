@@ -0,0 +1,139 @@
+// Package probe checks readiness conditions inside the guest: a listening
+// TCP port, a healthy HTTP endpoint, a file (optionally with some content)
+// or a running process. Each check returns nil when the condition holds and
+// otherwise an error saying why not.
+package probe
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/angelorc/vmsan/agent/internal/procfs"
+)
+
+// MaxFileBytes bounds how much of a file is searched for a pattern.
+const MaxFileBytes = 16 << 20 // 16MB
+
+// TCP checks that a connection to addr (host:port) is accepted.
+func TCP(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+// HTTP checks that a GET of url, following redirects, returns status, or
+// any 2xx status if status is 0.
+func HTTP(ctx context.Context, client *http.Client, url string, status int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	if status != 0 && resp.StatusCode != status {
+		return fmt.Errorf("status %d, want %d", resp.StatusCode, status)
+	}
+	if status == 0 && (resp.StatusCode < 200 || resp.StatusCode > 299) {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// File checks that path exists and is a regular file and, if pattern is
+// non-nil, that its first MaxFileBytes contain a match. It never opens
+// anything else, since opening a FIFO or a device can block indefinitely,
+// and it stops reading once ctx is done.
+func File(ctx context.Context, path string, pattern *regexp.Regexp) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	// O_NONBLOCK in case path was replaced since the Stat.
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if fi, err = f.Stat(); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New("not a regular file")
+	}
+	if pattern == nil {
+		return nil
+	}
+	var data []byte
+	buf := make([]byte, 64*1024)
+	for len(data) < MaxFileBytes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		n, err := f.Read(buf[:min(len(buf), MaxFileBytes-len(data))])
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !pattern.Match(data) {
+		return errors.New("pattern not found")
+	}
+	return nil
+}
+
+// Process checks that a live (non-zombie) process exists whose name is name
+// and whose command line matches pattern. Either may be empty or nil to
+// match any. The name is compared to both the kernel's command name and the
+// base name of argv[0], since the former is truncated to 15 bytes. It
+// returns the matching process IDs.
+func Process(name string, pattern *regexp.Regexp) ([]int, error) {
+	stats, err := procfs.Processes()
+	if err != nil {
+		return nil, err
+	}
+	self := os.Getpid()
+	var pids []int
+	for _, st := range stats {
+		if st.State == 'Z' || st.PID == self {
+			continue
+		}
+		args, err := procfs.ReadCmdline(st.PID)
+		if err != nil {
+			continue
+		}
+		if name != "" && st.Comm != name && (len(args) == 0 || filepath.Base(args[0]) != name) {
+			continue
+		}
+		if pattern != nil && !pattern.MatchString(strings.Join(args, " ")) {
+			continue
+		}
+		pids = append(pids, st.PID)
+	}
+	if len(pids) == 0 {
+		return nil, errors.New("no matching process")
+	}
+	return pids, nil
+}
@@ -0,0 +1,55 @@
+package probe
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestFile_RejectsFIFOWithoutBlocking(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fifo")
+	if err := syscall.Mkfifo(path, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- File(context.Background(), path, nil) }()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected a FIFO to fail the check")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("File blocked on a FIFO")
+	}
+}
+
+func TestProcess_MatchesNameAndCommandLine(t *testing.T) {
+	cmd := exec.Command("sleep", "30.5")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	// The child may not have exec'd sleep yet.
+	var pids []int
+	var err error
+	for i := 0; i < 100; i++ {
+		if pids, err = Process("sleep", regexp.MustCompile(`30\.5`)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil || len(pids) != 1 || pids[0] != cmd.Process.Pid {
+		t.Fatalf("expected only pid %d, got %v, %v", cmd.Process.Pid, pids, err)
+	}
+	if _, err := Process("sleep", regexp.MustCompile(`^nothing like this$`)); err == nil {
+		t.Fatal("expected no match for a different command line")
+	}
+}
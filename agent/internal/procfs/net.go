@@ -0,0 +1,147 @@
+package procfs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Socket states from include/net/tcp_states.h. Unconnected UDP sockets are
+// reported as TCPClose.
+const (
+	TCPListen = 0x0A
+	TCPClose  = 0x07
+)
+
+// Socket is an entry of /proc/net/{tcp,tcp6,udp,udp6}.
+type Socket struct {
+	LocalIP    net.IP
+	LocalPort  int
+	RemoteIP   net.IP
+	RemotePort int
+	State      int
+	UID        int
+	Inode      uint64
+}
+
+// ParseNet parses the contents of a /proc/net/{tcp,tcp6,udp,udp6} table.
+func ParseNet(data []byte) ([]Socket, error) {
+	var sockets []Socket
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		local, localPort, err := parseNetAddr(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("local address %q: %w", fields[1], err)
+		}
+		remote, remotePort, err := parseNetAddr(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("remote address %q: %w", fields[2], err)
+		}
+		state, err := strconv.ParseUint(fields[3], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("state %q: %w", fields[3], err)
+		}
+		uid, err := strconv.Atoi(fields[7])
+		if err != nil {
+			return nil, fmt.Errorf("uid %q: %w", fields[7], err)
+		}
+		inode, err := strconv.ParseUint(fields[9], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("inode %q: %w", fields[9], err)
+		}
+		sockets = append(sockets, Socket{
+			LocalIP:    local,
+			LocalPort:  localPort,
+			RemoteIP:   remote,
+			RemotePort: remotePort,
+			State:      int(state),
+			UID:        uid,
+			Inode:      inode,
+		})
+	}
+	return sockets, scanner.Err()
+}
+
+// parseNetAddr parses an "ADDR:PORT" pair as printed by the kernel: the
+// address is hex, one 32-bit word at a time, each word being the number the
+// address bytes form in host byte order.
+func parseNetAddr(s string) (net.IP, int, error) {
+	addr, port, ok := strings.Cut(s, ":")
+	if !ok {
+		return nil, 0, fmt.Errorf("missing port")
+	}
+	raw, err := hex.DecodeString(addr)
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0, fmt.Errorf("invalid address")
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		binary.NativeEndian.PutUint32(ip[i:], binary.BigEndian.Uint32(raw[i:]))
+	}
+	p, err := strconv.ParseUint(port, 16, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port")
+	}
+	return ip, int(p), nil
+}
+
+// ReadNet reads /proc/net/<table>, e.g. "tcp6". A table that does not exist
+// (such as tcp6 without IPv6 support) is empty.
+func ReadNet(table string) ([]Socket, error) {
+	data, err := os.ReadFile(filepath.Join(Root, "net", table))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseNet(data)
+}
+
+// SocketOwners maps socket inodes to the lowest PID holding them open,
+// found by scanning /proc/<pid>/fd. Processes that cannot be inspected are
+// skipped.
+func SocketOwners() (map[uint64]int, error) {
+	entries, err := os.ReadDir(Root)
+	if err != nil {
+		return nil, err
+	}
+	owners := make(map[uint64]int)
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		fdDir := filepath.Join(Root, e.Name(), "fd")
+		fds, err := os.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+			inode, err := strconv.ParseUint(strings.TrimSuffix(link[len("socket:["):], "]"), 10, 64)
+			if err != nil {
+				continue
+			}
+			if owner, ok := owners[inode]; !ok || pid < owner {
+				owners[inode] = pid
+			}
+		}
+	}
+	return owners, nil
+}
@@ -0,0 +1,44 @@
+package procfs
+
+import "testing"
+
+func TestParseNet_IPv4AndIPv6(t *testing.T) {
+	tcp := []byte(`  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000:07E8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 662 1 00000000102a1f79 100 0 0 10 0
+   1: 0100007F:923A 0100007F:BC8F 01 00000000:00000000 02:000003B3 00000000  1000        0 28723 2 000000005477d044 20 4 26 16 8
+`)
+	sockets, err := ParseNet(tcp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sockets) != 2 {
+		t.Fatalf("expected 2 sockets, got %d", len(sockets))
+	}
+	if s := sockets[0]; s.LocalIP.String() != "0.0.0.0" || s.LocalPort != 2024 || s.State != TCPListen || s.Inode != 662 {
+		t.Fatalf("unexpected listener %+v", s)
+	}
+	if s := sockets[1]; s.LocalIP.String() != "127.0.0.1" || s.LocalPort != 37434 || s.RemotePort != 48271 || s.UID != 1000 {
+		t.Fatalf("unexpected connection %+v", s)
+	}
+
+	tcp6 := []byte(`  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000001000000:23F1 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 36336 1 00000000779e6eba 100 0 0 10 0
+   1: 0000000000000000FFFF00000100007F:23F1 0000000000000000FFFF00000100007F:EA80 06 00000000:00000000 03:0000068A 00000000     0        0 0 3 000000008e75c35d
+`)
+	sockets, err = ParseNet(tcp6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := sockets[0]; s.LocalIP.String() != "::1" || s.LocalPort != 9201 {
+		t.Fatalf("unexpected ipv6 listener %+v", s)
+	}
+	if s := sockets[1]; s.LocalIP.String() != "127.0.0.1" {
+		t.Fatalf("expected a v4-mapped address, got %+v", s)
+	}
+}
+
+func TestParseNet_Malformed(t *testing.T) {
+	if _, err := ParseNet([]byte("header\n 0: zz:0 00000000:0000 0A 0 0 0 0 0 1\n")); err == nil {
+		t.Fatal("expected an error for a malformed address")
+	}
+}
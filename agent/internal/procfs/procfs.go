@@ -0,0 +1,218 @@
+// Package procfs reads process information from /proc.
+package procfs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Root is the procfs mount point. Tests may point it at a fixture tree.
+var Root = "/proc"
+
+// ClockTicks is USER_HZ, the unit of the CPU times in /proc/<pid>/stat. It
+// is 100 on every Linux architecture the agent targets.
+const ClockTicks = 100
+
+// Stat holds the fields of /proc/<pid>/stat used by the agent. CPU times are
+// in clock ticks; RSS is in pages.
+type Stat struct {
+	PID    int
+	Comm   string
+	State  byte
+	PPID   int
+	PGID   int
+	UTime  uint64
+	STime  uint64
+	CUTime uint64
+	CSTime uint64
+	RSS    int64
+}
+
+// ParseStat parses the contents of a /proc/<pid>/stat file. The command name
+// may itself contain spaces and parentheses, so fields are located relative
+// to the last closing parenthesis.
+func ParseStat(data []byte) (Stat, error) {
+	open := bytes.IndexByte(data, '(')
+	closing := bytes.LastIndexByte(data, ')')
+	if open < 0 || closing < open {
+		return Stat{}, fmt.Errorf("malformed stat")
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(data[:open])))
+	if err != nil {
+		return Stat{}, fmt.Errorf("parse pid: %w", err)
+	}
+	fields := bytes.Fields(data[closing+1:])
+	if len(fields) < 3 {
+		return Stat{}, fmt.Errorf("malformed stat: too few fields")
+	}
+	ppid, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return Stat{}, fmt.Errorf("parse ppid: %w", err)
+	}
+	pgid, err := strconv.Atoi(string(fields[2]))
+	if err != nil {
+		return Stat{}, fmt.Errorf("parse pgid: %w", err)
+	}
+	st := Stat{
+		PID:   pid,
+		Comm:  string(data[open+1 : closing]),
+		State: fields[0][0],
+		PPID:  ppid,
+		PGID:  pgid,
+	}
+	// Accounting fields (stat fields 14-17 and 24) are optional so that
+	// truncated fixtures still parse.
+	if len(fields) > 21 {
+		st.UTime, _ = strconv.ParseUint(string(fields[11]), 10, 64)
+		st.STime, _ = strconv.ParseUint(string(fields[12]), 10, 64)
+		st.CUTime, _ = strconv.ParseUint(string(fields[13]), 10, 64)
+		st.CSTime, _ = strconv.ParseUint(string(fields[14]), 10, 64)
+		st.RSS, _ = strconv.ParseInt(string(fields[21]), 10, 64)
+	}
+	return st, nil
+}
+
+// ReadStat reads and parses /proc/<pid>/stat.
+func ReadStat(pid int) (Stat, error) {
+	data, err := os.ReadFile(filepath.Join(Root, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return Stat{}, err
+	}
+	return ParseStat(data)
+}
+
+// Processes returns the stat of every process currently visible in /proc.
+// Processes that exit while being scanned are skipped.
+func Processes() ([]Stat, error) {
+	entries, err := os.ReadDir(Root)
+	if err != nil {
+		return nil, err
+	}
+	stats := make([]Stat, 0, len(entries))
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		st, err := ReadStat(pid)
+		if err != nil {
+			continue
+		}
+		stats = append(stats, st)
+	}
+	return stats, nil
+}
+
+// Descendants returns the PIDs of all processes below pid in the process
+// tree, excluding pid itself.
+func Descendants(pid int) ([]int, error) {
+	tree, err := Tree(pid)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]int, 0, len(tree))
+	for _, st := range tree {
+		if st.PID != pid {
+			out = append(out, st.PID)
+		}
+	}
+	return out, nil
+}
+
+// Tree returns the stat of pid followed by all of its descendants, in
+// breadth-first order. The result is empty if pid no longer exists.
+func Tree(pid int) ([]Stat, error) {
+	procs, err := Processes()
+	if err != nil {
+		return nil, err
+	}
+	byPID := make(map[int]Stat, len(procs))
+	children := make(map[int][]int)
+	for _, p := range procs {
+		byPID[p.PID] = p
+		children[p.PPID] = append(children[p.PPID], p.PID)
+	}
+
+	root, ok := byPID[pid]
+	if !ok {
+		return nil, nil
+	}
+	out := []Stat{root}
+	queue := children[pid]
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		out = append(out, byPID[next])
+		queue = append(queue, children[next]...)
+	}
+	return out, nil
+}
+
+// Workload returns the processes belonging to a command started as leader
+// of process group pid: pid itself (if still present), its descendants, and
+// any member of the group that was reparented after its parent exited.
+func Workload(pid int) ([]Stat, error) {
+	procs, err := Processes()
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]int)
+	byPID := make(map[int]Stat, len(procs))
+	for _, p := range procs {
+		byPID[p.PID] = p
+		children[p.PPID] = append(children[p.PPID], p.PID)
+	}
+
+	seen := make(map[int]bool)
+	var out []Stat
+	add := func(st Stat) {
+		if !seen[st.PID] {
+			seen[st.PID] = true
+			out = append(out, st)
+		}
+	}
+	queue := []int{pid}
+	for _, p := range procs {
+		if p.PGID == pid {
+			queue = append(queue, p.PID)
+		}
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		st, ok := byPID[next]
+		if !ok || seen[next] {
+			continue
+		}
+		add(st)
+		queue = append(queue, children[next]...)
+	}
+	return out, nil
+}
+
+// CountFDs returns the number of open file descriptors of pid.
+func CountFDs(pid int) (int, error) {
+	entries, err := os.ReadDir(filepath.Join(Root, strconv.Itoa(pid), "fd"))
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// ReadCmdline returns the arguments of pid from /proc/<pid>/cmdline. It is
+// empty for kernel threads and zombies.
+func ReadCmdline(pid int) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(Root, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\x00")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\x00"), nil
+}
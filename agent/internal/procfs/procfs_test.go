@@ -0,0 +1,144 @@
+package procfs
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestParseStat_CommWithSpacesAndParens(t *testing.T) {
+	data := []byte("1234 (my (weird) cmd) S 1 1234 1234 0 -1 4194560 100 0 0 0 5 3 0 0 20 0 1 0 100 1000 50")
+	st, err := ParseStat(data)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if st.PID != 1234 || st.PPID != 1 || st.PGID != 1234 {
+		t.Fatalf("unexpected ids: %+v", st)
+	}
+	if st.Comm != "my (weird) cmd" {
+		t.Fatalf("unexpected comm %q", st.Comm)
+	}
+	if st.State != 'S' {
+		t.Fatalf("unexpected state %q", st.State)
+	}
+	if st.UTime != 5 || st.STime != 3 || st.RSS != 50 {
+		t.Fatalf("unexpected accounting fields: %+v", st)
+	}
+}
+
+func TestParseStat_Malformed(t *testing.T) {
+	for _, in := range []string{"", "1234 cmd S 1", "x (cmd) S 1 1"} {
+		if _, err := ParseStat([]byte(in)); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func writeStat(t *testing.T, root string, pid, ppid int) {
+	t.Helper()
+	writeStatGroup(t, root, pid, ppid, pid)
+}
+
+func writeStatGroup(t *testing.T, root string, pid, ppid, pgid int) {
+	t.Helper()
+	dir := filepath.Join(root, strconv.Itoa(pid))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	line := strconv.Itoa(pid) + " (proc) S " + strconv.Itoa(ppid) + " " + strconv.Itoa(pgid) + " 0"
+	if err := os.WriteFile(filepath.Join(dir, "stat"), []byte(line), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTree_MissingRoot(t *testing.T) {
+	root := t.TempDir()
+	old := Root
+	Root = root
+	defer func() { Root = old }()
+
+	writeStat(t, root, 1, 0)
+	tree, err := Tree(42)
+	if err != nil {
+		t.Fatalf("tree: %v", err)
+	}
+	if len(tree) != 0 {
+		t.Fatalf("expected empty tree for missing pid, got %v", tree)
+	}
+}
+
+func TestCountFDs_Self(t *testing.T) {
+	n, err := CountFDs(os.Getpid())
+	if err != nil {
+		t.Skipf("procfs unavailable: %v", err)
+	}
+	if n < 3 {
+		t.Fatalf("expected at least stdio fds, got %d", n)
+	}
+}
+
+func TestDescendants(t *testing.T) {
+	root := t.TempDir()
+	old := Root
+	Root = root
+	defer func() { Root = old }()
+
+	writeStat(t, root, 1, 0)
+	writeStat(t, root, 10, 1)
+	writeStat(t, root, 11, 10)
+	writeStat(t, root, 12, 11)
+	writeStat(t, root, 13, 10)
+	writeStat(t, root, 20, 1)
+	os.MkdirAll(filepath.Join(root, "self"), 0o755)
+
+	got, err := Descendants(10)
+	if err != nil {
+		t.Fatalf("descendants: %v", err)
+	}
+	sort.Ints(got)
+	want := []int{11, 12, 13}
+	if len(got) != len(want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, got)
+		}
+	}
+}
+
+func TestWorkload_IncludesReparentedGroupMembers(t *testing.T) {
+	root := t.TempDir()
+	old := Root
+	Root = root
+	defer func() { Root = old }()
+
+	writeStat(t, root, 1, 0)
+	writeStatGroup(t, root, 10, 1, 10)
+	writeStatGroup(t, root, 11, 10, 10)
+	// 12 was forked by an exited member of group 10 and reparented to init.
+	writeStatGroup(t, root, 12, 1, 10)
+	writeStatGroup(t, root, 13, 12, 13)
+	writeStatGroup(t, root, 20, 1, 20)
+
+	got, err := Workload(10)
+	if err != nil {
+		t.Fatalf("workload: %v", err)
+	}
+	pids := make([]int, 0, len(got))
+	for _, st := range got {
+		pids = append(pids, st.PID)
+	}
+	sort.Ints(pids)
+	want := []int{10, 11, 12, 13}
+	if len(pids) != len(want) {
+		t.Fatalf("expected %v, got %v", want, pids)
+	}
+	for i := range want {
+		if pids[i] != want[i] {
+			t.Fatalf("expected %v, got %v", want, pids)
+		}
+	}
+}
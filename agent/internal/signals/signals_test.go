@@ -0,0 +1,43 @@
+package signals
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := map[string]syscall.Signal{
+		"SIGTERM": syscall.SIGTERM,
+		"term":    syscall.SIGTERM,
+		"SigInt":  syscall.SIGINT,
+		"9":       syscall.SIGKILL,
+		" HUP ":   syscall.SIGHUP,
+		"SIGUSR1": syscall.SIGUSR1,
+	}
+	for in, want := range cases {
+		got, err := Parse(in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", in, err)
+		}
+		if got != want {
+			t.Fatalf("Parse(%q) = %v, want %v", in, got, want)
+		}
+	}
+}
+
+func TestParse_Unknown(t *testing.T) {
+	for _, in := range []string{"", "SIGNOPE", "0", "999"} {
+		if _, err := Parse(in); err == nil {
+			t.Fatalf("expected error for %q", in)
+		}
+	}
+}
+
+func TestName(t *testing.T) {
+	if got := Name(syscall.SIGKILL); got != "SIGKILL" {
+		t.Fatalf("expected SIGKILL, got %s", got)
+	}
+	if got := Name(syscall.Signal(40)); got != "SIG40" {
+		t.Fatalf("expected SIG40, got %s", got)
+	}
+}
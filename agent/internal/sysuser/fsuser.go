@@ -0,0 +1,55 @@
+package sysuser
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+)
+
+// RunAs calls fn with the filesystem credentials of the user, so that the
+// files it opens and creates are subject to the user's permissions and owned
+// by them, as they would be for a command run with Apply. Like Apply it drops
+// supplementary groups.
+//
+// fn runs on a dedicated, locked OS thread whose filesystem uid and gid are
+// changed; the thread is discarded afterwards rather than changed back.
+// fn must not start goroutines that touch the filesystem. For root, fn is
+// called directly.
+func (c *Credentials) RunAs(fn func() error) error {
+	if c.Uid == 0 {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() {
+		// Never unlocked: the runtime terminates the thread when this
+		// goroutine exits, so no other goroutine runs with these
+		// credentials.
+		runtime.LockOSThread()
+		if err := setThreadFSCreds(c.Uid, c.Gid); err != nil {
+			done <- err
+			return
+		}
+		done <- fn()
+	}()
+	return <-done
+}
+
+// setThreadFSCreds switches the calling thread's filesystem ids. The raw
+// syscalls only affect the calling thread, unlike their libc and syscall
+// package counterparts.
+func setThreadFSCreds(uid, gid uint32) error {
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SETGROUPS, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("setgroups: %w", errno)
+	}
+	// setfsuid and setfsgid return the previous id and cannot fail, so read
+	// the id back (an invalid id leaves it unchanged) to check.
+	syscall.RawSyscall(syscall.SYS_SETFSGID, uintptr(gid), 0, 0)
+	if cur, _, _ := syscall.RawSyscall(syscall.SYS_SETFSGID, ^uintptr(0), 0, 0); uint32(cur) != gid {
+		return fmt.Errorf("setfsgid %d: not permitted", gid)
+	}
+	syscall.RawSyscall(syscall.SYS_SETFSUID, uintptr(uid), 0, 0)
+	if cur, _, _ := syscall.RawSyscall(syscall.SYS_SETFSUID, ^uintptr(0), 0, 0); uint32(cur) != uid {
+		return fmt.Errorf("setfsuid %d: not permitted", uid)
+	}
+	return nil
+}
@@ -1,7 +1,9 @@
 package sysuser
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
@@ -16,12 +18,16 @@ var validUsernameRe = regexp.MustCompile(`^[a-zA-Z0-9._-]{1,32}$`)
 
 const defaultSystemPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
 
+// PasswdFile is read to find a user's login shell.
+var PasswdFile = "/etc/passwd"
+
 // Credentials holds resolved system user identity.
 type Credentials struct {
 	Uid      uint32
 	Gid      uint32
 	HomeDir  string
 	Username string
+	Shell    string // login shell from the passwd entry, if any
 }
 
 var cache sync.Map // map[string]*Credentials
@@ -52,11 +58,30 @@ func Resolve(username string) (*Credentials, error) {
 		Gid:      uint32(gid),
 		HomeDir:  u.HomeDir,
 		Username: username,
+		Shell:    lookupShell(username),
 	}
 	cache.Store(username, creds)
 	return creds, nil
 }
 
+// lookupShell returns the login shell field of username's passwd entry, or
+// "" if it cannot be found.
+func lookupShell(username string) string {
+	f, err := os.Open(PasswdFile)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) == 7 && fields[0] == username {
+			return fields[6]
+		}
+	}
+	return ""
+}
+
 func envValue(env []string, key string) string {
 	prefix := key + "="
 	value := ""
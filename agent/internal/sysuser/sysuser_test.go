@@ -1,7 +1,10 @@
 package sysuser
 
 import (
+	"os"
 	"os/exec"
+	"path/filepath"
+	"syscall"
 	"testing"
 )
 
@@ -100,3 +103,61 @@ func TestCredentialsApply_PreservesExplicitDirAndUsesLastPathValue(t *testing.T)
 		t.Fatalf("expected PATH=%q, got %q", wantPath, env["PATH"])
 	}
 }
+
+func TestLookupShell_ReadsPasswdEntry(t *testing.T) {
+	dir := t.TempDir()
+	passwd := filepath.Join(dir, "passwd")
+	content := "root:x:0:0:root:/root:/bin/bash\nubuntu:x:1000:1000::/home/ubuntu:/usr/bin/zsh\nbroken:x\n"
+	if err := os.WriteFile(passwd, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := PasswdFile
+	PasswdFile = passwd
+	defer func() { PasswdFile = old }()
+
+	if got := lookupShell("ubuntu"); got != "/usr/bin/zsh" {
+		t.Fatalf("expected /usr/bin/zsh, got %q", got)
+	}
+	if got := lookupShell("broken"); got != "" {
+		t.Fatalf("expected no shell for a malformed entry, got %q", got)
+	}
+	if got := lookupShell("missing"); got != "" {
+		t.Fatalf("expected no shell for an unknown user, got %q", got)
+	}
+}
+
+func TestCredentialsRunAs_UsesUserPermissions(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir := t.TempDir()
+	os.Chmod(filepath.Dir(dir), 0o755)
+	os.Chmod(dir, 0o777)
+	secret := filepath.Join(dir, "secret")
+	if err := os.WriteFile(secret, []byte("x"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	creds := &Credentials{Uid: 65534, Gid: 65534, Username: "nobody"}
+	err := creds.RunAs(func() error {
+		if _, err := os.ReadFile(secret); !os.IsPermission(err) {
+			t.Errorf("expected reading a root-only file to be denied, got %v", err)
+		}
+		return os.WriteFile(filepath.Join(dir, "mine"), []byte("x"), 0o644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "mine"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); st.Uid != 65534 || st.Gid != 65534 {
+		t.Fatalf("expected the file to be owned by nobody, got %d:%d", st.Uid, st.Gid)
+	}
+	// The calling goroutine keeps the agent's credentials.
+	if _, err := os.ReadFile(secret); err != nil {
+		t.Fatalf("expected root to still read the file, got %v", err)
+	}
+}
@@ -0,0 +1,308 @@
+// Package upload keeps resumable upload sessions: a file is sent in chunks,
+// each appended at the offset the previous ones reached, to a temporary file
+// next to its destination, and moved into place once its checksum has been
+// verified. A client that loses its connection asks for the offset and
+// carries on from there.
+package upload
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxSessions bounds the number of open sessions.
+	MaxSessions = 64
+
+	// TTL is how long a session may go without a chunk before it is
+	// discarded, along with its data.
+	TTL = 24 * time.Hour
+
+	// SweepInterval is how often the agent calls Sweep.
+	SweepInterval = time.Hour
+
+	chunkBufferSize = 256 * 1024
+)
+
+var (
+	ErrTooMany    = errors.New("too many upload sessions")
+	ErrBusy       = errors.New("upload session is busy")
+	ErrTooLarge   = errors.New("upload exceeds the declared size")
+	ErrIncomplete = errors.New("upload is incomplete")
+	ErrChecksum   = errors.New("checksum mismatch")
+)
+
+// OffsetError is returned when a chunk does not start where the data
+// received so far ends.
+type OffsetError struct {
+	Offset int64 // the offset the next chunk must start at
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("chunk must start at offset %d", e.Offset)
+}
+
+// RunAs runs fn with the credentials the session's files are accessed with.
+type RunAs func(fn func() error) error
+
+// Session is an upload in progress.
+type Session struct {
+	ID        string
+	Path      string
+	User      string
+	Size      int64 // declared size, or -1 if unknown
+	Mode      os.FileMode
+	CreatedAt time.Time
+
+	runAs RunAs
+	tmp   string
+
+	busy      sync.Mutex // held while a chunk is written or on commit
+	mu        sync.Mutex
+	offset    int64
+	hash      hash.Hash
+	updatedAt time.Time
+}
+
+// Info is the exported struct for JSON serialization.
+type Info struct {
+	ID        string    `json:"id"`
+	Path      string    `json:"path"`
+	User      string    `json:"user,omitempty"`
+	Offset    int64     `json:"offset"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+var (
+	mu       sync.Mutex
+	sessions = make(map[string]*Session)
+)
+
+func generateID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Create opens a session for a file of size bytes (-1 if unknown) to be
+// written to path with mode. The temporary file is created in path's
+// directory with runAs, so that the final rename stays on one filesystem.
+func Create(path, user string, size int64, mode os.FileMode, runAs RunAs) (*Session, error) {
+	Sweep()
+
+	now := time.Now()
+	s := &Session{
+		ID:        generateID(),
+		Path:      path,
+		User:      user,
+		Size:      size,
+		Mode:      mode,
+		CreatedAt: now,
+		runAs:     runAs,
+		hash:      sha256.New(),
+		updatedAt: now,
+	}
+	s.tmp = filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".upload-"+s.ID)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sessions) >= MaxSessions {
+		return nil, ErrTooMany
+	}
+	err := runAs(func() error {
+		f, err := os.OpenFile(s.tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	})
+	if err != nil {
+		return nil, err
+	}
+	sessions[s.ID] = s
+	return s, nil
+}
+
+// Get returns the session with id, or nil.
+func Get(id string) *Session {
+	mu.Lock()
+	defer mu.Unlock()
+	return sessions[id]
+}
+
+// List returns all sessions ordered by creation time.
+func List() []Info {
+	mu.Lock()
+	list := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	mu.Unlock()
+
+	infos := make([]Info, len(list))
+	for i, s := range list {
+		infos[i] = s.Info()
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].CreatedAt.Before(infos[j].CreatedAt) })
+	return infos
+}
+
+// Sweep discards the sessions that have been idle for longer than TTL.
+func Sweep() {
+	mu.Lock()
+	var expired []*Session
+	for _, s := range sessions {
+		s.mu.Lock()
+		if time.Since(s.updatedAt) > TTL {
+			expired = append(expired, s)
+		}
+		s.mu.Unlock()
+	}
+	mu.Unlock()
+	for _, s := range expired {
+		s.Abort()
+	}
+}
+
+// Info returns a snapshot of the session.
+func (s *Session) Info() Info {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Info{
+		ID:        s.ID,
+		Path:      s.Path,
+		User:      s.User,
+		Offset:    s.offset,
+		Size:      s.Size,
+		CreatedAt: s.CreatedAt,
+		UpdatedAt: s.updatedAt,
+	}
+}
+
+// Offset returns the number of bytes received so far.
+func (s *Session) Offset() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.offset
+}
+
+// Write appends the chunk read from r, which must start at offset. Whatever
+// part of the chunk arrives is kept even if reading r fails, so the client
+// resumes from the returned offset.
+func (s *Session) Write(offset int64, r io.Reader) (int64, error) {
+	if !s.busy.TryLock() {
+		return s.Offset(), ErrBusy
+	}
+	defer s.busy.Unlock()
+	if current := s.Offset(); offset != current {
+		return current, &OffsetError{Offset: current}
+	}
+
+	err := s.runAs(func() error {
+		f, err := os.OpenFile(s.tmp, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		buf := make([]byte, chunkBufferSize)
+		for {
+			n, rerr := r.Read(buf)
+			if n > 0 {
+				if s.Size >= 0 && s.Offset()+int64(n) > s.Size {
+					return ErrTooLarge
+				}
+				// Hash exactly what was written, so the two never
+				// disagree on a partial write.
+				written, werr := f.Write(buf[:n])
+				s.mu.Lock()
+				s.hash.Write(buf[:written])
+				s.offset += int64(written)
+				s.updatedAt = time.Now()
+				s.mu.Unlock()
+				if werr != nil {
+					return werr
+				}
+			}
+			if rerr == io.EOF {
+				return nil
+			}
+			if rerr != nil {
+				return rerr
+			}
+		}
+	})
+	return s.Offset(), err
+}
+
+// Commit checks that the whole file arrived and that its SHA-256 is sum
+// (hex), then moves it to its destination and closes the session. On a
+// checksum mismatch the data is discarded and the session closed too.
+func (s *Session) Commit(sum string) error {
+	if !s.busy.TryLock() {
+		return ErrBusy
+	}
+	defer s.busy.Unlock()
+
+	s.mu.Lock()
+	offset, actual := s.offset, hex.EncodeToString(s.hash.Sum(nil))
+	s.mu.Unlock()
+	if s.Size >= 0 && offset != s.Size {
+		return ErrIncomplete
+	}
+	if !strings.EqualFold(actual, sum) {
+		s.remove()
+		return fmt.Errorf("%w: got sha256 %s", ErrChecksum, actual)
+	}
+
+	err := s.runAs(func() error {
+		if err := os.Chmod(s.tmp, s.Mode); err != nil {
+			return err
+		}
+		return os.Rename(s.tmp, s.Path)
+	})
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	delete(sessions, s.ID)
+	mu.Unlock()
+	return nil
+}
+
+// Abort closes the session and deletes its data.
+func (s *Session) Abort() error {
+	if !s.busy.TryLock() {
+		return ErrBusy
+	}
+	defer s.busy.Unlock()
+	return s.remove()
+}
+
+func (s *Session) remove() error {
+	mu.Lock()
+	delete(sessions, s.ID)
+	mu.Unlock()
+	return s.runAs(func() error {
+		if err := os.Remove(s.tmp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,122 @@
+package upload
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func direct(fn func() error) error { return fn() }
+
+// failingReader returns data and then a non-EOF error, like a dropped
+// connection.
+type failingReader struct{ r io.Reader }
+
+func (f failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+func TestSession_ResumeAndCommit(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "disk.img")
+	data := strings.Repeat("0123456789", 1000)
+	sum := sha256.Sum256([]byte(data))
+
+	s, err := Create(dest, "", int64(len(data)), 0o640, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first chunk is cut short by a dropped connection; what arrived
+	// is kept.
+	offset, err := s.Write(0, failingReader{strings.NewReader(data[:3000])})
+	if err == nil || offset != 3000 {
+		t.Fatalf("expected the partial chunk to be kept, got offset %d, err %v", offset, err)
+	}
+
+	var oe *OffsetError
+	if _, err := s.Write(0, strings.NewReader(data)); !errors.As(err, &oe) || oe.Offset != 3000 {
+		t.Fatalf("expected an offset error at 3000, got %v", err)
+	}
+	if err := s.Commit(hex.EncodeToString(sum[:])); !errors.Is(err, ErrIncomplete) {
+		t.Fatalf("expected an incomplete upload, got %v", err)
+	}
+	if _, err := s.Write(3000, strings.NewReader(data[3000:]+"extra")); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected writing past the declared size to fail, got %v", err)
+	}
+
+	if offset, err := s.Write(3000, strings.NewReader(data[3000:])); err != nil || offset != int64(len(data)) {
+		t.Fatalf("expected the upload to complete, got offset %d, err %v", offset, err)
+	}
+	if err := s.Commit(strings.ToUpper(hex.EncodeToString(sum[:]))); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil || string(got) != data {
+		t.Fatalf("expected the committed file to hold the data, got %d bytes, err %v", len(got), err)
+	}
+	if info, _ := os.Stat(dest); info.Mode().Perm() != 0o640 {
+		t.Fatalf("expected mode 0640, got %v", info.Mode())
+	}
+	if Get(s.ID) != nil {
+		t.Fatal("expected the session to be closed after commit")
+	}
+}
+
+func TestSession_ChecksumMismatchDiscards(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "data.bin")
+
+	s, err := Create(dest, "", -1, 0o644, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(0, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Commit(strings.Repeat("0", 64)); !errors.Is(err, ErrChecksum) {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	if Get(s.ID) != nil {
+		t.Fatal("expected the session to be closed")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("expected no files left behind, got %v", entries)
+	}
+}
+
+func TestSweep_DiscardsIdleSessions(t *testing.T) {
+	dir := t.TempDir()
+	idle, err := Create(filepath.Join(dir, "idle.bin"), "", -1, 0o644, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := Create(filepath.Join(dir, "active.bin"), "", -1, 0o644, direct)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer active.Abort()
+
+	idle.mu.Lock()
+	idle.updatedAt = time.Now().Add(-TTL - time.Minute)
+	idle.mu.Unlock()
+	Sweep()
+
+	if Get(idle.ID) != nil || Get(active.ID) == nil {
+		t.Fatal("expected only the idle session to be discarded")
+	}
+	if _, err := os.Stat(idle.tmp); !os.IsNotExist(err) {
+		t.Fatalf("expected the idle session's data to be removed, got %v", err)
+	}
+}
@@ -9,8 +9,15 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"time"
 
+	"github.com/angelorc/vmsan/agent/internal/admission"
+	"github.com/angelorc/vmsan/agent/internal/cgroup"
+	"github.com/angelorc/vmsan/agent/internal/cmdstore"
+	"github.com/angelorc/vmsan/agent/internal/execctx"
+	"github.com/angelorc/vmsan/agent/internal/kernel"
+	"github.com/angelorc/vmsan/agent/internal/upload"
 	"github.com/angelorc/vmsan/agent/shell"
 )
 
@@ -64,6 +71,9 @@ func (rec *statusRecorder) Unwrap() http.ResponseWriter {
 func main() {
 	port := flag.Int("port", 9119, "listen port")
 	token := flag.String("token", "", "auth token (or VMSAN_AGENT_TOKEN env)")
+	execRetention := flag.Duration("exec-retention", 0, "how long finished commands stay queryable (or VMSAN_EXEC_RETENTION env, default 10m)")
+	maxCommands := flag.Int("max-commands", 0, "max concurrently running commands (or VMSAN_MAX_COMMANDS env, default 16)")
+	maxQueue := flag.Int("max-queue", -1, "max commands waiting for a slot (or VMSAN_MAX_QUEUE env, default 64)")
 	flag.Parse()
 
 	if *token == "" {
@@ -73,6 +83,52 @@ func main() {
 		log.Fatal("auth token required: use --token or VMSAN_AGENT_TOKEN env")
 	}
 
+	if *execRetention == 0 {
+		if v := os.Getenv("VMSAN_EXEC_RETENTION"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("invalid VMSAN_EXEC_RETENTION: %v", err)
+			}
+			*execRetention = d
+		}
+	}
+	if *execRetention > 0 {
+		cmdstore.Retention = *execRetention
+	}
+
+	if *maxCommands == 0 {
+		*maxCommands = envInt("VMSAN_MAX_COMMANDS", defaultMaxCommands)
+	}
+	if *maxQueue < 0 {
+		*maxQueue = envInt("VMSAN_MAX_QUEUE", defaultMaxQueue)
+	}
+	if *maxCommands < 1 || *maxQueue < 0 {
+		log.Fatal("max-commands must be at least 1 and max-queue must not be negative")
+	}
+	execAdmission = admission.New(*maxCommands, *maxQueue)
+
+	// Leaves of a previous run can only be told apart from new ones before
+	// any workload starts.
+	cgroup.Sweep()
+
+	// Discard idle uploads, contexts and kernels even when no new ones are
+	// created.
+	go func() {
+		for range time.Tick(upload.SweepInterval) {
+			upload.Sweep()
+		}
+	}()
+	go func() {
+		for range time.Tick(execctx.SweepInterval) {
+			execctx.Sweep()
+		}
+	}()
+	go func() {
+		for range time.Tick(kernel.SweepInterval) {
+			kernel.Sweep()
+		}
+	}()
+
 	defaultUser := os.Getenv("VMSAN_DEFAULT_USER")
 	if defaultUser == "" {
 		defaultUser = "ubuntu"
@@ -90,9 +146,49 @@ func main() {
 	// authenticated requests are logged. Auth failures are rejected before
 	// reaching the audit layer.
 	mux.Handle("POST /exec", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeRunHandler(logger, defaultUser)))))
+	mux.Handle("POST /exec/expect", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeExpectHandler(logger, defaultUser)))))
+	mux.Handle("POST /exec/batch", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeBatchHandler(logger, defaultUser)))))
+	mux.Handle("GET /exec", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleListCommands))))
+	mux.Handle("GET /exec/{id}", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleGetCommand))))
 	mux.Handle("POST /exec/{id}/kill", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleKill))))
-	mux.Handle("POST /files/write", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFilesWriteHandler(logger)))))
-	mux.Handle("POST /files/read", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFilesReadHandler(logger)))))
+	mux.Handle("POST /exec/{id}/stdin", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleStdin))))
+	mux.Handle("POST /exec/{id}/resize", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleResize))))
+	mux.Handle("GET /exec/{id}/logs", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleLogs))))
+	mux.Handle("GET /exec/{id}/events", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleEvents))))
+	mux.Handle("GET /ws/exec", wsAuthMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeExecWSHandler(logger, defaultUser)))))
+	mux.Handle("GET /ws/exec/{id}", wsAuthMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleExecWSAttach))))
+	mux.Handle("GET /ports", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleListPorts))))
+	mux.Handle("GET /ports/events", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handlePortEvents))))
+	mux.Handle("POST /wait", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeWaitHandler(logger)))))
+	mux.Handle("POST /contexts", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeContextCreateHandler(logger, defaultUser)))))
+	mux.Handle("GET /contexts", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleListContexts))))
+	mux.Handle("GET /contexts/{id}", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleGetContext))))
+	mux.Handle("DELETE /contexts/{id}", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleDeleteContext))))
+	mux.Handle("POST /kernels", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeKernelCreateHandler(logger, defaultUser)))))
+	mux.Handle("GET /kernels", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleListKernels))))
+	mux.Handle("GET /kernels/{id}", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleGetKernel))))
+	mux.Handle("DELETE /kernels/{id}", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleDeleteKernel))))
+	mux.Handle("POST /kernels/{id}/execute", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeKernelExecuteHandler(logger)))))
+	mux.Handle("POST /kernels/{id}/interrupt", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleKernelInterrupt))))
+	mux.Handle("POST /kernels/{id}/restart", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeKernelRestartHandler(logger)))))
+	mux.Handle("POST /files/write", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFilesWriteHandler(logger, defaultUser)))))
+	mux.Handle("POST /files/read", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFilesReadHandler(logger, defaultUser)))))
+	mux.Handle("GET /files/read", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFilesReadHandler(logger, defaultUser)))))
+	mux.Handle("POST /files/stat", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFSHandler(logger, defaultUser, "stat", fsStat)))))
+	mux.Handle("POST /files/readdir", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFSHandler(logger, defaultUser, "readdir", fsReaddir)))))
+	mux.Handle("POST /files/mkdir", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFSHandler(logger, defaultUser, "mkdir", fsMkdir)))))
+	mux.Handle("POST /files/rename", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFSHandler(logger, defaultUser, "rename", fsRename)))))
+	mux.Handle("POST /files/remove", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFSHandler(logger, defaultUser, "remove", fsRemove)))))
+	mux.Handle("POST /files/chmod", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFSHandler(logger, defaultUser, "chmod", fsChmod)))))
+	mux.Handle("POST /files/chown", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFSHandler(logger, defaultUser, "chown", fsChown)))))
+	mux.Handle("POST /files/symlink", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFSHandler(logger, defaultUser, "symlink", fsSymlink)))))
+	mux.Handle("POST /files/uploads", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeUploadCreateHandler(logger, defaultUser)))))
+	mux.Handle("GET /files/uploads", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleListUploads))))
+	mux.Handle("GET /files/uploads/{id}", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleGetUpload))))
+	mux.Handle("PATCH /files/uploads/{id}", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeUploadChunkHandler(logger)))))
+	mux.Handle("POST /files/uploads/{id}/commit", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeUploadCommitHandler(logger)))))
+	mux.Handle("DELETE /files/uploads/{id}", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(handleDeleteUpload))))
+	mux.Handle("POST /files/archive", authMiddleware(*token, auditMiddleware(logger, http.HandlerFunc(makeFilesArchiveHandler(logger, defaultUser)))))
 
 	// Shell subsystem (WebSocket + REST)
 	shellHandler := shell.NewHandler(*token, defaultUser, logger)
@@ -104,3 +200,17 @@ func main() {
 		log.Fatalf("server error: %v", err)
 	}
 }
+
+// envInt returns the integer value of the environment variable name, or def
+// when it is unset.
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return n
+}
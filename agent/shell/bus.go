@@ -10,8 +10,10 @@ import (
 	"os"
 	"os/exec"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/angelorc/vmsan/agent/internal/cgroup"
 	"github.com/angelorc/vmsan/agent/internal/sysuser"
 	"github.com/creack/pty"
 	"github.com/gorilla/websocket"
@@ -51,6 +53,7 @@ type Session struct {
 
 	ptmx   *os.File
 	cmd    *exec.Cmd
+	cgroup *cgroup.Group // nil when cgroup v2 is unavailable
 	ctx    context.Context
 	cancel context.CancelFunc
 
@@ -67,10 +70,14 @@ type Session struct {
 	logger    *slog.Logger
 }
 
+// ErrLimits is returned when a session's resource limits cannot be applied.
+var ErrLimits = errors.New("limits")
+
 // NewSession creates a PTY session, starts the producer and wait loops,
 // and arms the inactivity timer. When runAs is non-empty the shell runs
-// as that system user.
-func NewSession(id, shell, runAs string, onDestroy func(string), logger *slog.Logger) (*Session, error) {
+// as that system user. The shell and everything it starts are confined to
+// limits; the time limits are not enforced for sessions.
+func NewSession(id, shell, runAs string, limits cgroup.Limits, onDestroy func(string), logger *slog.Logger) (*Session, error) {
 	cmd := exec.Command(shell)
 	cmd.Env = append(os.Environ(), "TERM=xterm-256color")
 
@@ -82,8 +89,38 @@ func NewSession(id, shell, runAs string, onDestroy func(string), logger *slog.Lo
 		creds.Apply(cmd)
 	}
 
+	// Give the session its own cgroup leaf so it is accounted separately
+	// from exec workloads. Sessions without limits still start when cgroups
+	// are unavailable.
+	cg, err := cgroup.New("shell", limits)
+	if err != nil {
+		if limits.NeedsCgroup() {
+			return nil, fmt.Errorf("%w: %s", ErrLimits, err)
+		}
+		if !errors.Is(err, cgroup.ErrUnavailable) {
+			logger.Warn("shell cgroup", "error", err)
+		}
+		cg = nil
+	}
+	if cg != nil {
+		cgFile, err := cg.Open()
+		if err != nil {
+			cg.Remove()
+			return nil, fmt.Errorf("open cgroup: %w", err)
+		}
+		defer cgFile.Close()
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.UseCgroupFD = true
+		cmd.SysProcAttr.CgroupFD = int(cgFile.Fd())
+	}
+
 	ptmx, err := pty.Start(cmd)
 	if err != nil {
+		if cg != nil {
+			cg.Remove()
+		}
 		return nil, fmt.Errorf("pty start: %w", err)
 	}
 
@@ -95,6 +132,7 @@ func NewSession(id, shell, runAs string, onDestroy func(string), logger *slog.Lo
 		CreatedAt:   time.Now(),
 		ptmx:        ptmx,
 		cmd:         cmd,
+		cgroup:      cg,
 		ctx:         ctx,
 		cancel:      cancel,
 		subscribers: make(map[string]*subscriber),
@@ -264,6 +302,9 @@ func (s *Session) subscriberReadPump(sub *subscriber) {
 func (s *Session) waitLoop() {
 	s.cmd.Wait()
 	s.destroy()
+	if s.cgroup != nil {
+		s.cgroup.Remove()
+	}
 }
 
 // destroy kills the PTY, cancels all contexts, sends close frames, and
@@ -362,8 +403,8 @@ func NewSessionManager(logger *slog.Logger) *SessionManager {
 
 // CreateSession creates a new PTY session with the given shell.
 // Enforces DefaultMaxSessions limit. When runAs is non-empty the shell
-// process runs as that system user.
-func (m *SessionManager) CreateSession(shell, runAs string) (*Session, error) {
+// process runs as that system user, confined to limits.
+func (m *SessionManager) CreateSession(shell, runAs string, limits cgroup.Limits) (*Session, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -383,7 +424,7 @@ func (m *SessionManager) CreateSession(shell, runAs string) (*Session, error) {
 		m.logger.Info("session removed from manager", "sessionId", sid)
 	}
 
-	s, err := NewSession(id, shell, runAs, onDestroy, m.logger)
+	s, err := NewSession(id, shell, runAs, limits, onDestroy, m.logger)
 	if err != nil {
 		return nil, err
 	}
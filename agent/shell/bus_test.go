@@ -1,10 +1,15 @@
 package shell
 
 import (
+	"errors"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/angelorc/vmsan/agent/internal/cgroup"
 )
 
 func testLogger() *slog.Logger {
@@ -17,14 +22,14 @@ func TestSessionManager_MaxSessions(t *testing.T) {
 
 	created := make([]*Session, 0, DefaultMaxSessions)
 	for i := 0; i < DefaultMaxSessions; i++ {
-		s, err := m.CreateSession("/bin/sh", "")
+		s, err := m.CreateSession("/bin/sh", "", cgroup.Limits{})
 		if err != nil {
 			t.Fatalf("failed to create session %d: %v", i, err)
 		}
 		created = append(created, s)
 	}
 
-	_, err := m.CreateSession("/bin/sh", "")
+	_, err := m.CreateSession("/bin/sh", "", cgroup.Limits{})
 	if err == nil {
 		t.Fatal("expected error when exceeding max sessions")
 	}
@@ -39,7 +44,7 @@ func TestSessionManager_CreateAndGet(t *testing.T) {
 	logger := testLogger()
 	m := NewSessionManager(logger)
 
-	s, err := m.CreateSession("/bin/sh", "")
+	s, err := m.CreateSession("/bin/sh", "", cgroup.Limits{})
 	if err != nil {
 		t.Fatalf("create session: %v", err)
 	}
@@ -61,13 +66,13 @@ func TestSessionManager_ListSessions(t *testing.T) {
 	logger := testLogger()
 	m := NewSessionManager(logger)
 
-	s1, err := m.CreateSession("/bin/sh", "")
+	s1, err := m.CreateSession("/bin/sh", "", cgroup.Limits{})
 	if err != nil {
 		t.Fatalf("create session 1: %v", err)
 	}
 	defer s1.destroy()
 
-	s2, err := m.CreateSession("/bin/sh", "")
+	s2, err := m.CreateSession("/bin/sh", "", cgroup.Limits{})
 	if err != nil {
 		t.Fatalf("create session 2: %v", err)
 	}
@@ -94,7 +99,7 @@ func TestSessionManager_KillSession(t *testing.T) {
 	logger := testLogger()
 	m := NewSessionManager(logger)
 
-	s, err := m.CreateSession("/bin/sh", "")
+	s, err := m.CreateSession("/bin/sh", "", cgroup.Limits{})
 	if err != nil {
 		t.Fatalf("create session: %v", err)
 	}
@@ -127,7 +132,7 @@ func TestSession_MaxSubscribers(t *testing.T) {
 	logger := testLogger()
 	m := NewSessionManager(logger)
 
-	s, err := m.CreateSession("/bin/sh", "")
+	s, err := m.CreateSession("/bin/sh", "", cgroup.Limits{})
 	if err != nil {
 		t.Fatalf("create session: %v", err)
 	}
@@ -157,7 +162,7 @@ func TestSession_InactivityTimeout(t *testing.T) {
 		t.Fatalf("generate id: %v", err)
 	}
 
-	s, err := NewSession(id, "/bin/sh", "", onDestroy, logger)
+	s, err := NewSession(id, "/bin/sh", "", cgroup.Limits{}, onDestroy, logger)
 	if err != nil {
 		t.Fatalf("create session: %v", err)
 	}
@@ -187,7 +192,7 @@ func TestSession_Info(t *testing.T) {
 	logger := testLogger()
 	m := NewSessionManager(logger)
 
-	s, err := m.CreateSession("/bin/sh", "")
+	s, err := m.CreateSession("/bin/sh", "", cgroup.Limits{})
 	if err != nil {
 		t.Fatalf("create session: %v", err)
 	}
@@ -226,3 +231,23 @@ func TestGenerateID(t *testing.T) {
 		t.Fatal("expected unique IDs")
 	}
 }
+
+func TestSessionManager_AppliesLimits(t *testing.T) {
+	m := NewSessionManager(testLogger())
+	s, err := m.CreateSession("/bin/sh", "", cgroup.Limits{PidsMax: 32})
+	if !cgroup.Available() {
+		if !errors.Is(err, ErrLimits) {
+			t.Fatalf("expected limits to be refused without cgroup v2, got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	defer s.destroy()
+
+	got, err := os.ReadFile(filepath.Join(s.cgroup.Path, "pids.max"))
+	if err != nil || strings.TrimSpace(string(got)) != "32" {
+		t.Fatalf("expected pids.max 32, got %q, err %v", got, err)
+	}
+}
@@ -3,11 +3,16 @@ package shell
 import (
 	"crypto/subtle"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"path/filepath"
+	"strconv"
 	"strings"
 
+	"github.com/angelorc/vmsan/agent/internal/cgroup"
 	"github.com/gorilla/websocket"
 )
 
@@ -52,7 +57,8 @@ func (h *Handler) Register(mux *http.ServeMux) {
 }
 
 // handleNewSession creates a new PTY session and attaches the caller as the
-// first WebSocket subscriber.
+// first WebSocket subscriber. The memoryMax, cpuQuota, cpuWeight, pidsMax
+// and ioWeight query params limit the session like the limits of POST /exec.
 func (h *Handler) handleNewSession(w http.ResponseWriter, r *http.Request) {
 	if !h.checkQueryToken(r) {
 		http.Error(w, `{"error":"invalid token"}`, http.StatusForbidden)
@@ -77,10 +83,20 @@ func (h *Handler) handleNewSession(w http.ResponseWriter, r *http.Request) {
 		runAs = h.defaultUser
 	}
 
-	session, err := h.manager.CreateSession(shell, runAs)
+	limits, err := parseLimits(r.URL.Query())
+	if err != nil {
+		encoded, _ := json.Marshal("limits: " + err.Error())
+		http.Error(w, `{"error":`+string(encoded)+`}`, http.StatusBadRequest)
+		return
+	}
+
+	session, err := h.manager.CreateSession(shell, runAs, limits)
 	if err != nil {
 		if err.Error() == "max sessions reached" {
 			http.Error(w, `{"error":"too many concurrent sessions"}`, http.StatusTooManyRequests)
+		} else if errors.Is(err, ErrLimits) {
+			encoded, _ := json.Marshal(err.Error())
+			http.Error(w, `{"error":`+string(encoded)+`}`, http.StatusBadRequest)
 		} else {
 			h.logger.Error("shell.session.create_failed", "shell", shell, "user", runAs, "error", err)
 			// Sanitize: only include the first line to avoid leaking stack traces.
@@ -174,6 +190,37 @@ func (h *Handler) handleAttach(w http.ResponseWriter, r *http.Request) {
 	)
 }
 
+// parseLimits reads a session's resource limits from query params.
+func parseLimits(q url.Values) (cgroup.Limits, error) {
+	var l cgroup.Limits
+	ints := []struct {
+		name string
+		set  func(int64)
+	}{
+		{"memoryMax", func(v int64) { l.MemoryMax = v }},
+		{"cpuWeight", func(v int64) { l.CPUWeight = int(v) }},
+		{"pidsMax", func(v int64) { l.PidsMax = v }},
+		{"ioWeight", func(v int64) { l.IOWeight = int(v) }},
+	}
+	for _, p := range ints {
+		if v := q.Get(p.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return l, fmt.Errorf("%s must be an integer", p.name)
+			}
+			p.set(n)
+		}
+	}
+	if v := q.Get("cpuQuota"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return l, errors.New("cpuQuota must be a number")
+		}
+		l.CPUQuota = f
+	}
+	return l, l.Validate()
+}
+
 // handleListSessions returns JSON info for all active sessions.
 func (h *Handler) handleListSessions(w http.ResponseWriter, r *http.Request) {
 	sessions := h.manager.ListSessions()
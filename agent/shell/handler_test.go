@@ -0,0 +1,18 @@
+package shell
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	l, err := parseLimits(url.Values{"memoryMax": {"1048576"}, "cpuQuota": {"0.5"}, "pidsMax": {"64"}})
+	if err != nil || l.MemoryMax != 1048576 || l.CPUQuota != 0.5 || l.PidsMax != 64 {
+		t.Fatalf("unexpected limits %+v, err %v", l, err)
+	}
+	for _, q := range []url.Values{{"memoryMax": {"1G"}}, {"cpuWeight": {"0x10"}}, {"ioWeight": {"20000"}}, {"cpuQuota": {"-1"}}} {
+		if _, err := parseLimits(q); err == nil {
+			t.Fatalf("expected %v to be rejected", q)
+		}
+	}
+}
@@ -8,6 +8,7 @@ import { createCommandLogger } from "../lib/logger/index.ts";
 import { handleCommandError } from "../errors/index.ts";
 import { resolveVmState, waitForAgent } from "../lib/vm-context.ts";
 import { AgentClient } from "../services/agent.ts";
+import { DEFAULT_AGENT_USER } from "../lib/agent-service.ts";
 
 const downloadCommand = defineCommand({
   meta: {
@@ -25,6 +26,11 @@ const downloadCommand = defineCommand({
       alias: "d",
       description: "Local destination path (default: basename of remote path in cwd)",
     },
+    user: {
+      type: "string",
+      alias: "u",
+      description: `User to read the file as (default: ${DEFAULT_AGENT_USER})`,
+    },
   },
   async run({ args }) {
     const cmdLog = createCommandLogger("download");
@@ -51,7 +57,7 @@ const downloadCommand = defineCommand({
 
       consola.debug(`Remote path: ${remotePath}`);
       log.start(`Downloading ${remotePath}...`);
-      const data = await agent.readFile(remotePath);
+      const data = await agent.readFile(remotePath, args.user);
 
       if (data === null) {
         consola.error(`File not found on VM: ${remotePath}`);
@@ -77,7 +83,7 @@ const downloadCommand = defineCommand({
       writeFileSync(localPath, data);
 
       log.success(`Downloaded to ${localPath} (${data.length} bytes)`);
-      cmdLog.set({ vmId: args.vmId, remotePath, localPath });
+      cmdLog.set({ vmId: args.vmId, remotePath, localPath, user: args.user });
       cmdLog.emit();
     } catch (error) {
       handleCommandError(error, cmdLog);
@@ -8,6 +8,11 @@ import { createCommandLogger } from "../lib/logger/index.ts";
 import { handleCommandError } from "../errors/index.ts";
 import { resolveVmState, waitForAgent } from "../lib/vm-context.ts";
 import { AgentClient } from "../services/agent.ts";
+import { DEFAULT_AGENT_USER } from "../lib/agent-service.ts";
+
+function homeDir(user: string): string {
+  return user === "root" ? "/root" : `/home/${user}`;
+}
 
 const uploadCommand = defineCommand({
   meta: {
@@ -23,8 +28,12 @@ const uploadCommand = defineCommand({
     dest: {
       type: "string",
       alias: "d",
-      default: "/root",
-      description: "Destination directory inside the VM (default: /root)",
+      description: "Destination directory inside the VM (default: the user's home)",
+    },
+    user: {
+      type: "string",
+      alias: "u",
+      description: `User to write the files as (default: ${DEFAULT_AGENT_USER})`,
     },
   },
   async run({ args }) {
@@ -55,12 +64,13 @@ const uploadCommand = defineCommand({
       consola.debug(`File sizes: ${files.map((f) => `${f.path}=${f.content.length}b`).join(", ")}`);
 
       const agent = new AgentClient(`http://${guestIp}:${port}`, state.agentToken);
+      const dest = args.dest || homeDir(args.user || DEFAULT_AGENT_USER);
 
-      log.start(`Uploading ${files.length} file(s) to ${args.dest}...`);
-      await agent.writeFiles(files, args.dest);
+      log.start(`Uploading ${files.length} file(s) to ${dest}...`);
+      await agent.writeFiles(files, dest, args.user);
 
-      log.success(`Uploaded ${files.length} file(s) to ${args.dest}`);
-      cmdLog.set({ vmId: args.vmId, files: filePaths, dest: args.dest });
+      log.success(`Uploaded ${files.length} file(s) to ${dest}`);
+      cmdLog.set({ vmId: args.vmId, files: filePaths, dest, user: args.user });
       cmdLog.emit();
     } catch (error) {
       handleCommandError(error, cmdLog);
@@ -19,10 +19,13 @@ WantedBy=multi-user.target
 `;
 }
 
+/** The user the agent runs commands and file operations as by default. */
+export const DEFAULT_AGENT_USER = "ubuntu";
+
 export function generateAgentEnv(token: string, port: number, vmId: string): string {
   return `VMSAN_AGENT_TOKEN=${token}
 VMSAN_AGENT_PORT=${port}
 VMSAN_VM_ID=${vmId}
-VMSAN_DEFAULT_USER=ubuntu
+VMSAN_DEFAULT_USER=${DEFAULT_AGENT_USER}
 `;
 }
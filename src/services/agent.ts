@@ -121,7 +121,11 @@ export class AgentClient {
     }
   }
 
-  async writeFiles(files: WriteFileEntry[], extractDir?: string): Promise<void> {
+  /**
+   * Extracts files into extractDir, written as user (the agent's default
+   * user when omitted).
+   */
+  async writeFiles(files: WriteFileEntry[], extractDir?: string, user?: string): Promise<void> {
     const tarPack = pack();
     for (const file of files) {
       tarPack.entry({ name: file.path }, file.content);
@@ -138,6 +142,9 @@ export class AgentClient {
     if (extractDir) {
       headers["X-Extract-Dir"] = extractDir;
     }
+    if (user) {
+      headers["X-User"] = user;
+    }
 
     const res = await fetch(`${this.baseUrl}/files/write`, {
       method: "POST",
@@ -237,14 +244,15 @@ export class AgentClient {
     return command.wait({ signal });
   }
 
-  async readFile(path: string): Promise<Buffer | null> {
+  /** Reads path as user (the agent's default user when omitted). */
+  async readFile(path: string, user?: string): Promise<Buffer | null> {
     const res = await fetch(`${this.baseUrl}/files/read`, {
       method: "POST",
       headers: {
         "Content-Type": "application/json",
         Authorization: `Bearer ${this.token}`,
       },
-      body: JSON.stringify({ path }),
+      body: JSON.stringify({ path, user }),
     });
 
     if (res.status === 404) {